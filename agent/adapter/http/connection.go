@@ -63,10 +63,15 @@ func (h *ConnectionHandler) handleGet(rw http.ResponseWriter, req *http.Request,
 func (h *ConnectionHandler) handleList(rw http.ResponseWriter, req *http.Request) (interface{}, error) {
 
 	args := &structs.ConnectionListRequest{
-		QueryOptions: parseQueryOptions(req),
-		InterfaceID:  req.URL.Query().Get("interface"),
-		NodeID:       req.URL.Query().Get("node"),
-		NetworkID:    req.URL.Query().Get("network"),
+		QueryOptions:   parseQueryOptions(req),
+		InterfaceID:    req.URL.Query().Get("interface"),
+		NodeID:         req.URL.Query().Get("node"),
+		NetworkID:      req.URL.Query().Get("network"),
+		NodeIDs:        req.URL.Query()["nodes"],
+		ContainsIP:     req.URL.Query().Get("ip"),
+		ExcludeIDs:     req.URL.Query()["exclude"],
+		GroupID:        req.URL.Query().Get("group"),
+		IncludeSamples: req.URL.Query().Get("samples") == "true",
 	}
 
 	var out structs.ConnectionListResponse
@@ -95,8 +100,9 @@ func (h *ConnectionHandler) handlePost(rw http.ResponseWriter, req *http.Request
 	}
 
 	args := &structs.ConnectionUpsertRequest{
-		Connection:   &conn,
-		WriteRequest: parseWriteRequestOptions(req),
+		Connection:     &conn,
+		IdempotencyKey: req.Header.Get("Idempotency-Key"),
+		WriteRequest:   parseWriteRequestOptions(req),
 	}
 
 	var out structs.GenericResponse
@@ -110,8 +116,14 @@ func (h *ConnectionHandler) handlePost(rw http.ResponseWriter, req *http.Request
 func (h *ConnectionHandler) handleDelete(rw http.ResponseWriter, req *http.Request, connID string) (interface{}, error) {
 
 	args := structs.ConnectionDeleteRequest{
-		WriteRequest:  parseWriteRequestOptions(req),
-		ConnectionIDs: []string{connID},
+		WriteRequest: parseWriteRequestOptions(req),
+		GroupID:      req.URL.Query().Get("group"),
+	}
+
+	if connID != "" {
+		args.ConnectionIDs = []string{connID}
+	} else if args.GroupID == "" {
+		return nil, NewCodedError(400, ErrBadRequest)
 	}
 
 	var out structs.GenericResponse
@@ -249,6 +249,8 @@ func (c *Client) run() {
 
 	go c.synchronizeInterfaces()
 
+	go c.reportPeers()
+
 	for {
 		select {
 		case desired := <-interfacesUpdateCh:
@@ -410,6 +412,38 @@ func (c *Client) synchronizeInterfaces() {
 	}
 }
 
+func (c *Client) reportPeers() {
+
+	for {
+
+		c.logger.Debugf("reporting peer status (client -> server)")
+
+		peers, err := c.niController.Peers()
+		if err != nil {
+			c.logger.Warnf("could not retrieve peers from controller")
+		}
+
+		if len(peers) > 0 {
+			req := &structs.NodePeerReportRequest{
+				NodeID: c.NodeID(),
+				Peers:  peers,
+			}
+
+			var resp structs.GenericResponse
+			if err := c.RPC("Node.ReportPeers", req, &resp); err != nil {
+				c.logger.Debugf("error reporting peers: %v", err)
+			}
+		}
+
+		retryCh := time.After(randomDuration(c.config.ReconcileInterval, 0*time.Second))
+		select {
+		case <-c.shutdownCh:
+			return
+		case <-retryCh:
+		}
+	}
+}
+
 func (c *Client) tryToRegisterUntilSuccessful() {
 
 	for {
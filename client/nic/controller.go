@@ -19,6 +19,10 @@ import (
 
 const (
 	linkTypeWireguard = "wireguard"
+
+	// Overhead added by WireGuard to each packet, including the outer IP header.
+	wireguardOverheadIPv4 = 60
+	wireguardOverheadIPv6 = 80
 )
 
 // Config contains configurations for a network controller.
@@ -93,6 +97,71 @@ func (c *Controller) Interfaces() ([]*structs.Interface, error) {
 	return out, nil
 }
 
+// Peers returns the state of the peers of all network interfaces
+// managed by the controller.
+func (c *Controller) Peers() ([]*structs.PeerReport, error) {
+
+	out := []*structs.PeerReport{}
+
+	links, err := linksByPrefix(c.config.InterfacesPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, l := range links {
+
+		dev, err := c.wg.Device(l.Attrs().Name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range dev.Peers {
+			report := &structs.PeerReport{
+				InterfaceID: l.Attrs().Alias,
+				PublicKey:   p.PublicKey.String(),
+				RxBytes:     uint64(p.ReceiveBytes),
+				TxBytes:     uint64(p.TransmitBytes),
+			}
+			if p.Endpoint != nil {
+				if mtu, err := pathMTU(p.Endpoint.IP); err == nil {
+					report.DiscoveredMTU = &mtu
+				}
+			}
+			out = append(out, report)
+		}
+	}
+
+	return out, nil
+}
+
+// pathMTU returns the MTU of the path towards an IP address, as known by the
+// kernel, net of the WireGuard overhead. If the kernel hasn't discovered the
+// path MTU, the MTU of the outgoing link is used.
+func pathMTU(ip net.IP) (int, error) {
+
+	routes, err := netlink.RouteGet(ip)
+	if err != nil {
+		return 0, err
+	}
+	if len(routes) == 0 {
+		return 0, fmt.Errorf("no route to %s", ip)
+	}
+
+	mtu := routes[0].MTU
+	if mtu == 0 {
+		link, err := netlink.LinkByIndex(routes[0].LinkIndex)
+		if err != nil {
+			return 0, err
+		}
+		mtu = link.Attrs().MTU
+	}
+
+	if ip.To4() != nil {
+		return mtu - wireguardOverheadIPv4, nil
+	}
+	return mtu - wireguardOverheadIPv6, nil
+}
+
 // DeleteInterfaceByName deletes a network interface and all associated routes by name.
 func (c *Controller) DeleteInterfaceByName(s string) error {
 	err := deleteLinkAndRoutesByName(s)
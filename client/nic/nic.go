@@ -7,6 +7,7 @@ import (
 // NetworkInterfaceController provides network configuration capabilities.
 type NetworkInterfaceController interface {
 	Interfaces() ([]*structs.Interface, error)
+	Peers() ([]*structs.PeerReport, error)
 	CreateInterface(iface *structs.Interface) error
 	UpdateInterface(iface *structs.Interface) error
 	DeleteInterfaceByAlias(s string) error
@@ -53,6 +53,14 @@ type Config struct {
 
 	// HostGCInterval is how often we perform garbage collection of hosts.
 	HostGCInterval time.Duration
+
+	// ConnectionGCInterval is how often expired connections are purged.
+	// If zero, they are never purged automatically.
+	ConnectionGCInterval time.Duration
+
+	// ConnectionCacheSize is the number of connections to be cached in memory.
+	// If zero, connections are always read from the state repository.
+	ConnectionCacheSize int
 }
 
 // Ports :
@@ -74,8 +82,9 @@ func DefaultConfig() *Config {
 			HTTP: defaultHTTPPort,
 			RPC:  defaultRPCPort,
 		},
-		ACL:            config.DefaultACLConfig(),
-		Etcd:           config.DefaultEtcdConfig(),
-		HostGCInterval: 5 * time.Minute,
+		ACL:                  config.DefaultACLConfig(),
+		Etcd:                 config.DefaultEtcdConfig(),
+		HostGCInterval:       5 * time.Minute,
+		ConnectionGCInterval: time.Minute,
 	}
 }
@@ -2,7 +2,10 @@ package drago
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"sync"
 	"time"
 
 	auth "github.com/seashell/drago/drago/auth"
@@ -23,6 +26,8 @@ type ConnectionService struct {
 	logger      log.Logger
 	state       state.Repository
 	authHandler auth.AuthorizationHandler
+
+	purgeLock sync.Mutex
 }
 
 // NewConnectionService ...
@@ -60,6 +65,19 @@ func (s *ConnectionService) GetConnection(args *structs.ConnectionSpecificReques
 // ListConnections retrieves all connection entities in the repository
 func (s *ConnectionService) ListConnections(args *structs.ConnectionListRequest, out *structs.ConnectionListResponse) error {
 
+	out.Items = nil
+
+	return s.StreamConnections(args, func(stub *structs.ConnectionListStub) error {
+		out.Items = append(out.Items, stub)
+		return nil
+	})
+}
+
+// StreamConnections retrieves the same connection entities as ListConnections, but
+// instead of building the whole list in memory, invokes a callback for each of them.
+// Streaming stops at the first error returned by the callback.
+func (s *ConnectionService) StreamConnections(args *structs.ConnectionListRequest, fn func(*structs.ConnectionListStub) error) error {
+
 	ctx := context.TODO()
 
 	// Check if authorized
@@ -69,45 +87,103 @@ func (s *ConnectionService) ListConnections(args *structs.ConnectionListRequest,
 		}
 	}
 
-	out.Items = nil
+	if err := args.Validate(); err != nil {
+		return structs.NewInvalidInputError("Invalid input: " + err.Error())
+	}
 
-	var err error
-	var connections []*structs.Connection
+	excluded := map[string]struct{}{}
+	for _, id := range args.ExcludeIDs {
+		excluded[id] = struct{}{}
+	}
 
-	if args.InterfaceID != "" {
-		if connections, err = s.state.ConnectionsByInterfaceID(ctx, args.InterfaceID); err != nil {
-			return structs.ErrInternal
+	emit := func(c *structs.Connection) error {
+		if _, ok := excluded[c.ID]; ok {
+			return nil
 		}
-	} else if args.NodeID != "" {
-		if connections, err = s.state.ConnectionsByNodeID(ctx, args.NodeID); err != nil {
-			return structs.ErrInternal
+		if args.NetworkID != "" && c.NetworkID != args.NetworkID {
+			return nil
 		}
-	} else if args.NetworkID != "" {
-		if connections, err = s.state.ConnectionsByNetworkID(ctx, args.NetworkID); err != nil {
-			return structs.ErrInternal
+		if args.InterfaceID != "" && !c.ConnectsInterface(args.InterfaceID) {
+			return nil
 		}
-	} else {
-		if connections, err = s.state.Connections(ctx); err != nil {
-			return structs.ErrInternal
+		if args.NodeID != "" && !connectsAnyNode(c, []string{args.NodeID}) {
+			return nil
+		}
+		if len(args.NodeIDs) > 0 && !connectsAnyNode(c, args.NodeIDs) {
+			return nil
+		}
+		if args.ContainsIP != "" && !c.ContainsIP(args.ContainsIP) {
+			return nil
 		}
+		if args.GroupID != "" && !c.InGroup(args.GroupID) {
+			return nil
+		}
+		// A single malformed connection shouldn't prevent listing the others
+		stub, err := c.Stub()
+		if err != nil {
+			s.logger.Warnf("couldn't list connection %s: %v", c.ID, err)
+			return nil
+		}
+		if args.IncludeSamples {
+			stub.ThroughputSamples = append([]structs.Sample{}, c.ThroughputSamples...)
+		}
+		return fn(stub)
 	}
 
-	for _, c := range connections {
-		shouldAppend := true
-		if args.NetworkID != "" && c.NetworkID != args.NetworkID {
-			shouldAppend = false
-		}
-		if args.InterfaceID != "" && !c.ConnectsInterface(args.InterfaceID) {
-			shouldAppend = false
+	// The connections of an interface are indexed, so they can be read at once.
+	// Otherwise, connections are streamed from the repository, so that they are
+	// never all held in memory.
+	if args.InterfaceID != "" {
+		connections, err := s.state.ConnectionsByInterfaceID(ctx, args.InterfaceID)
+		if err != nil {
+			return structs.ErrInternal
 		}
-		if shouldAppend {
-			out.Items = append(out.Items, c.Stub())
+		for _, c := range connections {
+			if err := emit(c); err != nil {
+				return err
+			}
 		}
+		return nil
+	}
+
+	var emitErr error
+	err := s.state.IterateConnections(ctx, func(c *structs.Connection) error {
+		emitErr = emit(c)
+		return emitErr
+	})
+	if emitErr != nil {
+		return emitErr
+	}
+	if err != nil {
+		return structs.ErrInternal
 	}
 
 	return nil
 }
 
+// WriteConnections writes the connections matching the request into w,
+// as newline-delimited JSON, one connection stub per line.
+func (s *ConnectionService) WriteConnections(args *structs.ConnectionListRequest, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return s.StreamConnections(args, func(stub *structs.ConnectionListStub) error {
+		if err := enc.Encode(stub); err != nil {
+			return structs.ErrInternal
+		}
+		return nil
+	})
+}
+
+func connectsAnyNode(c *structs.Connection, ids []string) bool {
+	for _, connected := range c.ConnectedNodeIDs() {
+		for _, id := range ids {
+			if connected == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // UpsertConnection upserts a new Connection entity
 func (s *ConnectionService) UpsertConnection(args *structs.ConnectionUpsertRequest, out *structs.GenericResponse) error {
 
@@ -122,23 +198,83 @@ func (s *ConnectionService) UpsertConnection(args *structs.ConnectionUpsertReque
 
 	c := args.Connection
 
+	// Connections written in a newer schema version can't be understood
+	if c.SchemaVersion > structs.ConnectionSchemaVersion {
+		return structs.NewInvalidInputError(fmt.Sprintf("Invalid input: unsupported connection schema version %d", c.SchemaVersion))
+	}
+
+	// History and values reported by agents are only written by the
+	// server, so that they can't be forged
+	c.History = nil
+	c.DiscoveredMTU = nil
+	c.ThroughputSamples = nil
+
+	// Retries of a request which already created a connection update it.
+	// Keys are scoped by network, which is the one of the interfaces connected.
+	if args.IdempotencyKey != "" {
+		networkID := c.NetworkID
+		if networkID == "" && len(c.PeerSettings) > 0 {
+			if iface, err := s.state.InterfaceByID(ctx, c.PeerSettings[0].InterfaceID); err == nil {
+				networkID = iface.NetworkID
+			}
+		}
+		if old, err := s.state.ConnectionByIdempotencyKey(ctx, networkID, args.IdempotencyKey); err == nil {
+			if c.ID == "" {
+				c.ID = old.ID
+			} else if c.ID != old.ID {
+				return structs.NewInvalidInputError(fmt.Sprintf("Invalid input: idempotency key %s is already used by connection %s", args.IdempotencyKey, old.ID))
+			}
+		}
+		c.IdempotencyKey = args.IdempotencyKey
+	}
+
 	isNewConnection := false
 
 	// If the connection already exists, we simply merge the new values into the existing struct.
-	// Otherwise, we generate a new ID and set the protected attributes in preparation for inserting
-	// the new struct into the repository.
+	// Otherwise, we generate a new ID, unless one was supplied by the client, and set the protected
+	// attributes in preparation for inserting the new struct into the repository.
 	if c.ID != "" {
 		old, err := s.state.ConnectionByID(ctx, c.ID)
-		if err != nil {
-			return structs.ErrNotFound // connection does not exist
+		switch {
+		case err == structs.ErrNotFound:
+			if !uuid.IsValid(c.ID) {
+				return structs.NewInvalidInputError(fmt.Sprintf("Invalid input: connection ID %s is not a valid UUID", c.ID))
+			}
+			c.CreatedAt = time.Now()
+			isNewConnection = true
+		case err == structs.ErrDeleted:
+			return structs.NewInvalidInputError(fmt.Sprintf("Invalid input: connection %s was deleted", c.ID))
+		case err != nil:
+			return structs.ErrInternal
+		default:
+			// Stored connections are upgraded before being merged, since
+			// they are written back in the current schema version
+			old = old.Clone()
+			if err := old.Migrate(old.SchemaVersion); err != nil {
+				return structs.NewInternalError(err.Error())
+			}
+			if len(c.PeerSettings) == 2 && c.CanonicalKey() != old.CanonicalKey() {
+				return structs.NewInvalidInputError(fmt.Sprintf("Invalid input: connection ID %s is already used by interfaces %s", c.ID, old.CanonicalKey()))
+			}
+			if c, err = old.Merge(c); err != nil {
+				return structs.NewInvalidInputError("Invalid input: " + err.Error())
+			}
 		}
-		c = old.Merge(c)
 	} else {
 		c.ID = uuid.Generate()
 		c.CreatedAt = time.Now()
 		isNewConnection = true
 	}
 
+	// Peers are owned by the nodes owning their interfaces
+	for _, peer := range c.PeerSettings {
+		if peer.NodeID == "" {
+			if iface, err := s.state.InterfaceByID(ctx, peer.InterfaceID); err == nil {
+				peer.NodeID = iface.NodeID
+			}
+		}
+	}
+
 	err := c.Validate()
 	if err != nil {
 		return structs.NewInvalidInputError("Invalid input: " + err.Error())
@@ -160,14 +296,21 @@ func (s *ConnectionService) UpsertConnection(args *structs.ConnectionUpsertReque
 
 	// Make sure both peer interfaces exist
 	ifaces := []*structs.Interface{}
+	ifacesByID := map[string]*structs.Interface{}
 	for _, id := range connectedInterfaceIDs {
 		if iface, err := s.state.InterfaceByID(ctx, id); err == nil {
 			ifaces = append(ifaces, iface)
+			ifacesByID[id] = iface
 			continue
 		}
 		return structs.NewInternalError(fmt.Sprintf("Interface %s does not exist", id))
 	}
 
+	// Make sure peers do not reference nodes other than the interface owners
+	if err := c.ValidateWithInterfaces(ifacesByID); err != nil {
+		return structs.NewInvalidInputError("Invalid input: " + err.Error())
+	}
+
 	if ifaces[0].NetworkID != ifaces[1].NetworkID {
 		return structs.NewInternalError("Interfaces are not in the same network")
 	}
@@ -184,8 +327,23 @@ func (s *ConnectionService) UpsertConnection(args *structs.ConnectionUpsertReque
 		c.AllowIPBidirectional(network.AddressRange)
 	}
 
+	if err := c.ValidateWithNetwork(network); err != nil {
+		return structs.NewInvalidInputError("Invalid input: " + err.Error())
+	}
+
+	c.SchemaVersion = structs.ConnectionSchemaVersion
 	c.UpdatedAt = time.Now()
 
+	author := ""
+	if token, err := s.state.ACLTokenBySecret(ctx, args.AuthToken); err == nil && token != nil {
+		author = token.ID
+	}
+	if isNewConnection {
+		c.RecordChange(author, "Connection created")
+	} else {
+		c.RecordChange(author, "Connection updated")
+	}
+
 	// TODO: wrap in a transaction
 
 	for _, iface := range ifaces {
@@ -232,7 +390,84 @@ func (s *ConnectionService) DeleteConnection(args *structs.ConnectionDeleteReque
 		}
 	}
 
-	for _, connID := range args.ConnectionIDs {
+	ids := args.ConnectionIDs
+	if args.GroupID != "" {
+		ids = append([]string{}, ids...)
+		err := s.state.IterateConnections(ctx, func(c *structs.Connection) error {
+			if c.InGroup(args.GroupID) {
+				ids = append(ids, c.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			return structs.ErrInternal
+		}
+	}
+
+	return s.deleteConnections(ctx, ids)
+}
+
+// PurgeExpired deletes all connections whose expiration time has passed,
+// returning the IDs of the connections removed. Concurrent calls are
+// serialized, so that each connection is only purged once.
+func (s *ConnectionService) PurgeExpired(now time.Time) ([]string, error) {
+
+	s.purgeLock.Lock()
+	defer s.purgeLock.Unlock()
+
+	ctx := context.TODO()
+
+	ids := []string{}
+	err := s.state.IterateConnections(ctx, func(c *structs.Connection) error {
+		if c.IsExpired(now) {
+			ids = append(ids, c.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, structs.ErrInternal
+	}
+
+	if len(ids) == 0 {
+		return ids, nil
+	}
+
+	if err := s.deleteConnections(ctx, ids); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// purgeExpiredPeriodically purges expired connections
+// every interval, until stopCh is closed.
+func (s *ConnectionService) purgeExpiredPeriodically(interval time.Duration, stopCh <-chan struct{}) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case now := <-ticker.C:
+			ids, err := s.PurgeExpired(now)
+			if err != nil {
+				s.logger.Warnf("couldn't purge expired connections: %v", err)
+				continue
+			}
+			if len(ids) > 0 {
+				s.logger.Infof("purged %d expired connections", len(ids))
+			}
+		}
+	}
+}
+
+// deleteConnections removes connections from the repository, together
+// with any references to them held by nodes, interfaces, and networks.
+func (s *ConnectionService) deleteConnections(ctx context.Context, ids []string) error {
+
+	for _, connID := range ids {
 		if conn, err := s.state.ConnectionByID(ctx, connID); err == nil {
 
 			var nodes []*structs.Node
@@ -277,7 +512,7 @@ func (s *ConnectionService) DeleteConnection(args *structs.ConnectionDeleteReque
 	}
 
 	// Remove connections
-	if err := s.state.DeleteConnections(ctx, args.ConnectionIDs); err != nil {
+	if err := s.state.DeleteConnections(ctx, ids); err != nil {
 		return structs.ErrInternal
 	}
 
@@ -0,0 +1,705 @@
+package drago
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	inmem "github.com/seashell/drago/drago/state/inmem"
+	structs "github.com/seashell/drago/drago/structs"
+	simple "github.com/seashell/drago/pkg/log/simple"
+	uuid "github.com/seashell/drago/pkg/uuid"
+)
+
+func newTestConnectionService(t *testing.T) (*ConnectionService, *inmem.StateRepository) {
+
+	logger, err := simple.NewLoggerAdapter(simple.Config{})
+	if err != nil {
+		t.Fatalf("simple.NewLoggerAdapter() failed, unexpected error: %v", err)
+	}
+
+	repo := inmem.NewStateRepository(logger)
+
+	return NewConnectionService(DefaultConfig(), logger, repo, nil), repo
+}
+
+func seedTestConnections(t *testing.T, repo *inmem.StateRepository, n int) {
+	for i := 0; i < n; i++ {
+		c, err := structs.NewConnectionBetween(fmt.Sprintf("network-%d", i%2),
+			fmt.Sprintf("iface-%d-a", i), fmt.Sprintf("node-%d", i), fmt.Sprintf("iface-%d-b", i), fmt.Sprintf("node-%d", i+1))
+		if err != nil {
+			t.Fatalf("structs.NewConnectionBetween() failed, unexpected error: %v", err)
+		}
+		if err := repo.UpsertConnection(context.TODO(), c); err != nil {
+			t.Fatalf("repo.UpsertConnection() failed, unexpected error: %v", err)
+		}
+	}
+}
+
+func TestStreamConnections(t *testing.T) {
+
+	s, repo := newTestConnectionService(t)
+	seedTestConnections(t, repo, 5000)
+
+	count := 0
+	seen := map[string]struct{}{}
+	err := s.StreamConnections(&structs.ConnectionListRequest{NetworkID: "network-1"}, func(stub *structs.ConnectionListStub) error {
+		if stub.NetworkID != "network-1" {
+			return fmt.Errorf("unexpected network %s", stub.NetworkID)
+		}
+		seen[stub.ID] = struct{}{}
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("s.StreamConnections() failed, unexpected error: %v", err)
+	}
+	if count != 2500 || len(seen) != 2500 {
+		t.Fatalf("s.StreamConnections() failed, expected %d stubs, have %d (%d distinct)", 2500, count, len(seen))
+	}
+
+	// Errors returned by the callback stop the stream
+	count = 0
+	errStop := errors.New("stop")
+	err = s.StreamConnections(&structs.ConnectionListRequest{}, func(stub *structs.ConnectionListStub) error {
+		count++
+		if count == 10 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || count != 10 {
+		t.Fatalf("s.StreamConnections() failed, expected to stop after %d stubs, have %d (%v)", 10, count, err)
+	}
+}
+
+// iteratingRepository fails every read of the full list of connections,
+// so that callers are forced to iterate over them instead.
+type iteratingRepository struct {
+	*inmem.StateRepository
+}
+
+var errFullRead = errors.New("full read of connections")
+
+func (r *iteratingRepository) Connections(ctx context.Context) ([]*structs.Connection, error) {
+	return nil, errFullRead
+}
+
+func (r *iteratingRepository) ConnectionsByNetworkID(ctx context.Context, s string) ([]*structs.Connection, error) {
+	return nil, errFullRead
+}
+
+func (r *iteratingRepository) ConnectionsByNodeID(ctx context.Context, s string) ([]*structs.Connection, error) {
+	return nil, errFullRead
+}
+
+func TestStreamConnectionsIterates(t *testing.T) {
+
+	base, repo := newTestConnectionService(t)
+	seedTestConnections(t, repo, 10)
+	s := NewConnectionService(DefaultConfig(), base.logger, &iteratingRepository{repo}, nil)
+
+	tests := []struct {
+		name     string
+		args     *structs.ConnectionListRequest
+		expected int
+	}{
+		{"all", &structs.ConnectionListRequest{}, 10},
+		{"by network", &structs.ConnectionListRequest{NetworkID: "network-1"}, 5},
+		{"by node", &structs.ConnectionListRequest{NodeID: "node-3"}, 2},
+	}
+
+	for _, tt := range tests {
+		count := 0
+		err := s.StreamConnections(tt.args, func(stub *structs.ConnectionListStub) error {
+			count++
+			return nil
+		})
+		if err != nil || count != tt.expected {
+			t.Fatalf("%s: s.StreamConnections() failed, expected %d stubs, have %d (%v)", tt.name, tt.expected, count, err)
+		}
+	}
+}
+
+func TestListConnectionsSkipsMalformed(t *testing.T) {
+
+	s, repo := newTestConnectionService(t)
+	seedTestConnections(t, repo, 5)
+
+	malformed := &structs.Connection{ID: "conn-malformed", PeerSettings: []*structs.PeerSettings{{InterfaceID: "iface-x"}}}
+	if err := repo.UpsertConnection(context.TODO(), malformed); err != nil {
+		t.Fatalf("repo.UpsertConnection() failed, unexpected error: %v", err)
+	}
+
+	var out structs.ConnectionListResponse
+	if err := s.ListConnections(&structs.ConnectionListRequest{}, &out); err != nil {
+		t.Fatalf("s.ListConnections() failed, unexpected error: %v", err)
+	}
+	if len(out.Items) != 5 {
+		t.Fatalf("s.ListConnections() failed, expected %d items, have %d", 5, len(out.Items))
+	}
+	for _, stub := range out.Items {
+		if stub.ID == malformed.ID {
+			t.Fatalf("s.ListConnections() failed, malformed connection %s is present", malformed.ID)
+		}
+	}
+}
+
+func TestWriteConnections(t *testing.T) {
+
+	s, repo := newTestConnectionService(t)
+	seedTestConnections(t, repo, 1000)
+
+	buf := &bytes.Buffer{}
+	if err := s.WriteConnections(&structs.ConnectionListRequest{}, buf); err != nil {
+		t.Fatalf("s.WriteConnections() failed, unexpected error: %v", err)
+	}
+
+	count := 0
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var stub structs.ConnectionListStub
+		if err := json.Unmarshal(scanner.Bytes(), &stub); err != nil {
+			t.Fatalf("json.Unmarshal() failed, unexpected error: %v", err)
+		}
+		if len(stub.Peers) != 2 {
+			t.Fatalf("s.WriteConnections() failed, expected %d peers, have %d", 2, len(stub.Peers))
+		}
+		count++
+	}
+	if count != 1000 {
+		t.Fatalf("s.WriteConnections() failed, expected %d lines, have %d", 1000, count)
+	}
+}
+
+func TestPurgeExpired(t *testing.T) {
+
+	s, repo := newTestConnectionService(t)
+	ctx := context.TODO()
+
+	suffixes := []string{}
+	for i := 0; i < 20; i++ {
+		suffixes = append(suffixes, fmt.Sprint(i))
+	}
+	seedTestInterfaces(t, repo, "network-1", suffixes...)
+
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+
+	expired := map[string]struct{}{}
+	for i := 0; i < 10; i++ {
+		c := &structs.Connection{}
+		switch i % 3 {
+		case 0:
+			c.ExpireAt = &past
+		case 1:
+			c.ExpireAt = &future
+		}
+		id := createTestConnection(t, s, suffixes[2*i], suffixes[2*i+1], c)
+		if i%3 == 0 {
+			expired[id] = struct{}{}
+		}
+	}
+
+	// Run several sweepers concurrently
+	var wg sync.WaitGroup
+	results := make(chan []string, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids, err := s.PurgeExpired(now)
+			if err != nil {
+				t.Errorf("s.PurgeExpired() failed, unexpected error: %v", err)
+			}
+			results <- ids
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	purged := map[string]struct{}{}
+	for ids := range results {
+		for _, id := range ids {
+			if _, ok := purged[id]; ok {
+				t.Fatalf("s.PurgeExpired() failed, connection %s purged more than once", id)
+			}
+			purged[id] = struct{}{}
+		}
+	}
+
+	if !reflect.DeepEqual(purged, expired) {
+		t.Fatalf("s.PurgeExpired() failed, expected %d purged connections, have %d", len(expired), len(purged))
+	}
+
+	remaining, _ := repo.Connections(ctx)
+	if len(remaining) != 10-len(expired) {
+		t.Fatalf("s.PurgeExpired() failed, expected %d remaining connections, have %d", 10-len(expired), len(remaining))
+	}
+	for _, c := range remaining {
+		if c.IsExpired(now) {
+			t.Fatalf("s.PurgeExpired() failed, expired connection %s was not purged", c.ID)
+		}
+	}
+}
+
+func TestPurgeExpiredPeriodically(t *testing.T) {
+
+	s, repo := newTestConnectionService(t)
+	seedTestInterfaces(t, repo, "network-1", "a", "b")
+
+	past := time.Now().Add(-time.Minute)
+	id := createTestConnection(t, s, "a", "b", &structs.Connection{ExpireAt: &past})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go s.purgeExpiredPeriodically(10*time.Millisecond, stopCh)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := repo.ConnectionByID(context.TODO(), id); err != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("s.purgeExpiredPeriodically() failed, expired connection %s was not purged", id)
+}
+
+func TestListConnectionsExcludeIDs(t *testing.T) {
+
+	s, repo := newTestConnectionService(t)
+	seedTestConnections(t, repo, 10)
+
+	all, _ := repo.Connections(context.TODO())
+	excluded := []string{all[0].ID, all[3].ID, all[7].ID}
+
+	var out structs.ConnectionListResponse
+	if err := s.ListConnections(&structs.ConnectionListRequest{ExcludeIDs: excluded}, &out); err != nil {
+		t.Fatalf("s.ListConnections() failed, unexpected error: %v", err)
+	}
+
+	if len(out.Items) != len(all)-len(excluded) {
+		t.Fatalf("s.ListConnections() failed, expected %d items, have %d", len(all)-len(excluded), len(out.Items))
+	}
+	for _, stub := range out.Items {
+		for _, id := range excluded {
+			if stub.ID == id {
+				t.Fatalf("s.ListConnections() failed, excluded connection %s is present", id)
+			}
+		}
+	}
+}
+
+// seedGroupedTestConnections creates n connections through the service, every
+// third of them in group, returning the IDs of the connections in the group.
+func seedGroupedTestConnections(t *testing.T, s *ConnectionService, repo *inmem.StateRepository, n int, group string) map[string]struct{} {
+
+	suffixes := []string{}
+	for i := 0; i < 2*n; i++ {
+		suffixes = append(suffixes, fmt.Sprint(i))
+	}
+	seedTestInterfaces(t, repo, "network-1", suffixes...)
+
+	grouped := map[string]struct{}{}
+	for i := 0; i < n; i++ {
+		c := &structs.Connection{}
+		if i%3 == 0 {
+			c.GroupID = &group
+		}
+		id := createTestConnection(t, s, suffixes[2*i], suffixes[2*i+1], c)
+		if i%3 == 0 {
+			grouped[id] = struct{}{}
+		}
+	}
+	return grouped
+}
+
+func TestListConnectionsGroupID(t *testing.T) {
+
+	s, repo := newTestConnectionService(t)
+	grouped := seedGroupedTestConnections(t, s, repo, 10, "site-a")
+
+	var out structs.ConnectionListResponse
+	if err := s.ListConnections(&structs.ConnectionListRequest{GroupID: "site-a"}, &out); err != nil {
+		t.Fatalf("s.ListConnections() failed, unexpected error: %v", err)
+	}
+
+	if len(out.Items) != len(grouped) {
+		t.Fatalf("s.ListConnections() failed, expected %d items, have %d", len(grouped), len(out.Items))
+	}
+	for _, stub := range out.Items {
+		if _, ok := grouped[stub.ID]; !ok {
+			t.Fatalf("s.ListConnections() failed, connection %s is not in the group", stub.ID)
+		}
+	}
+}
+
+func TestListConnectionsIncludeSamples(t *testing.T) {
+
+	s, repo := newTestConnectionService(t)
+	ctx := context.TODO()
+	seedTestInterfaces(t, repo, "network-1", "a", "b", "c")
+
+	keys := map[string]string{}
+	for _, id := range []string{"b", "c"} {
+		key := "public-key-" + id
+		keys[id] = key
+		repo.UpsertInterface(ctx, &structs.Interface{ID: "iface-" + id, NodeID: "node-" + id, NetworkID: "network-1", PublicKey: &key})
+	}
+
+	// Samples can't be set through the API
+	forged := []structs.Sample{{At: time.Now(), RxBytes: 1000}}
+	for id := range keys {
+		createTestConnection(t, s, "a", id, &structs.Connection{ThroughputSamples: forged})
+	}
+
+	ns := newTestNodeService(t, repo)
+	for i := 1; i <= 3; i++ {
+		req := &structs.NodePeerReportRequest{NodeID: "node-a"}
+		for _, key := range keys {
+			req.Peers = append(req.Peers, &structs.PeerReport{InterfaceID: "iface-a", PublicKey: key, RxBytes: uint64(100 * i), TxBytes: uint64(10 * i)})
+		}
+		if err := ns.ReportPeers(req, &structs.GenericResponse{}); err != nil {
+			t.Fatalf("ns.ReportPeers() failed, unexpected error: %v", err)
+		}
+	}
+
+	var out structs.ConnectionListResponse
+	if err := s.ListConnections(&structs.ConnectionListRequest{}, &out); err != nil {
+		t.Fatalf("s.ListConnections() failed, unexpected error: %v", err)
+	}
+	for _, stub := range out.Items {
+		if len(stub.ThroughputSamples) != 0 {
+			t.Fatalf("s.ListConnections() failed, expected no samples, have %d", len(stub.ThroughputSamples))
+		}
+	}
+
+	if err := s.ListConnections(&structs.ConnectionListRequest{IncludeSamples: true}, &out); err != nil {
+		t.Fatalf("s.ListConnections() failed, unexpected error: %v", err)
+	}
+	if len(out.Items) != len(keys) {
+		t.Fatalf("s.ListConnections() failed, expected %d items, have %d", len(keys), len(out.Items))
+	}
+	for _, stub := range out.Items {
+		if len(stub.ThroughputSamples) != 3 {
+			t.Fatalf("s.ListConnections() failed, expected 3 samples, have %d", len(stub.ThroughputSamples))
+		}
+		for i, sample := range stub.ThroughputSamples {
+			if expected := uint64(100 * (i + 1)); sample.RxBytes != expected {
+				t.Fatalf("s.ListConnections() failed, expected samples in time order, have %v", stub.ThroughputSamples)
+			}
+		}
+	}
+}
+
+func TestDeleteConnectionGroupID(t *testing.T) {
+
+	s, repo := newTestConnectionService(t)
+	ctx := context.TODO()
+	grouped := seedGroupedTestConnections(t, s, repo, 10, "site-a")
+
+	if err := s.DeleteConnection(&structs.ConnectionDeleteRequest{GroupID: "site-a"}, &structs.GenericResponse{}); err != nil {
+		t.Fatalf("s.DeleteConnection() failed, unexpected error: %v", err)
+	}
+
+	remaining, _ := repo.Connections(ctx)
+	if len(remaining) != 10-len(grouped) {
+		t.Fatalf("s.DeleteConnection() failed, expected %d remaining connections, have %d", 10-len(grouped), len(remaining))
+	}
+	for _, c := range remaining {
+		if c.InGroup("site-a") {
+			t.Fatalf("s.DeleteConnection() failed, grouped connection %s was not deleted", c.ID)
+		}
+	}
+}
+
+// seedTestInterfaces creates a network, and an interface on its own node
+// for each of the suffixes, with IDs such as iface-a and node-a.
+func seedTestInterfaces(t *testing.T, repo *inmem.StateRepository, networkID string, suffixes ...string) {
+	ctx := context.TODO()
+	if err := repo.UpsertNetwork(ctx, &structs.Network{ID: networkID, AddressRange: "10.0.0.0/24"}); err != nil {
+		t.Fatalf("repo.UpsertNetwork() failed, unexpected error: %v", err)
+	}
+	for _, id := range suffixes {
+		if err := repo.UpsertNode(ctx, &structs.Node{ID: "node-" + id}); err != nil {
+			t.Fatalf("repo.UpsertNode() failed, unexpected error: %v", err)
+		}
+		if err := repo.UpsertInterface(ctx, &structs.Interface{ID: "iface-" + id, NodeID: "node-" + id, NetworkID: networkID}); err != nil {
+			t.Fatalf("repo.UpsertInterface() failed, unexpected error: %v", err)
+		}
+	}
+}
+
+// createTestConnection creates a connection between the interfaces with the
+// suffixes through the service, with the attributes of c, and returns its ID.
+func createTestConnection(t *testing.T, s *ConnectionService, a, b string, c *structs.Connection) string {
+	c.ID = uuid.Generate()
+	c.PeerSettings = []*structs.PeerSettings{
+		{InterfaceID: "iface-" + a, NodeID: "node-" + a},
+		{InterfaceID: "iface-" + b, NodeID: "node-" + b},
+	}
+	if err := s.UpsertConnection(&structs.ConnectionUpsertRequest{Connection: c}, &structs.GenericResponse{}); err != nil {
+		t.Fatalf("s.UpsertConnection() failed, unexpected error: %v", err)
+	}
+	return c.ID
+}
+
+func TestUpsertConnectionHistory(t *testing.T) {
+
+	s, repo := newTestConnectionService(t)
+	ctx := context.TODO()
+	seedTestInterfaces(t, repo, "network-1", "a", "b")
+
+	// Client-supplied entries are discarded on create
+	req := &structs.ConnectionUpsertRequest{
+		Connection: &structs.Connection{
+			PeerSettings: []*structs.PeerSettings{
+				{InterfaceID: "iface-a", NodeID: "node-a"},
+				{InterfaceID: "iface-b", NodeID: "node-b"},
+			},
+			History: []*structs.ChangeEntry{{By: "admin", Summary: "forged"}},
+		},
+	}
+	if err := s.UpsertConnection(req, &structs.GenericResponse{}); err != nil {
+		t.Fatalf("s.UpsertConnection() failed, unexpected error: %v", err)
+	}
+	connections, _ := repo.Connections(ctx)
+	if h := connections[0].History; len(h) != 1 || h[0].Summary != "Connection created" {
+		t.Fatalf("s.UpsertConnection() failed, unexpected history %v", h)
+	}
+
+	// Writing back a connection as read doesn't duplicate its entries
+	req = &structs.ConnectionUpsertRequest{Connection: connections[0].Clone()}
+	if err := s.UpsertConnection(req, &structs.GenericResponse{}); err != nil {
+		t.Fatalf("s.UpsertConnection() failed, unexpected error: %v", err)
+	}
+	c, _ := repo.ConnectionByID(ctx, connections[0].ID)
+	if h := c.History; len(h) != 2 || h[1].Summary != "Connection updated" {
+		t.Fatalf("s.UpsertConnection() failed, unexpected history %v", h)
+	}
+}
+
+func TestUpsertConnectionIdempotencyKey(t *testing.T) {
+
+	s, repo := newTestConnectionService(t)
+	ctx := context.TODO()
+	seedTestInterfaces(t, repo, "network-1", "a", "b")
+	seedTestInterfaces(t, repo, "network-2", "c", "d")
+
+	newRequest := func(keepalive int, a, b string) *structs.ConnectionUpsertRequest {
+		return &structs.ConnectionUpsertRequest{
+			Connection: &structs.Connection{
+				PersistentKeepalive: &keepalive,
+				PeerSettings: []*structs.PeerSettings{
+					{InterfaceID: "iface-" + a, NodeID: "node-" + a},
+					{InterfaceID: "iface-" + b, NodeID: "node-" + b},
+				},
+			},
+			IdempotencyKey: "request-1",
+		}
+	}
+
+	// First attempt creates the connection
+	if err := s.UpsertConnection(newRequest(20, "a", "b"), &structs.GenericResponse{}); err != nil {
+		t.Fatalf("s.UpsertConnection() failed, unexpected error: %v", err)
+	}
+	created, err := repo.ConnectionByIdempotencyKey(ctx, "network-1", "request-1")
+	if err != nil {
+		t.Fatalf("repo.ConnectionByIdempotencyKey() failed, unexpected error: %v", err)
+	}
+
+	// Retry updates it
+	if err := s.UpsertConnection(newRequest(25, "a", "b"), &structs.GenericResponse{}); err != nil {
+		t.Fatalf("s.UpsertConnection() failed, unexpected error: %v", err)
+	}
+
+	connections, _ := repo.ConnectionsByNetworkID(ctx, "network-1")
+	if len(connections) != 1 {
+		t.Fatalf("s.UpsertConnection() failed, expected %d connection, have %d", 1, len(connections))
+	}
+	if c := connections[0]; c.ID != created.ID || *c.PersistentKeepalive != 25 {
+		t.Fatalf("s.UpsertConnection() failed, expected connection %s to be updated, have %+v", created.ID, c)
+	}
+
+	// The same key in another network creates a different connection
+	if err := s.UpsertConnection(newRequest(20, "c", "d"), &structs.GenericResponse{}); err != nil {
+		t.Fatalf("s.UpsertConnection() failed, unexpected error: %v", err)
+	}
+	if c, err := repo.ConnectionByIdempotencyKey(ctx, "network-2", "request-1"); err != nil || c.ID == created.ID {
+		t.Fatalf("s.UpsertConnection() failed, expected a new connection in network-2, have %v (%v)", c, err)
+	}
+
+	// A key can't be moved onto a connection with a different ID
+	req := newRequest(25, "a", "b")
+	req.Connection.ID = uuid.Generate()
+	if err := s.UpsertConnection(req, &structs.GenericResponse{}); err == nil {
+		t.Fatalf("s.UpsertConnection() failed, expected error for key used by connection %s", created.ID)
+	}
+}
+
+func TestUpsertConnectionMigrates(t *testing.T) {
+
+	s, repo := newTestConnectionService(t)
+	ctx := context.TODO()
+	seedTestInterfaces(t, repo, "network-1", "a", "b")
+
+	// Connection stored before routing rules were normalized
+	id := uuid.Generate()
+	repo.UpsertConnection(ctx, &structs.Connection{
+		ID:            id,
+		NetworkID:     "network-1",
+		SchemaVersion: 1,
+		PeerSettings: []*structs.PeerSettings{
+			{InterfaceID: "iface-a", NodeID: "node-a", RoutingRules: &structs.RoutingRules{AllowedIPs: []string{"10.0.0.1/24"}}},
+			{InterfaceID: "iface-b", NodeID: "node-b"},
+		},
+	})
+
+	keepalive := 25
+	req := &structs.ConnectionUpsertRequest{Connection: &structs.Connection{ID: id, PersistentKeepalive: &keepalive}}
+	if err := s.UpsertConnection(req, &structs.GenericResponse{}); err != nil {
+		t.Fatalf("s.UpsertConnection() failed, unexpected error: %v", err)
+	}
+
+	c, _ := repo.ConnectionByID(ctx, id)
+	if c.SchemaVersion != structs.ConnectionSchemaVersion {
+		t.Fatalf("s.UpsertConnection() failed, expected schema version %d, have %d", structs.ConnectionSchemaVersion, c.SchemaVersion)
+	}
+	if routes := c.PeerSettingsByInterfaceID("iface-a").RoutingRules.AllowedIPs; len(routes) != 1 || routes[0] != "10.0.0.0/24" {
+		t.Fatalf("s.UpsertConnection() failed, expected normalized routes, have %v", routes)
+	}
+	if c.PeerSettingsByInterfaceID("iface-b").RoutingRules == nil {
+		t.Fatalf("s.UpsertConnection() failed, expected routing rules to be initialized")
+	}
+
+	// Connections in a newer schema version are rejected
+	req = &structs.ConnectionUpsertRequest{Connection: &structs.Connection{ID: id, SchemaVersion: structs.ConnectionSchemaVersion + 1}}
+	if err := s.UpsertConnection(req, &structs.GenericResponse{}); err == nil {
+		t.Fatalf("s.UpsertConnection() failed, expected error for newer schema version")
+	}
+
+	c.SchemaVersion = structs.ConnectionSchemaVersion + 1
+	req = &structs.ConnectionUpsertRequest{Connection: &structs.Connection{ID: id, PersistentKeepalive: &keepalive}}
+	if err := s.UpsertConnection(req, &structs.GenericResponse{}); err == nil {
+		t.Fatalf("s.UpsertConnection() failed, expected error for stored connection in newer schema version")
+	}
+}
+
+func TestUpsertConnectionSuppliedID(t *testing.T) {
+
+	s, repo := newTestConnectionService(t)
+	ctx := context.TODO()
+
+	repo.UpsertNetwork(ctx, &structs.Network{ID: "network-1", AddressRange: "10.0.0.0/24"})
+	for _, id := range []string{"a", "b", "c"} {
+		repo.UpsertNode(ctx, &structs.Node{ID: "node-" + id})
+		repo.UpsertInterface(ctx, &structs.Interface{ID: "iface-" + id, NodeID: "node-" + id, NetworkID: "network-1"})
+	}
+
+	newRequest := func(id, a, b string) *structs.ConnectionUpsertRequest {
+		return &structs.ConnectionUpsertRequest{
+			Connection: &structs.Connection{
+				ID: id,
+				PeerSettings: []*structs.PeerSettings{
+					{InterfaceID: "iface-" + a, NodeID: "node-" + a},
+					{InterfaceID: "iface-" + b, NodeID: "node-" + b},
+				},
+			},
+		}
+	}
+
+	// Supplied ID is honored
+	const id = "0f8fad5b-d9cb-469f-a165-70867728950e"
+	if err := s.UpsertConnection(newRequest(id, "a", "b"), &structs.GenericResponse{}); err != nil {
+		t.Fatalf("s.UpsertConnection() failed, unexpected error: %v", err)
+	}
+	if _, err := repo.ConnectionByID(ctx, id); err != nil {
+		t.Fatalf("s.UpsertConnection() failed, connection %s not found: %v", id, err)
+	}
+
+	// Supplied ID already used by a different pair of interfaces
+	if err := s.UpsertConnection(newRequest(id, "a", "c"), &structs.GenericResponse{}); err == nil {
+		t.Fatalf("s.UpsertConnection() failed, expected error for conflicting ID")
+	}
+	if err := s.UpsertConnection(newRequest("conn-1", "a", "c"), &structs.GenericResponse{}); err == nil {
+		t.Fatalf("s.UpsertConnection() failed, expected error for invalid ID")
+	}
+
+	// ID is generated if not supplied
+	if err := s.UpsertConnection(newRequest("", "a", "c"), &structs.GenericResponse{}); err != nil {
+		t.Fatalf("s.UpsertConnection() failed, unexpected error: %v", err)
+	}
+	connections, _ := repo.Connections(ctx)
+	if len(connections) != 2 {
+		t.Fatalf("s.UpsertConnection() failed, expected %d connections, have %d", 2, len(connections))
+	}
+	for _, c := range connections {
+		if c.ID != id && !uuid.IsValid(c.ID) {
+			t.Fatalf("s.UpsertConnection() failed, expected generated UUID, have %s", c.ID)
+		}
+	}
+}
+
+// unavailableRepository fails every lookup of a connection by ID, as a
+// repository which can't be reached would.
+type unavailableRepository struct {
+	*inmem.StateRepository
+}
+
+var errUnavailable = errors.New("repository unavailable")
+
+func (r *unavailableRepository) ConnectionByID(ctx context.Context, id string) (*structs.Connection, error) {
+	return nil, errUnavailable
+}
+
+func TestUpsertConnectionSuppliedIDNotCreated(t *testing.T) {
+
+	s, repo := newTestConnectionService(t)
+	ctx := context.TODO()
+
+	seedTestInterfaces(t, repo, "network-1", "a", "b")
+
+	newRequest := func(id string) *structs.ConnectionUpsertRequest {
+		return &structs.ConnectionUpsertRequest{
+			Connection: &structs.Connection{
+				ID: id,
+				PeerSettings: []*structs.PeerSettings{
+					{InterfaceID: "iface-a", NodeID: "node-a"},
+					{InterfaceID: "iface-b", NodeID: "node-b"},
+				},
+			},
+		}
+	}
+
+	// Updates to a deleted connection do not recreate it
+	const deletedID = "0f8fad5b-d9cb-469f-a165-70867728950e"
+	if err := s.UpsertConnection(newRequest(deletedID), &structs.GenericResponse{}); err != nil {
+		t.Fatalf("s.UpsertConnection() failed, unexpected error: %v", err)
+	}
+	if err := s.DeleteConnection(&structs.ConnectionDeleteRequest{ConnectionIDs: []string{deletedID}}, &structs.GenericResponse{}); err != nil {
+		t.Fatalf("s.DeleteConnection() failed, unexpected error: %v", err)
+	}
+	if err := s.UpsertConnection(newRequest(deletedID), &structs.GenericResponse{}); err == nil {
+		t.Fatalf("s.UpsertConnection() failed, expected error for deleted ID")
+	}
+	if _, err := repo.ConnectionByID(ctx, deletedID); err != structs.ErrDeleted {
+		t.Fatalf("s.UpsertConnection() failed, expected %v, have %v", structs.ErrDeleted, err)
+	}
+
+	// Repository errors other than not found do not create it
+	u := NewConnectionService(DefaultConfig(), s.logger, &unavailableRepository{repo}, nil)
+	const id = "7c9e6679-7425-40de-944b-e07fc1f90ae7"
+	if err := u.UpsertConnection(newRequest(id), &structs.GenericResponse{}); err != structs.ErrInternal {
+		t.Fatalf("s.UpsertConnection() failed, expected %v, have %v", structs.ErrInternal, err)
+	}
+	if _, err := repo.ConnectionByID(ctx, id); err != structs.ErrNotFound {
+		t.Fatalf("s.UpsertConnection() failed, expected %v, have %v", structs.ErrNotFound, err)
+	}
+}
@@ -3,7 +3,9 @@ package drago
 import (
 	"context"
 	"fmt"
+	"net"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -229,8 +231,13 @@ func (s *NodeService) GetInterfaces(args *structs.NodeSpecificRequest, out *stru
 			s.logger.Warnf("couldn't get connections for interface %s", iface.ID)
 		}
 
+		now := time.Now()
 		for _, conn := range connections {
 
+			if !conn.IsActive(now) {
+				continue
+			}
+
 			ifaceSettings := conn.PeerSettingsByInterfaceID(iface.ID)
 			peerSettings := conn.OtherPeerSettingsByInterfaceID(iface.ID)
 
@@ -253,7 +260,20 @@ func (s *NodeService) GetInterfaces(args *structs.NodeSpecificRequest, out *stru
 				Address:             &peerNode.AdvertiseAddress,
 				Port:                peerIface.ListenPort,
 				AllowedIPs:          []string{},
-				PersistentKeepalive: conn.PersistentKeepalive,
+				PersistentKeepalive: conn.PersistentKeepaliveByInterfaceID(iface.ID),
+			}
+
+			if peerSettings.ListenPort != nil {
+				peer.Port = peerSettings.ListenPort
+			}
+
+			// A static endpoint overrides the address advertised by the peer node
+			if e := peerSettings.PrimaryEndpoint(); e != nil {
+				if host, port, err := splitEndpoint(*e); err == nil {
+					peer.Address, peer.Port = &host, &port
+				} else {
+					s.logger.Warnf("couldn't parse endpoint of peer interface %s: %v", peerSettings.InterfaceID, err)
+				}
 			}
 
 			if ifaceSettings.RoutingRules != nil {
@@ -316,6 +336,82 @@ func (s *NodeService) UpdateInterfaces(args *structs.NodeInterfaceUpdateRequest,
 	return nil
 }
 
+// ReportPeers updates the connections of the interfaces of a node
+// with the state of their peers, as observed by the node agent.
+func (s *NodeService) ReportPeers(args *structs.NodePeerReportRequest, out *structs.GenericResponse) error {
+
+	ctx := context.TODO()
+
+	// Check if authorized
+	if s.config.ACL.Enabled {
+		if err := s.authHandler.Authorize(ctx, args.AuthToken, "node", args.NodeID, NodeWrite); err != nil {
+			return structs.ErrPermissionDenied
+		}
+	}
+
+	for _, report := range args.Peers {
+
+		iface, err := s.state.InterfaceByID(ctx, report.InterfaceID)
+		if err != nil || iface.NodeID != args.NodeID {
+			return structs.NewInvalidInputError(fmt.Sprintf("Interface %s does not belong to node", report.InterfaceID))
+		}
+
+		conn, err := s.connectionByPeerPublicKey(ctx, iface.ID, report.PublicKey)
+		if err != nil {
+			s.logger.Debugf("couldn't match peer of interface %s to a connection: %v", iface.ID, err)
+			continue
+		}
+
+		// Reports are applied to the latest version of the connection,
+		// so that they don't overwrite changes made concurrently by users
+		err = s.state.UpdateConnection(ctx, conn.ID, func(c *structs.Connection) (bool, error) {
+			changed := false
+			if report.DiscoveredMTU != nil && (c.DiscoveredMTU == nil || *c.DiscoveredMTU != *report.DiscoveredMTU) {
+				mtu := *report.DiscoveredMTU
+				c.DiscoveredMTU = &mtu
+				changed = true
+			}
+			// Samples are kept per reporting node, as each one counts the traffic
+			// from its own side. Idle connections don't need a new sample on every report.
+			samples := c.SamplesByNodeID(args.NodeID)
+			if n := len(samples); n == 0 || samples[n-1].RxBytes != report.RxBytes || samples[n-1].TxBytes != report.TxBytes {
+				c.RecordSample(structs.Sample{At: time.Now(), NodeID: args.NodeID, RxBytes: report.RxBytes, TxBytes: report.TxBytes})
+				changed = true
+			}
+			return changed, nil
+		})
+		if err != nil {
+			return structs.ErrInternal
+		}
+	}
+
+	return nil
+}
+
+// connectionByPeerPublicKey returns the connection of an interface whose
+// other peer is the interface with the public key passed as argument.
+func (s *NodeService) connectionByPeerPublicKey(ctx context.Context, ifaceID, publicKey string) (*structs.Connection, error) {
+
+	connections, err := s.state.ConnectionsByInterfaceID(ctx, ifaceID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, conn := range connections {
+		peerSettings := conn.OtherPeerSettingsByInterfaceID(ifaceID)
+		if peerSettings == nil {
+			continue
+		}
+		if peerIface, err := s.state.InterfaceByID(ctx, peerSettings.InterfaceID); err == nil {
+			if peerIface.PublicKey != nil && *peerIface.PublicKey == publicKey {
+				return conn, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no connection with peer %s", publicKey)
+}
+
 // GetNode returns a Node entity by ID
 func (s *NodeService) GetNode(args *structs.NodeSpecificRequest, out *structs.SingleNodeResponse) error {
 
@@ -529,3 +625,16 @@ func filterNodes(nodes []*structs.NodeListStub, filters structs.Filters) []*stru
 
 	return out
 }
+
+// splitEndpoint splits an endpoint in the host:port format into its parts.
+func splitEndpoint(s string) (string, int, error) {
+	host, p, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %s", p)
+	}
+	return host, port, nil
+}
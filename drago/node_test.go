@@ -0,0 +1,295 @@
+package drago
+
+import (
+	"context"
+	"testing"
+
+	state "github.com/seashell/drago/drago/state"
+	inmem "github.com/seashell/drago/drago/state/inmem"
+	structs "github.com/seashell/drago/drago/structs"
+	simple "github.com/seashell/drago/pkg/log/simple"
+)
+
+func newTestNodeService(t *testing.T, repo state.Repository) *NodeService {
+	logger, err := simple.NewLoggerAdapter(simple.Config{})
+	if err != nil {
+		t.Fatalf("simple.NewLoggerAdapter() failed, unexpected error: %v", err)
+	}
+	s, err := NewNodeService(DefaultConfig(), logger, repo, nil)
+	if err != nil {
+		t.Fatalf("NewNodeService() failed, unexpected error: %v", err)
+	}
+	return s
+}
+
+// peerOf returns the only peer of the only interface of a node.
+func peerOf(t *testing.T, s *NodeService, nodeID string) *structs.Peer {
+	var out structs.NodeInterfacesResponse
+	if err := s.GetInterfaces(&structs.NodeSpecificRequest{NodeID: nodeID}, &out); err != nil {
+		t.Fatalf("s.GetInterfaces() failed, unexpected error: %v", err)
+	}
+	if len(out.Items) != 1 || len(out.Items[0].Peers) != 1 {
+		t.Fatalf("s.GetInterfaces() failed, expected a single interface with a single peer, have %v", out.Items)
+	}
+	return out.Items[0].Peers[0]
+}
+
+func TestGetInterfacesPeerEndpoint(t *testing.T) {
+
+	cs, repo := newTestConnectionService(t)
+	ctx := context.TODO()
+	seedTestInterfaces(t, repo, "network-1", "a", "b")
+
+	port := 51820
+	repo.UpsertNode(ctx, &structs.Node{ID: "node-b", AdvertiseAddress: "198.51.100.2"})
+	repo.UpsertInterface(ctx, &structs.Interface{ID: "iface-b", NodeID: "node-b", NetworkID: "network-1", ListenPort: &port})
+
+	req := &structs.ConnectionUpsertRequest{
+		Connection: &structs.Connection{
+			PeerSettings: []*structs.PeerSettings{
+				{InterfaceID: "iface-a", NodeID: "node-a"},
+				{InterfaceID: "iface-b", NodeID: "node-b"},
+			},
+		},
+	}
+	if err := cs.UpsertConnection(req, &structs.GenericResponse{}); err != nil {
+		t.Fatalf("cs.UpsertConnection() failed, unexpected error: %v", err)
+	}
+
+	s := newTestNodeService(t, repo)
+
+	// Without an endpoint, the address advertised by the node is used
+	if p := peerOf(t, s, "node-a"); *p.Address != "198.51.100.2" || *p.Port != 51820 {
+		t.Fatalf("s.GetInterfaces() failed, expected peer at %s:%d, have %s:%d", "198.51.100.2", 51820, *p.Address, *p.Port)
+	}
+
+	// The endpoint overrides both the address and the port
+	connections, _ := repo.Connections(ctx)
+	endpoint := "203.0.113.7:4500"
+	req = &structs.ConnectionUpsertRequest{
+		Connection: &structs.Connection{
+			ID: connections[0].ID,
+			PeerSettings: []*structs.PeerSettings{
+				{InterfaceID: "iface-b", Endpoint: &endpoint},
+			},
+		},
+	}
+	if err := cs.UpsertConnection(req, &structs.GenericResponse{}); err != nil {
+		t.Fatalf("cs.UpsertConnection() failed, unexpected error: %v", err)
+	}
+	if p := peerOf(t, s, "node-a"); *p.Address != "203.0.113.7" || *p.Port != 4500 {
+		t.Fatalf("s.GetInterfaces() failed, expected peer at %s, have %s:%d", endpoint, *p.Address, *p.Port)
+	}
+
+	// The first of the ordered endpoints takes precedence
+	req.Connection.PeerSettings[0].Endpoints = []string{"192.0.2.9:51821", endpoint}
+	if err := cs.UpsertConnection(req, &structs.GenericResponse{}); err != nil {
+		t.Fatalf("cs.UpsertConnection() failed, unexpected error: %v", err)
+	}
+	if p := peerOf(t, s, "node-a"); *p.Address != "192.0.2.9" || *p.Port != 51821 {
+		t.Fatalf("s.GetInterfaces() failed, expected peer at %s, have %s:%d", "192.0.2.9:51821", *p.Address, *p.Port)
+	}
+}
+
+func TestReportPeers(t *testing.T) {
+
+	cs, repo := newTestConnectionService(t)
+	ctx := context.TODO()
+	seedTestInterfaces(t, repo, "network-1", "a", "b", "c")
+
+	key := "public-key-b"
+	repo.UpsertInterface(ctx, &structs.Interface{ID: "iface-b", NodeID: "node-b", NetworkID: "network-1", PublicKey: &key})
+
+	// Values reported by agents can't be set through the API
+	mtu := 1500
+	id := createTestConnection(t, cs, "a", "b", &structs.Connection{DiscoveredMTU: &mtu})
+	if c, _ := repo.ConnectionByID(ctx, id); c.DiscoveredMTU != nil {
+		t.Fatalf("cs.UpsertConnection() failed, expected no discovered MTU, have %d", *c.DiscoveredMTU)
+	}
+
+	s := newTestNodeService(t, repo)
+
+	mtu = 1380
+	req := &structs.NodePeerReportRequest{
+		NodeID: "node-a",
+		Peers: []*structs.PeerReport{
+			{InterfaceID: "iface-a", PublicKey: key, DiscoveredMTU: &mtu},
+			{InterfaceID: "iface-a", PublicKey: "unknown"},
+		},
+	}
+	if err := s.ReportPeers(req, &structs.GenericResponse{}); err != nil {
+		t.Fatalf("s.ReportPeers() failed, unexpected error: %v", err)
+	}
+
+	var out structs.ConnectionListResponse
+	if err := cs.ListConnections(&structs.ConnectionListRequest{}, &out); err != nil {
+		t.Fatalf("cs.ListConnections() failed, unexpected error: %v", err)
+	}
+	if stub := out.Items[0]; stub.DiscoveredMTU == nil || *stub.DiscoveredMTU != 1380 || stub.MTU != nil {
+		t.Fatalf("s.ReportPeers() failed, expected discovered MTU %d, have %v", 1380, stub.DiscoveredMTU)
+	}
+
+	// Nodes can only report the peers of their own interfaces
+	req = &structs.NodePeerReportRequest{
+		NodeID: "node-c",
+		Peers:  []*structs.PeerReport{{InterfaceID: "iface-a", PublicKey: key}},
+	}
+	if err := s.ReportPeers(req, &structs.GenericResponse{}); err == nil {
+		t.Fatalf("s.ReportPeers() failed, expected error for interface of another node")
+	}
+}
+
+// editingRepository applies an edit to every connection it looks up by
+// interface, after returning them, as a user editing it concurrently would.
+type editingRepository struct {
+	*inmem.StateRepository
+	edit func(*structs.Connection)
+}
+
+func (r *editingRepository) ConnectionsByInterfaceID(ctx context.Context, id string) ([]*structs.Connection, error) {
+	connections, err := r.StateRepository.ConnectionsByInterfaceID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	res := []*structs.Connection{}
+	for _, c := range connections {
+		res = append(res, c.Clone())
+		edited := c.Clone()
+		r.edit(edited)
+		r.StateRepository.UpsertConnection(ctx, edited)
+	}
+	return res, nil
+}
+
+// countingRepository counts the connection updates which were written.
+type countingRepository struct {
+	*inmem.StateRepository
+	writes int
+}
+
+func (r *countingRepository) UpdateConnection(ctx context.Context, id string, fn func(*structs.Connection) (bool, error)) error {
+	return r.StateRepository.UpdateConnection(ctx, id, func(c *structs.Connection) (bool, error) {
+		changed, err := fn(c)
+		if changed {
+			r.writes++
+		}
+		return changed, err
+	})
+}
+
+func TestReportPeersConcurrentEdit(t *testing.T) {
+
+	cs, repo := newTestConnectionService(t)
+	ctx := context.TODO()
+	seedTestInterfaces(t, repo, "network-1", "a", "b")
+
+	key := "public-key-b"
+	repo.UpsertInterface(ctx, &structs.Interface{ID: "iface-b", NodeID: "node-b", NetworkID: "network-1", PublicKey: &key})
+	id := createTestConnection(t, cs, "a", "b", &structs.Connection{})
+
+	keepalive := 25
+	s := newTestNodeService(t, &editingRepository{repo, func(c *structs.Connection) {
+		c.PersistentKeepalive = &keepalive
+	}})
+
+	mtu := 1380
+	req := &structs.NodePeerReportRequest{
+		NodeID: "node-a",
+		Peers:  []*structs.PeerReport{{InterfaceID: "iface-a", PublicKey: key, DiscoveredMTU: &mtu}},
+	}
+	if err := s.ReportPeers(req, &structs.GenericResponse{}); err != nil {
+		t.Fatalf("s.ReportPeers() failed, unexpected error: %v", err)
+	}
+
+	c, _ := repo.ConnectionByID(ctx, id)
+	if c.PersistentKeepalive == nil || *c.PersistentKeepalive != 25 {
+		t.Fatalf("s.ReportPeers() failed, concurrent edit was lost, have keepalive %v", c.PersistentKeepalive)
+	}
+	if c.DiscoveredMTU == nil || *c.DiscoveredMTU != 1380 {
+		t.Fatalf("s.ReportPeers() failed, expected discovered MTU %d, have %v", 1380, c.DiscoveredMTU)
+	}
+}
+
+func TestReportPeersUnchanged(t *testing.T) {
+
+	cs, repo := newTestConnectionService(t)
+	ctx := context.TODO()
+	seedTestInterfaces(t, repo, "network-1", "a", "b")
+
+	key := "public-key-b"
+	repo.UpsertInterface(ctx, &structs.Interface{ID: "iface-b", NodeID: "node-b", NetworkID: "network-1", PublicKey: &key})
+	createTestConnection(t, cs, "a", "b", &structs.Connection{})
+
+	counting := &countingRepository{StateRepository: repo}
+	s := newTestNodeService(t, counting)
+
+	mtu := 1380
+	req := &structs.NodePeerReportRequest{
+		NodeID: "node-a",
+		Peers:  []*structs.PeerReport{{InterfaceID: "iface-a", PublicKey: key, DiscoveredMTU: &mtu, RxBytes: 100, TxBytes: 10}},
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.ReportPeers(req, &structs.GenericResponse{}); err != nil {
+			t.Fatalf("s.ReportPeers() failed, unexpected error: %v", err)
+		}
+	}
+	if counting.writes != 1 {
+		t.Fatalf("s.ReportPeers() failed, expected %d write, have %d", 1, counting.writes)
+	}
+
+	// Reports without any value don't write either
+	req.Peers[0].DiscoveredMTU = nil
+	if err := s.ReportPeers(req, &structs.GenericResponse{}); err != nil || counting.writes != 1 {
+		t.Fatalf("s.ReportPeers() failed, expected %d write, have %d (%v)", 1, counting.writes, err)
+	}
+}
+
+func TestReportPeersSamplesByNode(t *testing.T) {
+
+	cs, repo := newTestConnectionService(t)
+	ctx := context.TODO()
+	seedTestInterfaces(t, repo, "network-1", "a", "b")
+
+	keys := map[string]string{"a": "public-key-a", "b": "public-key-b"}
+	for id, key := range keys {
+		key := key
+		repo.UpsertInterface(ctx, &structs.Interface{ID: "iface-" + id, NodeID: "node-" + id, NetworkID: "network-1", PublicKey: &key})
+	}
+	id := createTestConnection(t, cs, "a", "b", &structs.Connection{})
+
+	s := newTestNodeService(t, repo)
+
+	// Both nodes report the same traffic, each one from its own side
+	for i := 1; i <= 3; i++ {
+		for self, other := range map[string]string{"a": "b", "b": "a"} {
+			rx, tx := uint64(100*i), uint64(10*i)
+			if self == "b" {
+				rx, tx = tx, rx
+			}
+			req := &structs.NodePeerReportRequest{
+				NodeID: "node-" + self,
+				Peers:  []*structs.PeerReport{{InterfaceID: "iface-" + self, PublicKey: keys[other], RxBytes: rx, TxBytes: tx}},
+			}
+			if err := s.ReportPeers(req, &structs.GenericResponse{}); err != nil {
+				t.Fatalf("s.ReportPeers() failed, unexpected error: %v", err)
+			}
+		}
+	}
+
+	c, _ := repo.ConnectionByID(ctx, id)
+	for _, node := range []string{"node-a", "node-b"} {
+		if n := len(c.SamplesByNodeID(node)); n != 3 {
+			t.Fatalf("s.ReportPeers() failed, expected %d samples of %s, have %d", 3, node, n)
+		}
+	}
+	for i, sample := range c.SamplesByNodeID("node-a") {
+		if sample.RxBytes != uint64(100*(i+1)) || sample.TxBytes != uint64(10*(i+1)) {
+			t.Fatalf("s.ReportPeers() failed, unexpected samples of node-a %v", c.SamplesByNodeID("node-a"))
+		}
+	}
+	for i, sample := range c.SamplesByNodeID("node-b") {
+		if sample.RxBytes != uint64(10*(i+1)) || sample.TxBytes != uint64(100*(i+1)) {
+			t.Fatalf("s.ReportPeers() failed, unexpected samples of node-b %v", c.SamplesByNodeID("node-b"))
+		}
+	}
+}
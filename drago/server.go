@@ -8,6 +8,7 @@ import (
 
 	auth "github.com/seashell/drago/drago/auth"
 	state "github.com/seashell/drago/drago/state"
+	cache "github.com/seashell/drago/drago/state/cache"
 	"github.com/seashell/drago/drago/state/etcd"
 	structs "github.com/seashell/drago/drago/structs"
 	"github.com/seashell/drago/drago/structs/config"
@@ -111,6 +112,10 @@ func (s *Server) Shutdown() error {
 
 	//s.etcdServer.Close()
 
+	if c, ok := s.state.(*cache.StateRepository); ok {
+		c.Close()
+	}
+
 	s.shutdown = true
 	close(s.shutdownCh)
 
@@ -139,6 +144,10 @@ func (s *Server) setupApplication() error {
 	}
 	s.state = state
 
+	if s.config.ConnectionCacheSize > 0 {
+		s.state = cache.NewStateRepository(state, s.config.ConnectionCacheSize)
+	}
+
 	ctx := context.TODO()
 
 	// Setup default network
@@ -179,6 +188,10 @@ func (s *Server) setupApplication() error {
 	s.services.Interfaces = NewInterfaceService(s.config, s.logger, s.state, s.authHandler)
 	s.services.Connections = NewConnectionService(s.config, s.logger, s.state, s.authHandler)
 
+	if s.config.ConnectionGCInterval > 0 {
+		go s.services.Connections.purgeExpiredPeriodically(s.config.ConnectionGCInterval, s.shutdownCh)
+	}
+
 	s.services.Status = NewStatusService(s.config, s.state, s.authHandler)
 
 	return nil
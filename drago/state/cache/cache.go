@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	state "github.com/seashell/drago/drago/state"
+	structs "github.com/seashell/drago/drago/structs"
+)
+
+// StateRepository wraps another repository, caching the most recently
+// read connections in memory, so that repeated reads of the same connection
+// do not hit the underlying repository. Cached entries are invalidated
+// whenever the corresponding connection is upserted or deleted.
+//
+// Repositories which may be written by other processes, such as etcd, must
+// implement state.ConnectionWatcher, so that entries are also invalidated on
+// writes made elsewhere. If the changes can no longer be watched, caching is
+// disabled. Other repositories are assumed to be written by this process only.
+type StateRepository struct {
+	state.Repository
+
+	cancel context.CancelFunc
+
+	// The lock is held while reading from the underlying repository
+	// on cache misses, and while writing to it, so that a read can't
+	// put a stale entry in the cache after a concurrent write.
+	lock    sync.Mutex
+	size    int
+	entries *list.List
+	items   map[string]*list.Element
+}
+
+type entry struct {
+	id   string
+	conn *structs.Connection
+}
+
+// NewStateRepository returns a repository caching up to size connections
+// read from the underlying repository.
+func NewStateRepository(repo state.Repository, size int) *StateRepository {
+	r := &StateRepository{
+		Repository: repo,
+		size:       size,
+		entries:    list.New(),
+		items:      map[string]*list.Element{},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	if w, ok := repo.(state.ConnectionWatcher); ok {
+		go r.invalidate(w.WatchConnections(ctx))
+	}
+
+	return r
+}
+
+// Close stops watching the underlying repository for changes.
+func (r *StateRepository) Close() {
+	r.cancel()
+}
+
+// invalidate evicts the connections whose IDs are received on ch, or all
+// of them if the ID is empty. Once ch is closed, caching is disabled.
+func (r *StateRepository) invalidate(ch <-chan string) {
+	for id := range ch {
+		r.lock.Lock()
+		if id == "" {
+			r.flush()
+		} else if el, ok := r.items[id]; ok {
+			r.evict(el)
+		}
+		r.lock.Unlock()
+	}
+
+	r.lock.Lock()
+	r.flush()
+	r.size = 0
+	r.lock.Unlock()
+}
+
+// Name ...
+func (r *StateRepository) Name() string {
+	return "cache+" + r.Repository.Name()
+}
+
+// ConnectionByID ...
+func (r *StateRepository) ConnectionByID(ctx context.Context, id string) (*structs.Connection, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if el, ok := r.items[id]; ok {
+		r.entries.MoveToFront(el)
+		return el.Value.(*entry).conn.Clone(), nil
+	}
+
+	c, err := r.Repository.ConnectionByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	r.items[id] = r.entries.PushFront(&entry{id: id, conn: c.Clone()})
+	if r.entries.Len() > r.size {
+		r.evict(r.entries.Back())
+	}
+
+	// Callers must not be able to modify the connection held by the underlying repository
+	return c.Clone(), nil
+}
+
+// UpsertConnection ...
+func (r *StateRepository) UpsertConnection(ctx context.Context, c *structs.Connection) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if el, ok := r.items[c.ID]; ok {
+		r.evict(el)
+	}
+
+	return r.Repository.UpsertConnection(ctx, c)
+}
+
+// UpdateConnection ...
+func (r *StateRepository) UpdateConnection(ctx context.Context, id string, fn func(*structs.Connection) (bool, error)) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if el, ok := r.items[id]; ok {
+		r.evict(el)
+	}
+
+	return r.Repository.UpdateConnection(ctx, id, fn)
+}
+
+// DeleteConnections ...
+func (r *StateRepository) DeleteConnections(ctx context.Context, ids []string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, id := range ids {
+		if el, ok := r.items[id]; ok {
+			r.evict(el)
+		}
+	}
+
+	return r.Repository.DeleteConnections(ctx, ids)
+}
+
+// Len returns the number of cached connections.
+func (r *StateRepository) Len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.entries.Len()
+}
+
+func (r *StateRepository) evict(el *list.Element) {
+	r.entries.Remove(el)
+	delete(r.items, el.Value.(*entry).id)
+}
+
+func (r *StateRepository) flush() {
+	r.entries.Init()
+	r.items = map[string]*list.Element{}
+}
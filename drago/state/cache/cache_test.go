@@ -0,0 +1,170 @@
+package cache
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	inmem "github.com/seashell/drago/drago/state/inmem"
+	structs "github.com/seashell/drago/drago/structs"
+)
+
+func newTestConnection(id string) *structs.Connection {
+	return &structs.Connection{
+		ID:        id,
+		NetworkID: "network-1",
+		PeerSettings: []*structs.PeerSettings{
+			{InterfaceID: "iface-a", NodeID: "node-a", RoutingRules: &structs.RoutingRules{AllowedIPs: []string{"10.0.0.1/32"}}},
+			{InterfaceID: "iface-b", NodeID: "node-b", RoutingRules: &structs.RoutingRules{AllowedIPs: []string{"10.0.0.2/32"}}},
+		},
+	}
+}
+
+// watchingRepository reports the changes sent on ch, as if they had been
+// made by another process.
+type watchingRepository struct {
+	*inmem.StateRepository
+	ch chan string
+}
+
+func (r *watchingRepository) WatchConnections(ctx context.Context) <-chan string {
+	return r.ch
+}
+
+func waitForLen(t *testing.T, r *StateRepository, n int) {
+	deadline := time.Now().Add(time.Second)
+	for r.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("r.Len() failed, expected %d cached entries, have %d", n, r.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheReadThrough(t *testing.T) {
+
+	ctx := context.TODO()
+	backend := inmem.NewStateRepository(nil)
+	r := NewStateRepository(backend, 2)
+
+	backend.UpsertConnection(ctx, newTestConnection("conn-1"))
+
+	direct, _ := backend.ConnectionByID(ctx, "conn-1")
+	for i := 0; i < 2; i++ {
+		cached, err := r.ConnectionByID(ctx, "conn-1")
+		if err != nil {
+			t.Fatalf("r.ConnectionByID() failed, unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(cached, direct) {
+			t.Fatalf("r.ConnectionByID() failed, expected %+v, have %+v", direct, cached)
+		}
+	}
+
+	if _, err := r.ConnectionByID(ctx, "conn-unknown"); err == nil {
+		t.Fatalf("r.ConnectionByID() failed, expected error for unknown connection")
+	}
+	if r.Len() != 1 {
+		t.Fatalf("r.ConnectionByID() failed, expected %d cached entry, have %d", 1, r.Len())
+	}
+
+	// Mutating a connection returned on a miss does not affect the underlying repository
+	r = NewStateRepository(backend, 2)
+	c, _ := r.ConnectionByID(ctx, "conn-1")
+	c.PeerSettings[0].RoutingRules.AllowedIPs[0] = "0.0.0.0/0"
+	if direct, _ = backend.ConnectionByID(ctx, "conn-1"); direct.PeerSettings[0].RoutingRules.AllowedIPs[0] != "10.0.0.1/32" {
+		t.Fatalf("r.ConnectionByID() failed, underlying connection was modified by a caller")
+	}
+}
+
+func TestCacheWatchInvalidation(t *testing.T) {
+
+	ctx := context.TODO()
+	backend := &watchingRepository{inmem.NewStateRepository(nil), make(chan string)}
+	r := NewStateRepository(backend, 2)
+	defer r.Close()
+
+	for _, id := range []string{"conn-1", "conn-2"} {
+		backend.UpsertConnection(ctx, newTestConnection(id))
+		r.ConnectionByID(ctx, id)
+	}
+
+	// Changes made by another process invalidate the cached entry
+	backend.ch <- "conn-1"
+	waitForLen(t, r, 1)
+	if _, ok := r.items["conn-1"]; ok {
+		t.Fatalf("r.ConnectionByID() failed, expected watched entry to be evicted")
+	}
+
+	// Missed changes invalidate all entries
+	r.ConnectionByID(ctx, "conn-1")
+	backend.ch <- ""
+	waitForLen(t, r, 0)
+
+	// Caching is disabled once changes can no longer be watched
+	close(backend.ch)
+	r.ConnectionByID(ctx, "conn-1")
+	waitForLen(t, r, 0)
+	r.ConnectionByID(ctx, "conn-1")
+	if r.Len() != 0 {
+		t.Fatalf("r.ConnectionByID() failed, expected %d cached entries, have %d", 0, r.Len())
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+
+	ctx := context.TODO()
+	backend := inmem.NewStateRepository(nil)
+	r := NewStateRepository(backend, 2)
+
+	r.UpsertConnection(ctx, newTestConnection("conn-1"))
+	if _, err := r.ConnectionByID(ctx, "conn-1"); err != nil {
+		t.Fatalf("r.ConnectionByID() failed, unexpected error: %v", err)
+	}
+
+	// Upserts invalidate the cached entry
+	updated := newTestConnection("conn-1")
+	updated.PersistentKeepalive = new(int)
+	*updated.PersistentKeepalive = 25
+	r.UpsertConnection(ctx, updated)
+
+	c, err := r.ConnectionByID(ctx, "conn-1")
+	if err != nil {
+		t.Fatalf("r.ConnectionByID() failed, unexpected error: %v", err)
+	}
+	if c.PersistentKeepalive == nil || *c.PersistentKeepalive != 25 {
+		t.Fatalf("r.ConnectionByID() failed, served stale connection after upsert")
+	}
+
+	// Mutating a returned connection does not affect the cache
+	c.PeerSettings[0].RoutingRules.AllowedIPs[0] = "0.0.0.0/0"
+	c, _ = r.ConnectionByID(ctx, "conn-1")
+	if c.PeerSettings[0].RoutingRules.AllowedIPs[0] != "10.0.0.1/32" {
+		t.Fatalf("r.ConnectionByID() failed, cached entry was modified by a caller")
+	}
+
+	// Deletes invalidate the cached entry
+	r.DeleteConnections(ctx, []string{"conn-1"})
+	if _, err := r.ConnectionByID(ctx, "conn-1"); err == nil {
+		t.Fatalf("r.ConnectionByID() failed, served deleted connection")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+
+	ctx := context.TODO()
+	backend := inmem.NewStateRepository(nil)
+	r := NewStateRepository(backend, 2)
+
+	for _, id := range []string{"conn-1", "conn-2", "conn-3"} {
+		backend.UpsertConnection(ctx, newTestConnection(id))
+		r.ConnectionByID(ctx, id)
+	}
+
+	if r.Len() != 2 {
+		t.Fatalf("r.ConnectionByID() failed, expected %d cached entries, have %d", 2, r.Len())
+	}
+	if _, ok := r.items["conn-1"]; ok {
+		t.Fatalf("r.ConnectionByID() failed, expected least recently used entry to be evicted")
+	}
+}
@@ -2,13 +2,28 @@ package etcd
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"strings"
+	"time"
 
+	state "github.com/seashell/drago/drago/state"
 	structs "github.com/seashell/drago/drago/structs"
 	"go.etcd.io/etcd/clientv3"
 )
 
+// maxUpdateAttempts is the number of times an update is retried
+// when the connection is concurrently modified.
+const maxUpdateAttempts = 5
+
+// decodeConnection decodes a stored connection, upgrading it to the current
+// schema version, so that callers never see records in an older format.
+func decodeConnection(data []byte, c *structs.Connection) error {
+	if err := decodeValue(data, c); err != nil {
+		return err
+	}
+	return c.Migrate(c.SchemaVersion)
+}
+
 // Connections :
 func (r *StateRepository) Connections(ctx context.Context) ([]*structs.Connection, error) {
 
@@ -23,7 +38,7 @@ func (r *StateRepository) Connections(ctx context.Context) ([]*structs.Connectio
 
 	for _, el := range res.Kvs {
 		conn := &structs.Connection{}
-		err := decodeValue(el.Value, conn)
+		err := decodeConnection(el.Value, conn)
 		if err != nil {
 			return nil, err
 		}
@@ -33,6 +48,42 @@ func (r *StateRepository) Connections(ctx context.Context) ([]*structs.Connectio
 	return items, nil
 }
 
+// connectionPageSize is the number of connections
+// read at a time by IterateConnections.
+const connectionPageSize = 100
+
+// IterateConnections : invokes fn for each connection, reading them in pages so
+// that they are never all held in memory, and stops at the first error returned.
+func (r *StateRepository) IterateConnections(ctx context.Context, fn func(*structs.Connection) error) error {
+
+	prefix := resourceKey(resourceTypeConnection, "")
+	end := clientv3.GetPrefixRangeEnd(prefix)
+
+	for key := prefix; ; {
+		res, err := r.client.Get(ctx, key, clientv3.WithRange(end), clientv3.WithLimit(connectionPageSize))
+		if err != nil {
+			return err
+		}
+
+		for _, el := range res.Kvs {
+			conn := &structs.Connection{}
+			if err := decodeConnection(el.Value, conn); err != nil {
+				return err
+			}
+			if err := fn(conn); err != nil {
+				return err
+			}
+		}
+
+		if !res.More || len(res.Kvs) == 0 {
+			return nil
+		}
+
+		// Continue right after the last key read
+		key = string(res.Kvs[len(res.Kvs)-1].Key) + "\x00"
+	}
+}
+
 // ConnectionByID :
 func (r *StateRepository) ConnectionByID(ctx context.Context, id string) (*structs.Connection, error) {
 
@@ -44,12 +95,19 @@ func (r *StateRepository) ConnectionByID(ctx context.Context, id string) (*struc
 	}
 
 	if res.Count == 0 {
-		return nil, errors.New("not found")
+		res, err := r.client.Get(ctx, resourceKey(resourceTypeDeletedConnection, id), clientv3.WithCountOnly())
+		if err != nil {
+			return nil, err
+		}
+		if res.Count > 0 {
+			return nil, structs.ErrDeleted
+		}
+		return nil, structs.ErrNotFound
 	}
 
 	network := &structs.Connection{}
 
-	err = decodeValue(res.Kvs[0].Value, network)
+	err = decodeConnection(res.Kvs[0].Value, network)
 	if err != nil {
 		return nil, err
 	}
@@ -71,7 +129,7 @@ func (r *StateRepository) ConnectionsByNetworkID(ctx context.Context, id string)
 
 	for _, el := range res.Kvs {
 		conn := &structs.Connection{}
-		if err := decodeValue(el.Value, conn); err != nil {
+		if err := decodeConnection(el.Value, conn); err != nil {
 			return nil, err
 		}
 		if conn.NetworkID == id {
@@ -96,7 +154,7 @@ func (r *StateRepository) ConnectionsByNodeID(ctx context.Context, id string) ([
 
 	for _, el := range res.Kvs {
 		conn := &structs.Connection{}
-		if err := decodeValue(el.Value, conn); err != nil {
+		if err := decodeConnection(el.Value, conn); err != nil {
 			return nil, err
 		}
 
@@ -122,7 +180,7 @@ func (r *StateRepository) ConnectionsByInterfaceID(ctx context.Context, id strin
 
 	for _, el := range res.Kvs {
 		conn := &structs.Connection{}
-		if err := decodeValue(el.Value, conn); err != nil {
+		if err := decodeConnection(el.Value, conn); err != nil {
 			return nil, err
 		}
 
@@ -146,7 +204,7 @@ func (r *StateRepository) ConnectionByInterfaceIDs(ctx context.Context, a, b str
 
 	for _, el := range res.Kvs {
 		conn := &structs.Connection{}
-		if err := decodeValue(el.Value, conn); err != nil {
+		if err := decodeConnection(el.Value, conn); err != nil {
 			return nil, err
 		}
 
@@ -158,23 +216,145 @@ func (r *StateRepository) ConnectionByInterfaceIDs(ctx context.Context, a, b str
 	return nil, fmt.Errorf("not found")
 }
 
+// ConnectionByIdempotencyKey :
+func (r *StateRepository) ConnectionByIdempotencyKey(ctx context.Context, networkID, key string) (*structs.Connection, error) {
+
+	if key == "" {
+		return nil, structs.ErrNotFound
+	}
+
+	res, err := r.client.Get(ctx, idempotencyIndexKey(networkID, key))
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Count == 0 {
+		return nil, structs.ErrNotFound
+	}
+
+	conn, err := r.ConnectionByID(ctx, string(res.Kvs[0].Value))
+	if err != nil {
+		return nil, err
+	}
+
+	// The connection may have been updated with another key since
+	if conn.NetworkID != networkID || conn.IdempotencyKey != key {
+		return nil, structs.ErrNotFound
+	}
+
+	return conn, nil
+}
+
+// idempotencyIndexKey returns the key under which the ID of the connection
+// created with an idempotency key is stored, since keys are scoped by network.
+func idempotencyIndexKey(networkID, key string) string {
+	return resourceKey(resourceTypeIdempotencyKey, networkID+"/"+key)
+}
+
 // UpsertConnection :
 func (r *StateRepository) UpsertConnection(ctx context.Context, n *structs.Connection) error {
 	key := resourceKey(resourceTypeConnection, n.ID)
 
-	_, err := r.client.Put(ctx, key, encodeValue(n))
+	ops := []clientv3.Op{clientv3.OpPut(key, encodeValue(n))}
+	if n.IdempotencyKey != "" {
+		ops = append(ops, clientv3.OpPut(idempotencyIndexKey(n.NetworkID, n.IdempotencyKey), n.ID))
+	}
+
+	_, err := r.client.Txn(ctx).Then(ops...).Commit()
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// UpdateConnection ...
+func (r *StateRepository) UpdateConnection(ctx context.Context, id string, fn func(*structs.Connection) (bool, error)) error {
+
+	key := resourceKey(resourceTypeConnection, id)
+
+	for i := 0; i < maxUpdateAttempts; i++ {
+		res, err := r.client.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if res.Count == 0 {
+			return structs.ErrNotFound
+		}
+
+		c := &structs.Connection{}
+		if err := decodeConnection(res.Kvs[0].Value, c); err != nil {
+			return err
+		}
+
+		changed, err := fn(c)
+		if err != nil || !changed {
+			return err
+		}
+
+		ops := []clientv3.Op{clientv3.OpPut(key, encodeValue(c))}
+		if c.IdempotencyKey != "" {
+			ops = append(ops, clientv3.OpPut(idempotencyIndexKey(c.NetworkID, c.IdempotencyKey), c.ID))
+		}
+
+		// The write only succeeds if the connection is still at the revision read
+		txn, err := r.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", res.Kvs[0].ModRevision)).
+			Then(ops...).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if txn.Succeeded {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("connection %s modified concurrently, giving up after %d attempts", id, maxUpdateAttempts)
+}
+
 // DeleteConnections :
 func (r *StateRepository) DeleteConnections(ctx context.Context, ids []string) error {
 
+	// Deleted IDs are remembered under a lease, so that they expire
+	var lease *clientv3.LeaseGrantResponse
+
 	for _, id := range ids {
 		key := resourceKey(resourceTypeConnection, id)
-		_, err := r.client.Delete(ctx, key)
+
+		res, err := r.client.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if res.Count == 0 {
+			continue
+		}
+
+		// The idempotency key is only unindexed if it hasn't been reused by another connection.
+		// Connections which can't be decoded are still deleted, leaving their key indexed.
+		conn := &structs.Connection{}
+		if err := decodeValue(res.Kvs[0].Value, conn); err == nil && conn.IdempotencyKey != "" {
+			indexKey := idempotencyIndexKey(conn.NetworkID, conn.IdempotencyKey)
+			_, err := r.client.Txn(ctx).
+				If(clientv3.Compare(clientv3.Value(indexKey), "=", id)).
+				Then(clientv3.OpDelete(indexKey)).
+				Commit()
+			if err != nil {
+				return err
+			}
+		}
+
+		if lease == nil {
+			if lease, err = r.client.Grant(ctx, int64(state.DeletedConnectionRetention/time.Second)); err != nil {
+				return err
+			}
+		}
+
+		_, err = r.client.Txn(ctx).
+			Then(
+				clientv3.OpDelete(key),
+				clientv3.OpPut(resourceKey(resourceTypeDeletedConnection, id), "", clientv3.WithLease(lease.ID)),
+			).
+			Commit()
 		if err != nil {
 			return err
 		}
@@ -182,3 +362,32 @@ func (r *StateRepository) DeleteConnections(ctx context.Context, ids []string) e
 
 	return nil
 }
+
+// WatchConnections ...
+func (r *StateRepository) WatchConnections(ctx context.Context) <-chan string {
+
+	prefix := resourceKey(resourceTypeConnection, "")
+	ch := make(chan string)
+
+	go func() {
+		defer close(ch)
+		for res := range r.client.Watch(ctx, prefix, clientv3.WithPrefix()) {
+			ids := []string{}
+			if err := res.Err(); err != nil {
+				ids = append(ids, "")
+			}
+			for _, ev := range res.Events {
+				ids = append(ids, strings.TrimPrefix(string(ev.Kv.Key), prefix))
+			}
+			for _, id := range ids {
+				select {
+				case ch <- id:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return ch
+}
@@ -26,6 +26,15 @@ const (
 	resourceTypeInterface  = "interface"
 	resourceTypeConnection = "connection"
 
+	// Idempotency keys are indexed under their own prefix, mapping
+	// each key to the ID of the connection created with it.
+	resourceTypeIdempotencyKey = "idempotency-key"
+
+	// Deleted connections are remembered for state.DeletedConnectionRetention,
+	// so that updates referencing them can be told apart from the creation of
+	// a new connection.
+	resourceTypeDeletedConnection = "deleted-connection"
+
 	transactionContextKey = "etcdtxn"
 )
 
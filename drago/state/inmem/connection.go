@@ -2,14 +2,20 @@ package inmem
 
 import (
 	"context"
-	"errors"
 	"strings"
+	"sync"
+	"time"
 
+	state "github.com/seashell/drago/drago/state"
 	structs "github.com/seashell/drago/drago/structs"
 )
 
 const (
 	resourceTypeConnection = "connection"
+
+	// IDs of deleted connections, which must not be recreated by updates,
+	// mapped to the time of their deletion
+	resourceTypeDeletedConnection = "deleted-connection"
 )
 
 // Connections :
@@ -26,30 +32,59 @@ func (r *StateRepository) Connections(ctx context.Context) ([]*structs.Connectio
 	return items, nil
 }
 
+// IterateConnections ...
+func (r *StateRepository) IterateConnections(ctx context.Context, fn func(*structs.Connection) error) error {
+	items, err := r.Connections(ctx)
+	if err != nil {
+		return err
+	}
+	for _, c := range items {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // ConnectionByID ...
 func (r *StateRepository) ConnectionByID(ctx context.Context, id string) (*structs.Connection, error) {
 	key := resourceKey(resourceTypeConnection, id)
 	if v, found := r.kv.Get(key); found {
 		return v.(*structs.Connection), nil
 	}
-	return nil, errors.New("not found")
+	if v, found := r.kv.Get(resourceKey(resourceTypeDeletedConnection, id)); found {
+		if time.Since(v.(time.Time)) < state.DeletedConnectionRetention {
+			return nil, structs.ErrDeleted
+		}
+	}
+	return nil, structs.ErrNotFound
 }
 
 // ConnectionByInterfaceIDs ...
 func (r *StateRepository) ConnectionByInterfaceIDs(ctx context.Context, a, b string) (*structs.Connection, error) {
-	prefix := resourcePrefix(resourceTypeConnection)
 
-	for el := range r.kv.Iter() {
-		if strings.HasPrefix(el.Key, prefix) {
-			if c, ok := el.Value.(*structs.Connection); ok {
-				if c.ConnectsInterfaces(a, b) {
-					return c, nil
-				}
+	for _, id := range r.connIndex.lookup(a) {
+		key := resourceKey(resourceTypeConnection, id)
+		if v, found := r.kv.Get(key); found {
+			if c := v.(*structs.Connection); c.ConnectsInterfaces(a, b) {
+				return c, nil
 			}
 		}
 	}
 
-	return nil, errors.New("not found")
+	return nil, structs.ErrNotFound
+}
+
+// ConnectionByIdempotencyKey ...
+func (r *StateRepository) ConnectionByIdempotencyKey(ctx context.Context, networkID, key string) (*structs.Connection, error) {
+
+	if id, ok := r.connIndex.lookupKey(scopedIdempotencyKey(networkID, key)); ok {
+		if v, found := r.kv.Get(resourceKey(resourceTypeConnection, id)); found {
+			return v.(*structs.Connection), nil
+		}
+	}
+
+	return nil, structs.ErrNotFound
 }
 
 // ConnectionsByNetworkID ...
@@ -95,14 +130,10 @@ func (r *StateRepository) ConnectionsByInterfaceID(ctx context.Context, id strin
 
 	res := []*structs.Connection{}
 
-	prefix := resourcePrefix(resourceTypeConnection)
-	for el := range r.kv.Iter() {
-		if strings.HasPrefix(el.Key, prefix) {
-			if conn, ok := el.Value.(*structs.Connection); ok {
-				if conn.ConnectsInterface(id) {
-					res = append(res, conn)
-				}
-			}
+	for _, connID := range r.connIndex.lookup(id) {
+		key := resourceKey(resourceTypeConnection, connID)
+		if v, found := r.kv.Get(key); found {
+			res = append(res, v.(*structs.Connection))
 		}
 	}
 
@@ -111,16 +142,145 @@ func (r *StateRepository) ConnectionsByInterfaceID(ctx context.Context, id strin
 
 // UpsertConnection :
 func (r *StateRepository) UpsertConnection(ctx context.Context, n *structs.Connection) error {
+	r.connIndex.Lock()
+	defer r.connIndex.Unlock()
+
 	key := resourceKey(resourceTypeConnection, n.ID)
 	r.kv.Set(key, n)
+	r.connIndex.upsert(n)
+	return nil
+}
+
+// UpdateConnection ...
+func (r *StateRepository) UpdateConnection(ctx context.Context, id string, fn func(*structs.Connection) (bool, error)) error {
+	r.connIndex.Lock()
+	defer r.connIndex.Unlock()
+
+	key := resourceKey(resourceTypeConnection, id)
+	v, found := r.kv.Get(key)
+	if !found {
+		return structs.ErrNotFound
+	}
+
+	// Readers may still hold the stored connection, so a copy is updated
+	c := v.(*structs.Connection).Clone()
+	changed, err := fn(c)
+	if err != nil || !changed {
+		return err
+	}
+
+	r.kv.Set(key, c)
+	r.connIndex.upsert(c)
 	return nil
 }
 
 // DeleteConnections ...
 func (r *StateRepository) DeleteConnections(ctx context.Context, ids []string) error {
+	r.connIndex.Lock()
+	defer r.connIndex.Unlock()
+
+	// IDs of connections deleted longer ago than the retention are forgotten
+	prefix := resourcePrefix(resourceTypeDeletedConnection)
+	for el := range r.kv.Iter() {
+		if at, ok := el.Value.(time.Time); ok && strings.HasPrefix(el.Key, prefix) && time.Since(at) >= state.DeletedConnectionRetention {
+			r.kv.Delete(el.Key)
+		}
+	}
+
 	for _, id := range ids {
 		key := resourceKey(resourceTypeConnection, id)
+		if _, found := r.kv.Get(key); found {
+			r.kv.Set(resourceKey(resourceTypeDeletedConnection, id), time.Now())
+		}
 		r.kv.Delete(key)
+		r.connIndex.remove(id)
 	}
 	return nil
 }
+
+// connectionIndex maps interface IDs and idempotency keys to the IDs of the
+// connections referencing them, so that looking them up does not require
+// scanning all connections. Writers must hold the lock while updating both
+// the index and the underlying map, so that the two are always consistent.
+type connectionIndex struct {
+	sync.RWMutex
+	byInterface  map[string]map[string]struct{}
+	byConnection map[string][]string
+	byKey        map[string]string
+	keys         map[string]string
+}
+
+func newConnectionIndex() *connectionIndex {
+	return &connectionIndex{
+		byInterface:  map[string]map[string]struct{}{},
+		byConnection: map[string][]string{},
+		byKey:        map[string]string{},
+		keys:         map[string]string{},
+	}
+}
+
+// upsert indexes a connection under the interfaces it connects and its
+// idempotency key, removing it from the ones it was previously indexed
+// under. Must be called with the lock held.
+func (idx *connectionIndex) upsert(c *structs.Connection) {
+	connID, ifaceIDs := c.ID, c.ConnectedInterfaceIDs()
+	idx.remove(connID)
+	if c.IdempotencyKey != "" {
+		key := scopedIdempotencyKey(c.NetworkID, c.IdempotencyKey)
+		// A key reused by another connection is no longer indexed under the first one
+		if other, ok := idx.byKey[key]; ok && other != connID {
+			delete(idx.keys, other)
+		}
+		idx.byKey[key] = connID
+		idx.keys[connID] = key
+	}
+	for _, ifaceID := range ifaceIDs {
+		if _, ok := idx.byInterface[ifaceID]; !ok {
+			idx.byInterface[ifaceID] = map[string]struct{}{}
+		}
+		idx.byInterface[ifaceID][connID] = struct{}{}
+	}
+	idx.byConnection[connID] = ifaceIDs
+}
+
+// remove drops a connection from the index. Must be called with the lock held.
+func (idx *connectionIndex) remove(connID string) {
+	for _, ifaceID := range idx.byConnection[connID] {
+		delete(idx.byInterface[ifaceID], connID)
+		if len(idx.byInterface[ifaceID]) == 0 {
+			delete(idx.byInterface, ifaceID)
+		}
+	}
+	delete(idx.byConnection, connID)
+	if key, ok := idx.keys[connID]; ok {
+		delete(idx.byKey, key)
+		delete(idx.keys, connID)
+	}
+}
+
+// lookup returns the IDs of the connections referencing an interface.
+func (idx *connectionIndex) lookup(ifaceID string) []string {
+	idx.RLock()
+	defer idx.RUnlock()
+
+	res := make([]string, 0, len(idx.byInterface[ifaceID]))
+	for connID := range idx.byInterface[ifaceID] {
+		res = append(res, connID)
+	}
+	return res
+}
+
+// scopedIdempotencyKey returns the key under which an idempotency key
+// is indexed, since keys are only unique within a network.
+func scopedIdempotencyKey(networkID, key string) string {
+	return networkID + "/" + key
+}
+
+// lookupKey returns the ID of the connection with a scoped idempotency key.
+func (idx *connectionIndex) lookupKey(key string) (string, bool) {
+	idx.RLock()
+	defer idx.RUnlock()
+
+	id, ok := idx.byKey[key]
+	return id, ok
+}
@@ -0,0 +1,252 @@
+package inmem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	state "github.com/seashell/drago/drago/state"
+	structs "github.com/seashell/drago/drago/structs"
+)
+
+func newTestConnection(id, a, b string) *structs.Connection {
+	return &structs.Connection{
+		ID:        id,
+		NetworkID: "network-1",
+		PeerSettings: []*structs.PeerSettings{
+			{InterfaceID: a, NodeID: "node-" + a},
+			{InterfaceID: b, NodeID: "node-" + b},
+		},
+	}
+}
+
+func connectionIDsByInterface(t *testing.T, r *StateRepository, ifaceID string) []string {
+	conns, err := r.ConnectionsByInterfaceID(context.TODO(), ifaceID)
+	if err != nil {
+		t.Fatalf("r.ConnectionsByInterfaceID() failed, unexpected error: %v", err)
+	}
+	ids := []string{}
+	for _, c := range conns {
+		ids = append(ids, c.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestConnectionIndex(t *testing.T) {
+
+	ctx := context.TODO()
+	r := NewStateRepository(nil)
+
+	r.UpsertConnection(ctx, newTestConnection("conn-1", "iface-a", "iface-b"))
+	r.UpsertConnection(ctx, newTestConnection("conn-2", "iface-a", "iface-c"))
+	r.UpsertConnection(ctx, newTestConnection("conn-3", "iface-b", "iface-c"))
+
+	if ids := connectionIDsByInterface(t, r, "iface-a"); fmt.Sprint(ids) != "[conn-1 conn-2]" {
+		t.Fatalf("r.ConnectionsByInterfaceID() failed, expected %v, have %v", "[conn-1 conn-2]", ids)
+	}
+
+	// Reassign one of the interfaces, mutating the stored struct in place
+	c, _ := r.ConnectionByID(ctx, "conn-2")
+	c.PeerSettings[0].InterfaceID = "iface-d"
+	r.UpsertConnection(ctx, c)
+
+	if ids := connectionIDsByInterface(t, r, "iface-a"); fmt.Sprint(ids) != "[conn-1]" {
+		t.Fatalf("r.ConnectionsByInterfaceID() failed, expected %v, have %v", "[conn-1]", ids)
+	}
+	if ids := connectionIDsByInterface(t, r, "iface-d"); fmt.Sprint(ids) != "[conn-2]" {
+		t.Fatalf("r.ConnectionsByInterfaceID() failed, expected %v, have %v", "[conn-2]", ids)
+	}
+	if _, err := r.ConnectionByInterfaceIDs(ctx, "iface-c", "iface-d"); err != nil {
+		t.Fatalf("r.ConnectionByInterfaceIDs() failed, unexpected error: %v", err)
+	}
+	if _, err := r.ConnectionByInterfaceIDs(ctx, "iface-a", "iface-c"); err == nil {
+		t.Fatalf("r.ConnectionByInterfaceIDs() failed, expected stale pair not to be found")
+	}
+
+	// Delete
+	r.DeleteConnections(ctx, []string{"conn-1", "conn-3"})
+
+	if ids := connectionIDsByInterface(t, r, "iface-b"); len(ids) != 0 {
+		t.Fatalf("r.ConnectionsByInterfaceID() failed, expected no connections, have %v", ids)
+	}
+	if ids := connectionIDsByInterface(t, r, "iface-c"); fmt.Sprint(ids) != "[conn-2]" {
+		t.Fatalf("r.ConnectionsByInterfaceID() failed, expected %v, have %v", "[conn-2]", ids)
+	}
+}
+
+func TestConnectionIndexConcurrentWrites(t *testing.T) {
+
+	ctx := context.TODO()
+	r := NewStateRepository(nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("conn-%d", i)
+			r.UpsertConnection(ctx, newTestConnection(id, "iface-hub", fmt.Sprintf("iface-%d", i)))
+			if i%2 == 0 {
+				r.DeleteConnections(ctx, []string{id})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if ids := connectionIDsByInterface(t, r, "iface-hub"); len(ids) != 25 {
+		t.Fatalf("r.ConnectionsByInterfaceID() failed, expected %d connections, have %d", 25, len(ids))
+	}
+	all, _ := r.Connections(ctx)
+	if len(all) != 25 {
+		t.Fatalf("r.Connections() failed, expected %d connections, have %d", 25, len(all))
+	}
+}
+
+func TestConnectionByIdempotencyKey(t *testing.T) {
+
+	ctx := context.TODO()
+	r := NewStateRepository(nil)
+
+	c := newTestConnection("conn-1", "iface-a", "iface-b")
+	c.IdempotencyKey = "request-1"
+	r.UpsertConnection(ctx, c)
+	r.UpsertConnection(ctx, newTestConnection("conn-2", "iface-a", "iface-c"))
+
+	if res, err := r.ConnectionByIdempotencyKey(ctx, "network-1", "request-1"); err != nil || res.ID != "conn-1" {
+		t.Fatalf("r.ConnectionByIdempotencyKey() failed, expected %s, have %v (%v)", "conn-1", res, err)
+	}
+	if _, err := r.ConnectionByIdempotencyKey(ctx, "network-1", ""); err == nil {
+		t.Fatalf("r.ConnectionByIdempotencyKey() failed, expected error for empty key")
+	}
+
+	r.DeleteConnections(ctx, []string{"conn-1"})
+	if _, err := r.ConnectionByIdempotencyKey(ctx, "network-1", "request-1"); err == nil {
+		t.Fatalf("r.ConnectionByIdempotencyKey() failed, expected error for deleted connection")
+	}
+
+	// Deleting a connection doesn't drop a key since reused by another one
+	c = newTestConnection("conn-3", "iface-d", "iface-e")
+	c.IdempotencyKey = "request-2"
+	r.UpsertConnection(ctx, c)
+	c = newTestConnection("conn-4", "iface-d", "iface-f")
+	c.IdempotencyKey = "request-2"
+	r.UpsertConnection(ctx, c)
+
+	r.DeleteConnections(ctx, []string{"conn-3"})
+	if res, err := r.ConnectionByIdempotencyKey(ctx, "network-1", "request-2"); err != nil || res.ID != "conn-4" {
+		t.Fatalf("r.ConnectionByIdempotencyKey() failed, expected %s, have %v (%v)", "conn-4", res, err)
+	}
+
+	// Keys are scoped by network
+	c = newTestConnection("conn-5", "iface-g", "iface-h")
+	c.NetworkID, c.IdempotencyKey = "network-2", "request-2"
+	r.UpsertConnection(ctx, c)
+	if res, err := r.ConnectionByIdempotencyKey(ctx, "network-2", "request-2"); err != nil || res.ID != "conn-5" {
+		t.Fatalf("r.ConnectionByIdempotencyKey() failed, expected %s, have %v (%v)", "conn-5", res, err)
+	}
+	if res, err := r.ConnectionByIdempotencyKey(ctx, "network-1", "request-2"); err != nil || res.ID != "conn-4" {
+		t.Fatalf("r.ConnectionByIdempotencyKey() failed, expected %s, have %v (%v)", "conn-4", res, err)
+	}
+}
+
+func TestIterateConnections(t *testing.T) {
+
+	ctx := context.TODO()
+	r := NewStateRepository(nil)
+
+	for i := 0; i < 10; i++ {
+		r.UpsertConnection(ctx, newTestConnection(fmt.Sprintf("conn-%d", i), fmt.Sprintf("iface-%d", i), "iface-hub"))
+	}
+
+	seen := map[string]struct{}{}
+	err := r.IterateConnections(ctx, func(c *structs.Connection) error {
+		seen[c.ID] = struct{}{}
+		return nil
+	})
+	if err != nil || len(seen) != 10 {
+		t.Fatalf("r.IterateConnections() failed, expected %d connections, have %d (%v)", 10, len(seen), err)
+	}
+
+	// Errors returned by the callback stop the iteration
+	count := 0
+	errStop := errors.New("stop")
+	err = r.IterateConnections(ctx, func(c *structs.Connection) error {
+		if count++; count == 3 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || count != 3 {
+		t.Fatalf("r.IterateConnections() failed, expected to stop after %d connections, have %d (%v)", 3, count, err)
+	}
+}
+
+func TestConnectionByIDDeleted(t *testing.T) {
+
+	ctx := context.TODO()
+	r := NewStateRepository(nil)
+
+	r.UpsertConnection(ctx, newTestConnection("conn-1", "iface-a", "iface-b"))
+	r.DeleteConnections(ctx, []string{"conn-1", "conn-2"})
+
+	if _, err := r.ConnectionByID(ctx, "conn-1"); err != structs.ErrDeleted {
+		t.Fatalf("r.ConnectionByID() failed, expected %v, have %v", structs.ErrDeleted, err)
+	}
+
+	// Connections which never existed are not remembered as deleted
+	if _, err := r.ConnectionByID(ctx, "conn-2"); err != structs.ErrNotFound {
+		t.Fatalf("r.ConnectionByID() failed, expected %v, have %v", structs.ErrNotFound, err)
+	}
+
+	// Deleted IDs are forgotten after the retention, and pruned on later deletes
+	key := resourceKey(resourceTypeDeletedConnection, "conn-1")
+	r.kv.Set(key, time.Now().Add(-state.DeletedConnectionRetention))
+	if _, err := r.ConnectionByID(ctx, "conn-1"); err != structs.ErrNotFound {
+		t.Fatalf("r.ConnectionByID() failed, expected %v, have %v", structs.ErrNotFound, err)
+	}
+	r.DeleteConnections(ctx, []string{"conn-3"})
+	if _, found := r.kv.Get(key); found {
+		t.Fatalf("r.DeleteConnections() failed, expired deleted ID was not pruned")
+	}
+}
+
+func TestUpdateConnection(t *testing.T) {
+
+	ctx := context.TODO()
+	r := NewStateRepository(nil)
+
+	r.UpsertConnection(ctx, newTestConnection("conn-1", "iface-a", "iface-b"))
+	old, _ := r.ConnectionByID(ctx, "conn-1")
+
+	err := r.UpdateConnection(ctx, "conn-1", func(c *structs.Connection) (bool, error) {
+		c.Transport = structs.TransportObfuscated
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("r.UpdateConnection() failed, unexpected error: %v", err)
+	}
+	if c, _ := r.ConnectionByID(ctx, "conn-1"); c.Transport != structs.TransportObfuscated {
+		t.Fatalf("r.UpdateConnection() failed, expected transport %s, have %s", structs.TransportObfuscated, c.Transport)
+	}
+	if old.Transport == structs.TransportObfuscated {
+		t.Fatalf("r.UpdateConnection() failed, connection previously read was modified")
+	}
+
+	// Unchanged connections are not written
+	err = r.UpdateConnection(ctx, "conn-1", func(c *structs.Connection) (bool, error) {
+		c.Transport = structs.TransportWireGuardOverTCP
+		return false, nil
+	})
+	if c, _ := r.ConnectionByID(ctx, "conn-1"); err != nil || c.Transport != structs.TransportObfuscated {
+		t.Fatalf("r.UpdateConnection() failed, expected transport %s, have %s (%v)", structs.TransportObfuscated, c.Transport, err)
+	}
+
+	if err := r.UpdateConnection(ctx, "conn-2", func(c *structs.Connection) (bool, error) { return true, nil }); err != structs.ErrNotFound {
+		t.Fatalf("r.UpdateConnection() failed, expected %v, have %v", structs.ErrNotFound, err)
+	}
+}
@@ -17,15 +17,17 @@ const (
 
 // StateRepository ...
 type StateRepository struct {
-	kv     *concurrent.Map
-	logger log.Logger
+	kv        *concurrent.Map
+	connIndex *connectionIndex
+	logger    log.Logger
 }
 
 // NewStateRepository ...
 func NewStateRepository(logger log.Logger) *StateRepository {
 	return &StateRepository{
-		kv:     concurrent.NewMap(),
-		logger: logger,
+		kv:        concurrent.NewMap(),
+		connIndex: newConnectionIndex(),
+		logger:    logger,
 	}
 }
 
@@ -62,6 +64,7 @@ func (b *StateRepository) Dump() <-chan string {
 // Clear ...
 func (b *StateRepository) Clear() {
 	b.kv = &concurrent.Map{}
+	b.connIndex = newConnectionIndex()
 }
 
 func resourcePrefix(resourceType string) string {
@@ -2,10 +2,17 @@ package state
 
 import (
 	"context"
+	"time"
 
 	"github.com/seashell/drago/drago/structs"
 )
 
+// DeletedConnectionRetention is how long repositories remember the IDs of
+// deleted connections, reporting them as structs.ErrDeleted instead of
+// structs.ErrNotFound, so that updates referencing them are rejected rather
+// than recreating them. After that, the IDs are forgotten.
+const DeletedConnectionRetention = 24 * time.Hour
+
 // Transaction :
 type Transaction interface {
 	Commit() (interface{}, error)
@@ -29,6 +36,17 @@ type Repository interface {
 	ACLSetState(ctx context.Context, state *structs.ACLState) error
 }
 
+// ConnectionWatcher : implemented by repositories which may be written by
+// other processes, so that changes made elsewhere can be observed.
+type ConnectionWatcher interface {
+	// WatchConnections returns a channel on which the IDs of connections
+	// are sent whenever they are written or deleted, by any process, until
+	// the context is done. An empty ID means that changes may have been
+	// missed, so that any connection may have changed. The channel is
+	// closed once changes can no longer be watched.
+	WatchConnections(ctx context.Context) <-chan string
+}
+
 // ACLTokenRepository : ACLToken repository interface
 type ACLTokenRepository interface {
 	ACLTokens(ctx context.Context) ([]*structs.ACLToken, error)
@@ -77,11 +95,16 @@ type InterfaceRepository interface {
 // ConnectionRepository : Connection repository interface
 type ConnectionRepository interface {
 	Connections(ctx context.Context) ([]*structs.Connection, error)
+	IterateConnections(ctx context.Context, fn func(*structs.Connection) error) error
 	ConnectionsByNetworkID(ctx context.Context, s string) ([]*structs.Connection, error)
 	ConnectionsByNodeID(ctx context.Context, s string) ([]*structs.Connection, error)
 	ConnectionsByInterfaceID(ctx context.Context, s string) ([]*structs.Connection, error)
 	ConnectionByInterfaceIDs(ctx context.Context, a, b string) (*structs.Connection, error)
 	ConnectionByID(ctx context.Context, id string) (*structs.Connection, error)
+	ConnectionByIdempotencyKey(ctx context.Context, networkID, key string) (*structs.Connection, error)
 	UpsertConnection(ctx context.Context, i *structs.Connection) error
+	// UpdateConnection applies fn to the stored connection, and writes it back
+	// only if fn reports a change and the connection wasn't modified meanwhile.
+	UpdateConnection(ctx context.Context, id string, fn func(*structs.Connection) (bool, error)) error
 	DeleteConnections(ctx context.Context, ids []string) error
 }
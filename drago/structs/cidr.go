@@ -0,0 +1,284 @@
+package structs
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// sortedCIDRs returns a sorted copy of a list of CIDRs. IPv4 prefixes come
+// before IPv6 ones, and prefixes within the same family are ordered by network
+// address and then by prefix length. Entries which can't be parsed are placed
+// at the end, in lexicographic order.
+func sortedCIDRs(cidrs []string) []string {
+
+	res := make([]string, len(cidrs))
+	copy(res, cidrs)
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return compareCIDRs(res[i], res[j]) < 0
+	})
+
+	return res
+}
+
+// compareCIDRs compares two CIDRs according to the ordering used by sortedCIDRs.
+func compareCIDRs(a, b string) int {
+
+	_, na, errA := net.ParseCIDR(a)
+	_, nb, errB := net.ParseCIDR(b)
+
+	switch {
+	case errA != nil && errB != nil:
+		return compareStrings(a, b)
+	case errA != nil:
+		return 1
+	case errB != nil:
+		return -1
+	}
+
+	ipa, ipb := normalizeIP(na.IP), normalizeIP(nb.IP)
+	if len(ipa) != len(ipb) {
+		return len(ipa) - len(ipb)
+	}
+	if c := bytes.Compare(ipa, ipb); c != 0 {
+		return c
+	}
+
+	onesA, _ := na.Mask.Size()
+	onesB, _ := nb.Mask.Size()
+	if onesA != onesB {
+		return onesA - onesB
+	}
+
+	return compareStrings(a, b)
+}
+
+// normalizeIP returns the 4-byte representation of IPv4 addresses,
+// and the 16-byte representation of IPv6 addresses.
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+func compareStrings(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// parseCIDRs parses a list of CIDRs, failing on the first invalid entry.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	res := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %s", s)
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// cidrsOverlap checks whether two networks share at least one address.
+func cidrsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// parseIPOrCIDR parses either an IP address, which is converted into a
+// single-address network, or a network in CIDR notation.
+func parseIPOrCIDR(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		ip = normalizeIP(ip)
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+	}
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n, nil
+	}
+	return nil, fmt.Errorf("invalid IP address or CIDR %s", s)
+}
+
+// cidrContains checks whether the outer network fully contains the inner one.
+func cidrContains(outer, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
+
+// SummarizeRoutes : returns the minimal set of CIDRs covering exactly the same
+// addresses as the ones passed as argument, by removing prefixes contained in
+// others, and by aggregating adjacent prefixes into their common supernet.
+func SummarizeRoutes(cidrs []string) ([]string, error) {
+
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+
+	for changed := true; changed; {
+		changed = false
+
+		sort.Slice(nets, func(i, j int) bool {
+			return compareNets(nets[i], nets[j]) < 0
+		})
+
+		// Remove prefixes contained in others. Since prefixes are sorted by
+		// address and then by length, a supernet always precedes its subnets.
+		res := []*net.IPNet{}
+		for _, n := range nets {
+			if len(res) > 0 && cidrContains(res[len(res)-1], n) {
+				continue
+			}
+			res = append(res, n)
+		}
+
+		// Aggregate sibling prefixes, i.e. halves of the same supernet
+		for i := 0; i < len(res)-1; i++ {
+			if sup := supernetOfSiblings(res[i], res[i+1]); sup != nil {
+				res[i] = sup
+				res = append(res[:i+1], res[i+2:]...)
+				changed = true
+			}
+		}
+
+		nets = res
+	}
+
+	res := []string{}
+	for _, n := range nets {
+		res = append(res, n.String())
+	}
+
+	return res, nil
+}
+
+// compareNets compares two networks by family, address, and prefix length.
+func compareNets(a, b *net.IPNet) int {
+	ipa, ipb := normalizeIP(a.IP), normalizeIP(b.IP)
+	if len(ipa) != len(ipb) {
+		return len(ipa) - len(ipb)
+	}
+	if c := bytes.Compare(ipa, ipb); c != 0 {
+		return c
+	}
+	onesA, _ := a.Mask.Size()
+	onesB, _ := b.Mask.Size()
+	return onesA - onesB
+}
+
+// supernetOfSiblings returns the network immediately containing both networks passed
+// as argument, if they are its two halves. Otherwise, returns nil.
+func supernetOfSiblings(a, b *net.IPNet) *net.IPNet {
+
+	onesA, bitsA := a.Mask.Size()
+	onesB, bitsB := b.Mask.Size()
+	if onesA != onesB || bitsA != bitsB || onesA == 0 || a.IP.Equal(b.IP) {
+		return nil
+	}
+
+	mask := net.CIDRMask(onesA-1, bitsA)
+	ipa, ipb := normalizeIP(a.IP).Mask(mask), normalizeIP(b.IP).Mask(mask)
+	if !ipa.Equal(ipb) {
+		return nil
+	}
+
+	return &net.IPNet{IP: ipa, Mask: mask}
+}
+
+// cidrAddressFamily returns the address family of a network.
+func cidrAddressFamily(n *net.IPNet) string {
+	if n.IP.To4() != nil {
+		return AddressFamilyIPv4
+	}
+	return AddressFamilyIPv6
+}
+
+// isIPv4MappedCIDR checks whether a network is written in the IPv4-mapped IPv6
+// form (e.g. ::ffff:10.0.0.1/128), which the standard library otherwise treats
+// inconsistently, formatting it as IPv4, but with an IPv6 mask.
+func isIPv4MappedCIDR(n *net.IPNet) bool {
+	return len(n.IP) == net.IPv6len && n.IP.To4() != nil
+}
+
+// normalizeCIDR returns the canonical form of a CIDR, i.e. with host bits
+// cleared. Entries which can't be parsed are returned unchanged.
+func normalizeCIDR(s string) string {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n.String()
+	}
+	return s
+}
+
+// normalizedCIDRSet returns the sorted and deduplicated
+// canonical forms of a list of CIDRs.
+func normalizedCIDRSet(cidrs []string) []string {
+	seen := map[string]struct{}{}
+	res := []string{}
+	for _, s := range cidrs {
+		n := normalizeCIDR(s)
+		if _, ok := seen[n]; !ok {
+			seen[n] = struct{}{}
+			res = append(res, n)
+		}
+	}
+	return sortedCIDRs(res)
+}
+
+// privateRanges contains the address ranges reserved for private networks.
+var privateRanges = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"fc00::/7",
+)
+
+// documentationRanges contains the address ranges reserved for use in
+// documentation and examples, which are never routed on the internet.
+var documentationRanges = mustParseCIDRs(
+	"192.0.2.0/24",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"2001:db8::/32",
+)
+
+// documentationRange returns the documentation range containing a network, if any.
+func documentationRange(n *net.IPNet) *net.IPNet {
+	for _, r := range documentationRanges {
+		if cidrContains(r, n) {
+			return r
+		}
+	}
+	return nil
+}
+
+// isPrivateCIDR checks whether a network is fully contained in private address space.
+func isPrivateCIDR(n *net.IPNet) bool {
+	for _, r := range privateRanges {
+		if cidrContains(r, n) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	res, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// isDefaultRoute checks whether a CIDR is the IPv4 or IPv6 default route.
+func isDefaultRoute(n *net.IPNet) bool {
+	ones, _ := n.Mask.Size()
+	return ones == 0
+}
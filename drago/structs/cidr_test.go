@@ -0,0 +1,40 @@
+package structs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSummarizeRoutes(t *testing.T) {
+
+	tests := []struct {
+		in       []string
+		expected []string
+	}{
+		// Adjacent halves are collapsed
+		{[]string{"10.0.0.128/25", "10.0.0.0/25"}, []string{"10.0.0.0/24"}},
+		// Collapsing happens recursively
+		{[]string{"10.0.0.0/25", "10.0.0.128/25", "10.0.1.0/24"}, []string{"10.0.0.0/23"}},
+		// Contained prefixes are removed
+		{[]string{"10.0.0.0/8", "10.1.2.0/24", "10.0.0.1/32"}, []string{"10.0.0.0/8"}},
+		// Disjoint prefixes are left alone
+		{[]string{"192.168.1.0/24", "10.0.0.0/24", "fd00::/64"}, []string{"10.0.0.0/24", "192.168.1.0/24", "fd00::/64"}},
+		// Adjacent but not siblings
+		{[]string{"10.0.1.0/24", "10.0.2.0/24"}, []string{"10.0.1.0/24", "10.0.2.0/24"}},
+		{[]string{}, []string{}},
+	}
+
+	for _, test := range tests {
+		res, err := SummarizeRoutes(test.in)
+		if err != nil {
+			t.Fatalf("SummarizeRoutes() failed, unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(res, test.expected) {
+			t.Fatalf("SummarizeRoutes() failed, expected %v, have %v", test.expected, res)
+		}
+	}
+
+	if _, err := SummarizeRoutes([]string{"10.0.0.0/24", "invalid"}); err == nil {
+		t.Fatalf("SummarizeRoutes() failed, expected error for invalid CIDR")
+	}
+}
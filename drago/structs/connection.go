@@ -1,57 +1,894 @@
 package structs
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/seashell/drago/pkg/jsonpatch"
 	"github.com/seashell/drago/pkg/uuid"
 )
 
 // Connection :
 type Connection struct {
-	ID        string
+	ID string
+
+	// NetworkID is the network the connection belongs to. It is authoritative
+	// for both peers, whose interfaces must belong to the same network.
 	NetworkID string
 
+	// SchemaVersion is the version of the format the connection was written
+	// in. Connections written before versioning was introduced have it unset,
+	// and are treated as version 1.
+	SchemaVersion int
+
 	// PeerSettings contains the ID and the configurations to be applied
 	// to each of the connected interfaces.
 	PeerSettings []*PeerSettings
 
+	// Enabled indicates whether the connection is to be configured by the
+	// agents. Disabled connections are kept, but not applied. If nil, the
+	// connection is enabled.
+	Enabled *bool
+
 	// If the connection is going from a NAT-ed peer to a public peer,
 	// the node behind the NAT must regularly send an outgoing ping to
 	// keep the bidirectional connection alive in the NAT router's
 	// connection table.
 	PersistentKeepalive *int
 
+	// MTU is the maximum transmission unit configured for the link.
+	// If nil, the MTU of the interfaces is used.
+	MTU *int
+
+	// MTUProbeInterval is the interval, in seconds, at which the agents
+	// probe the path MTU of the link, reporting it as the discovered MTU.
+	// If nil, the path MTU is not probed.
+	MTUProbeInterval *int
+
+	// RekeyInterval is the interval, in seconds, after which the peers
+	// perform a new handshake, rotating the session keys. If nil, the
+	// WireGuard default of two minutes is used.
+	RekeyInterval *int
+
+	// Table is the routing table into which the routes of the connection
+	// are added, or ConnectionTableOff for not adding routes at all.
+	// If nil, the default table is used.
+	Table *int
+
+	// FwMark is the firewall mark applied to the packets sent through the
+	// connection, for use in policy routing. If nil, packets are not marked.
+	FwMark *int
+
+	// Transport is the transport over which the agents establish the
+	// connection. If empty, plain WireGuard over UDP is used.
+	Transport string
+
+	// DSCP is the Differentiated Services Code Point with which the
+	// agents mark the traffic of the connection, if any.
+	DSCP *int
+
+	// Priority is the failover priority of the connection among parallel
+	// connections between the same nodes, with lower values preferred.
+	// If nil, the connection is not part of a failover setup.
+	Priority *int
+
+	// RateLimitKbps caps the bandwidth of the connection, in kbps.
+	// If nil, the bandwidth is not limited.
+	RateLimitKbps *int
+
+	// Alerting contains the thresholds used by alerting rules for
+	// the connection. If nil, the connection is not monitored.
+	Alerting *AlertConfig
+
+	// LogLevel is the verbosity with which the agents log events of the
+	// connection, for debugging it without increasing the global verbosity.
+	// If nil, the agents' log level is used.
+	LogLevel *string
+
+	// CipherSuite is the cipher suite preferred by the obfuscated transport,
+	// such as for restricting it to FIPS-approved ciphers. WireGuard's own
+	// cryptography is fixed. If nil, the transport negotiates it freely.
+	CipherSuite *string
+
+	// PresharedKeyRef references the secret containing the
+	// preshared key to be used by both peers, if any.
+	PresharedKeyRef *string
+
+	// Description is a free-form, human-readable description of the connection.
+	Description string
+
+	// Labels are used by agents for mapping connections to firewall rules.
+	// They may contain only lowercase alphanumeric characters and dashes.
+	Labels []string
+
+	// GroupID identifies the group of related connections the connection
+	// belongs to, such as all the links of a site-to-site tunnel, so that
+	// they can be listed and removed as a unit.
+	GroupID *string
+
+	// Tags contain arbitrary metadata about the connection, which is not
+	// interpreted by Drago, such as its owner or purpose.
+	Tags map[string]string
+
+	// ActiveUntil is the end of the window during which the connection is
+	// active, after which agents no longer establish it, even if enabled.
+	// If nil, the connection is active for as long as it is enabled.
+	ActiveUntil *time.Time
+
+	// ExpireAt is the time after which the connection is no longer
+	// needed, and can be automatically removed. If nil, it never expires.
+	ExpireAt *time.Time
+
+	// IdempotencyKey is the key of the upsert request which created the
+	// connection, so that retries of that request update it instead of
+	// creating duplicates.
+	IdempotencyKey string
+
+	// History contains the most recent changes applied to the connection,
+	// in chronological order, and is capped to maxConnectionHistory entries.
+	// It is only written through RecordChange, and ignored by Merge.
+	History []*ChangeEntry
+
+	// DiscoveredMTU is the path MTU last reported by the agents, which may
+	// differ from MTU. It is only written through agent reports.
+	DiscoveredMTU *int
+
+	// ThroughputSamples contain the traffic counters most recently reported
+	// by the agents, in chronological order, and are capped to
+	// maxThroughputSamples entries per reporting node. They are only
+	// written through RecordSample, and ignored by Merge.
+	ThroughputSamples []Sample
+
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
 
+// ChangeEntry : describes a change applied to a connection.
+type ChangeEntry struct {
+	At      time.Time
+	By      string
+	Summary string
+}
+
+// Sample : contains the traffic counters of a connection at a point in time.
+type Sample struct {
+	At time.Time
+
+	// NodeID is the node which reported the sample. Both peers report
+	// their own counters, so the bytes received by one of them are the
+	// bytes transmitted by the other.
+	NodeID string
+
+	// RxBytes and TxBytes are cumulative since the
+	// peer was configured on the reporting node.
+	RxBytes uint64
+	TxBytes uint64
+}
+
+// ConnectionSchemaVersion is the version of the format
+// in which connections are currently written.
+const ConnectionSchemaVersion = 2
+
+const maxConnectionHistory = 32
+
+const maxThroughputSamples = 60
+
+const maxLabelLength = 63
+
+// maxDescriptionLength is the maximum length of a
+// connection description, in characters.
+const maxDescriptionLength = 256
+
+// Limits on the tags of a connection, so that they can't
+// be used for bloating the store and every list response.
+const (
+	maxTags           = 32
+	maxTagKeyLength   = 63
+	maxTagValueLength = 255
+)
+
+// Bounds of the MTU which can be configured for a connection.
+const (
+	minMTU = 576
+	maxMTU = 65535
+)
+
+// Bounds of the rekey interval which can be configured for a connection.
+// WireGuard retries handshakes every 5 seconds, and rejects sessions older
+// than 180 seconds, so keys can't be rotated any less often than the default.
+const (
+	minRekeyInterval = 10
+	maxRekeyInterval = 120
+)
+
+// Transports over which a connection can be established.
+const (
+	TransportWireGuard        = "wireguard"
+	TransportWireGuardOverTCP = "wireguard-over-tcp"
+	TransportObfuscated       = "obfs"
+)
+
+var connectionTransports = map[string]struct{}{
+	TransportWireGuard:        {},
+	TransportWireGuardOverTCP: {},
+	TransportObfuscated:       {},
+}
+
+// Cipher suites which can be preferred by the obfuscated transport.
+const (
+	CipherSuiteAES128GCM        = "aes-128-gcm"
+	CipherSuiteAES256GCM        = "aes-256-gcm"
+	CipherSuiteChaCha20Poly1305 = "chacha20-poly1305"
+)
+
+var cipherSuites = map[string]struct{}{
+	CipherSuiteAES128GCM:        {},
+	CipherSuiteAES256GCM:        {},
+	CipherSuiteChaCha20Poly1305: {},
+}
+
+// Log levels which can be set for a connection.
+const (
+	ConnectionLogLevelOff   = "off"
+	ConnectionLogLevelInfo  = "info"
+	ConnectionLogLevelDebug = "debug"
+	ConnectionLogLevelTrace = "trace"
+)
+
+var connectionLogLevels = map[string]struct{}{
+	ConnectionLogLevelOff:   {},
+	ConnectionLogLevelInfo:  {},
+	ConnectionLogLevelDebug: {},
+	ConnectionLogLevelTrace: {},
+}
+
+// ConnectionTableOff disables adding the routes of a connection to any
+// routing table, as with WireGuard's Table = off.
+const ConnectionTableOff = -1
+
+const maxTableID int64 = 1<<32 - 1
+
+const maxFwMark int64 = 1<<32 - 1
+
 func NewConnection() *Connection {
 
 	c := &Connection{}
 
 	c.ID = uuid.Generate()
+	c.SchemaVersion = ConnectionSchemaVersion
 	c.CreatedAt = time.Now()
 
 	return c
 }
 
+// Migrate : upgrades a connection written in an older schema version to the
+// current one. Connections written in a newer version can't be understood,
+// and therefore result in an error.
+func (c *Connection) Migrate(fromVersion int) error {
+
+	if fromVersion < 1 {
+		fromVersion = 1
+	}
+	if fromVersion > ConnectionSchemaVersion {
+		return fmt.Errorf("unsupported connection schema version %d: the latest supported version is %d", fromVersion, ConnectionSchemaVersion)
+	}
+
+	// Version 1 allowed peers without routing rules, and stored
+	// AllowedIPs as entered, rather than in their canonical form.
+	if fromVersion < 2 {
+		for _, peer := range c.PeerSettings {
+			if peer.RoutingRules == nil {
+				peer.RoutingRules = &RoutingRules{AllowedIPs: []string{}}
+			}
+			routes := []string{}
+			for _, route := range peer.RoutingRules.AllowedIPs {
+				routes = append(routes, normalizeCIDR(route))
+			}
+			peer.RoutingRules.AllowedIPs = unionStrings(routes)
+		}
+	}
+
+	c.SchemaVersion = ConnectionSchemaVersion
+
+	return nil
+}
+
+// NewConnectionBetween : returns a new connection between two interfaces,
+// with its peer settings initialized and already validated.
+func NewConnectionBetween(networkID, ifaceA, nodeA, ifaceB, nodeB string) (*Connection, error) {
+
+	c := NewConnection()
+	c.NetworkID = networkID
+	c.PeerSettings = []*PeerSettings{
+		{InterfaceID: ifaceA, NodeID: nodeA},
+		{InterfaceID: ifaceB, NodeID: nodeB},
+	}
+
+	if err := c.InitializePeerSettings(); err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// ConnectionValidationOptions : enables optional checks performed when
+// validating a connection, which are disabled by default.
+type ConnectionValidationOptions struct {
+	// RequireRoutableEndpoints rejects peer endpoints pointing
+	// to loopback or unspecified addresses.
+	RequireRoutableEndpoints bool
+
+	// RequireKeepaliveBehindNAT rejects connections in which a peer
+	// behind a NAT does not have a persistent keepalive enabled.
+	RequireKeepaliveBehindNAT bool
+
+	// StrictMesh enforces the invariants of full-mesh topologies, rejecting
+	// connections between two interfaces of the same node, and connections
+	// whose peers advertise different numbers of routes.
+	StrictMesh bool
+
+	// RejectOverlappingPeerRoutes rejects connections in which the AllowedIPs
+	// of one peer overlap those of the other, except for a default route set
+	// on both. It is not enforced by default, since connections are created
+	// with the address range of the network allowed in both directions.
+	RejectOverlappingPeerRoutes bool
+
+	// RejectDocumentationRanges rejects AllowedIPs within the address
+	// ranges reserved for documentation, which are usually copied
+	// verbatim from examples.
+	RejectDocumentationRanges bool
+
+	// RequireDistinctNodes requires the peers to be owned by different nodes,
+	// without the route symmetry also enforced by StrictMesh, so that a node
+	// never tunnels traffic to itself, such as after an interface is moved.
+	RequireDistinctNodes bool
+
+	// RequireCanonicalCIDRs rejects AllowedIPs which are not in canonical
+	// form, such as ones with host bits set, instead of accepting them and
+	// normalizing them later, so that stored connections are always canonical.
+	RequireCanonicalCIDRs bool
+
+	// RejectKeepaliveOnLAN rejects persistent keepalives on connections
+	// whose peers share a LAN, where they are pure overhead.
+	RejectKeepaliveOnLAN bool
+
+	// MinKeepalive rejects persistent keepalives, in seconds, shorter than
+	// the floor, such as DefaultMinKeepalive, which would flood the network
+	// with pointless traffic. Disabled keepalives are always accepted, and
+	// zero means no floor.
+	MinKeepalive int
+}
+
+// DefaultMinKeepalive is the suggested floor for
+// the persistent keepalive of connections, in seconds.
+const DefaultMinKeepalive = 5
+
 // Validate :
 func (c *Connection) Validate() error {
+	return c.ValidateWithOptions(&ConnectionValidationOptions{})
+}
+
+// ValidateWithOptions : validates the connection, performing
+// the optional checks enabled in the options passed as argument.
+// Disabled connections are validated the same way as enabled ones,
+// so that re-enabling them never results in an invalid configuration.
+func (c *Connection) ValidateWithOptions(opts *ConnectionValidationOptions) error {
+	if errs := c.validationErrors(opts); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// ValidateAll : same as Validate, but returning all the validation errors,
+// instead of only the first one. Only a wrong number of peers prevents
+// further checks, since none of them can be performed without both peers.
+func (c *Connection) ValidateAll() []error {
+	return c.validationErrors(&ConnectionValidationOptions{})
+}
+
+func (c *Connection) validationErrors(opts *ConnectionValidationOptions) []error {
 
 	connectedInterfaceIDs := c.ConnectedInterfaceIDs()
 
 	if len(connectedInterfaceIDs) != 2 {
-		return errors.New("a connection must specify exactly two interfaces")
+		return []error{errors.New("a connection must specify exactly two interfaces")}
+	}
+
+	errs := []error{}
+	for i, peer := range c.PeerSettings {
+		if peer.InterfaceID == "" {
+			errs = append(errs, fmt.Errorf("peer %d is missing an interface ID", i))
+		}
+		if peer.NodeID == "" {
+			errs = append(errs, fmt.Errorf("peer %d (interface %s) is missing a node ID", i, peer.InterfaceID))
+		}
+		if err := validateIdentifier("interface ID", peer.InterfaceID); err != nil {
+			errs = append(errs, err)
+		}
+		if err := validateIdentifier("node ID", peer.NodeID); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := validateIdentifier("connection ID", c.ID); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateIdentifier("network ID", c.NetworkID); err != nil {
+		errs = append(errs, err)
+	}
+	if a, b := c.PeerSettings[0], c.PeerSettings[1]; a.InterfaceID == b.InterfaceID && a.NodeID != b.NodeID {
+		// An interface belongs to a single node, so this can only result from corrupt data
+		errs = append(errs, fmt.Errorf("interface %s is referenced by both nodes %s and %s", a.InterfaceID, a.NodeID, b.NodeID))
+	} else if connectedInterfaceIDs[0] == connectedInterfaceIDs[1] {
+		errs = append(errs, errors.New("can't connect an interface to itself"))
+	}
+
+	if c.PeerSettings[0].IsServer() && c.PeerSettings[1].IsServer() {
+		errs = append(errs, errors.New("at most one peer can have the server role"))
+	}
+	if (opts.StrictMesh || opts.RequireDistinctNodes) && !c.HasDistinctNodes() {
+		errs = append(errs, fmt.Errorf("cannot connect a node to itself: both interfaces belong to node %s", c.PeerSettings[0].NodeID))
+	}
+	if opts.StrictMesh {
+		if na, nb := len(peerRoutes(c.PeerSettings[0])), len(peerRoutes(c.PeerSettings[1])); na != nb {
+			errs = append(errs, fmt.Errorf("asymmetric routes: interface %s advertises %d, interface %s advertises %d",
+				c.PeerSettings[0].InterfaceID, na, c.PeerSettings[1].InterfaceID, nb))
+		}
+	}
+
+	// A peer-level keepalive takes precedence over the connection-level one,
+	// but only as a way of specializing it for a single peer. Setting both
+	// to different values is ambiguous, and therefore rejected.
+	if c.PersistentKeepalive != nil {
+		for _, peer := range c.PeerSettings {
+			if peer.PersistentKeepalive != nil && *peer.PersistentKeepalive != *c.PersistentKeepalive {
+				errs = append(errs, fmt.Errorf("conflicting persistent keepalive for interface %s: connection sets %d, peer sets %d",
+					peer.InterfaceID, *c.PersistentKeepalive, *peer.PersistentKeepalive))
+			}
+		}
+	}
+
+	if n := utf8.RuneCountInString(c.Description); n > maxDescriptionLength {
+		errs = append(errs, fmt.Errorf("description too long: must contain at most %d characters, has %d", maxDescriptionLength, n))
+	}
+
+	for _, l := range c.Labels {
+		if len(l) > maxLabelLength || !labelRegexp.MatchString(l) {
+			errs = append(errs, fmt.Errorf("invalid label %s: must contain at most %d lowercase alphanumeric characters or dashes", l, maxLabelLength))
+		}
+	}
+
+	if len(c.Tags) > maxTags {
+		errs = append(errs, fmt.Errorf("too many tags: a connection can have at most %d, has %d", maxTags, len(c.Tags)))
+	}
+	for k, v := range c.Tags {
+		if k == "" || len(k) > maxTagKeyLength {
+			errs = append(errs, fmt.Errorf("invalid tag key %q: must contain between 1 and %d characters", k, maxTagKeyLength))
+		}
+		if len(v) > maxTagValueLength {
+			errs = append(errs, fmt.Errorf("invalid value for tag %s: must contain at most %d characters", k, maxTagValueLength))
+		}
+	}
+
+	if c.PersistentKeepalive != nil {
+		if err := validateKeepalive(*c.PersistentKeepalive); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if c.MTU != nil && (*c.MTU < minMTU || *c.MTU > maxMTU) {
+		errs = append(errs, fmt.Errorf("invalid MTU %d: must be between %d and %d", *c.MTU, minMTU, maxMTU))
+	}
+
+	if c.MTUProbeInterval != nil && *c.MTUProbeInterval <= 0 {
+		errs = append(errs, fmt.Errorf("invalid MTU probe interval %d: must be positive", *c.MTUProbeInterval))
+	}
+
+	if c.RekeyInterval != nil && (*c.RekeyInterval < minRekeyInterval || *c.RekeyInterval > maxRekeyInterval) {
+		errs = append(errs, fmt.Errorf("invalid rekey interval %d: must be between %d and %d seconds", *c.RekeyInterval, minRekeyInterval, maxRekeyInterval))
+	}
+
+	if c.Table != nil && *c.Table != ConnectionTableOff && (*c.Table < 1 || int64(*c.Table) > maxTableID) {
+		errs = append(errs, fmt.Errorf("invalid routing table %d: must be between 1 and %d, or %d for off", *c.Table, int64(maxTableID), ConnectionTableOff))
+	}
+
+	if c.FwMark != nil && (*c.FwMark < 0 || int64(*c.FwMark) > maxFwMark) {
+		errs = append(errs, fmt.Errorf("invalid firewall mark %d: must be between 0 and %d", *c.FwMark, int64(maxFwMark)))
+	}
+
+	if c.Transport != "" {
+		if _, ok := connectionTransports[c.Transport]; !ok {
+			errs = append(errs, fmt.Errorf("invalid transport %s: must be one of %s", c.Transport, strings.Join(sortedKeys(connectionTransports), ", ")))
+		}
+	}
+
+	if c.DSCP != nil && (*c.DSCP < 0 || *c.DSCP > 63) {
+		errs = append(errs, fmt.Errorf("invalid DSCP %d: must be between 0 and 63", *c.DSCP))
+	}
+
+	if c.Priority != nil && *c.Priority < 0 {
+		errs = append(errs, fmt.Errorf("invalid priority %d: must not be negative", *c.Priority))
+	}
+
+	if c.RateLimitKbps != nil && *c.RateLimitKbps <= 0 {
+		errs = append(errs, fmt.Errorf("invalid rate limit %d: must be positive", *c.RateLimitKbps))
+	}
+
+	if c.LogLevel != nil {
+		if _, ok := connectionLogLevels[*c.LogLevel]; !ok {
+			errs = append(errs, fmt.Errorf("invalid log level %s: must be one of %s", *c.LogLevel, strings.Join(sortedKeys(connectionLogLevels), ", ")))
+		}
+	}
+
+	if c.CipherSuite != nil {
+		if _, ok := cipherSuites[*c.CipherSuite]; !ok {
+			errs = append(errs, fmt.Errorf("invalid cipher suite %s: must be one of %s", *c.CipherSuite, strings.Join(sortedKeys(cipherSuites), ", ")))
+		}
+	}
+
+	if c.Alerting != nil {
+		if err := c.Alerting.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid alerting settings: %v", err))
+		}
+	}
+
+	for _, peer := range c.PeerSettings {
+		for _, err := range peer.validate(opts) {
+			errs = append(errs, fmt.Errorf("invalid settings for interface %s: %v", peer.InterfaceID, err))
+		}
+	}
+
+	if opts.RejectOverlappingPeerRoutes {
+		if err := c.validateDisjointPeerRoutes(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := c.validatePeerKeepalivesBehindNAT(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if opts.RejectKeepaliveOnLAN && c.sharesLAN() {
+		for _, peer := range c.PeerSettings {
+			if c.hasKeepalive(peer) {
+				errs = append(errs, fmt.Errorf("interface %s shares a LAN with its peer, so it must not send persistent keepalives", peer.InterfaceID))
+			}
+		}
+	}
+
+	if opts.MinKeepalive > 0 {
+		for _, peer := range c.PeerSettings {
+			if v := c.PersistentKeepaliveByInterfaceID(peer.InterfaceID); v != nil && *v > 0 && *v < opts.MinKeepalive {
+				errs = append(errs, fmt.Errorf("invalid persistent keepalive %d for interface %s: must be at least %d seconds, or 0 to disable it", *v, peer.InterfaceID, opts.MinKeepalive))
+			}
+		}
+	}
+
+	if opts.RequireKeepaliveBehindNAT {
+		for _, peer := range c.PeerSettings {
+			if peer.IsBehindNAT() && !c.hasKeepalive(peer) {
+				errs = append(errs, fmt.Errorf("interface %s is behind NAT, but has no persistent keepalive", peer.InterfaceID))
+			}
+		}
+	}
+
+	return errs
+}
+
+// validatePeerKeepalivesBehindNAT checks that the peers don't both explicitly
+// disable their persistent keepalives, either on the peers or through the
+// connection, while one of them is behind NAT, which is contradictory.
+// Disabling it on a single peer is a legitimate asymmetry.
+func (c *Connection) validatePeerKeepalivesBehindNAT() error {
+	var natted *PeerSettings
+	for _, peer := range c.PeerSettings {
+		if v := c.PersistentKeepaliveByInterfaceID(peer.InterfaceID); v == nil || *v != 0 {
+			return nil
+		}
+		if natted == nil && peer.IsBehindNAT() {
+			natted = peer
+		}
+	}
+	if natted != nil {
+		return fmt.Errorf("interface %s is behind NAT, but both peers disable persistent keepalives", natted.InterfaceID)
+	}
+	return nil
+}
+
+// hasKeepalive checks whether a peer has a persistent keepalive enabled,
+// either through its own settings or through the connection ones.
+func (c *Connection) hasKeepalive(peer *PeerSettings) bool {
+	v := c.PersistentKeepaliveByInterfaceID(peer.InterfaceID)
+	return v != nil && *v > 0
+}
+
+// sharesLAN checks whether the peers of the connection appear to be on the same
+// LAN, i.e. neither is behind NAT, and their endpoints are private addresses within
+// the same /24 (or /64, for IPv6) or within a private route advertised by either peer.
+func (c *Connection) sharesLAN() bool {
+
+	if len(c.PeerSettings) != 2 {
+		return false
+	}
+
+	ips := []net.IP{}
+	for _, peer := range c.PeerSettings {
+		e := peer.PrimaryEndpoint()
+		if peer.IsBehindNAT() || e == nil {
+			return false
+		}
+		host, _, err := net.SplitHostPort(*e)
+		if err != nil {
+			return false
+		}
+		ip := normalizeIP(net.ParseIP(host))
+		if ip == nil || !isPrivateCIDR(&net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}) {
+			return false
+		}
+		ips = append(ips, ip)
+	}
+
+	lan := net.IPNet{IP: ips[0].Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}
+	if ip4 := ips[0].To4(); ip4 != nil {
+		lan = net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+	}
+	if lan.Contains(ips[1]) {
+		return true
+	}
+
+	for _, peer := range c.PeerSettings {
+		for _, r := range peerRoutes(peer) {
+			if isPrivateCIDR(r) && r.Contains(ips[0]) && r.Contains(ips[1]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// validateDisjointPeerRoutes checks that no route of a peer overlaps a route
+// of the other peer, so that each subnet is owned by a single end of the
+// connection. A default route on both peers is allowed, as it is used for
+// intentionally sending all traffic through the tunnel in both directions.
+func (c *Connection) validateDisjointPeerRoutes() error {
+
+	a, b := peerRoutes(c.PeerSettings[0]), peerRoutes(c.PeerSettings[1])
+
+	for _, ra := range a {
+		for _, rb := range b {
+			if isDefaultRoute(ra) && ra.String() == rb.String() {
+				continue
+			}
+			if cidrsOverlap(ra, rb) {
+				return fmt.Errorf("route %s of interface %s overlaps route %s of interface %s",
+					ra, c.PeerSettings[0].InterfaceID, rb, c.PeerSettings[1].InterfaceID)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ValidateWithInterfaces : validates the connection, and additionally checks
+// that the NodeID of each peer matches the node owning its interface, and that
+// each interface belongs to the network of the connection. Connections without
+// a network are not checked against the networks of the interfaces.
+func (c *Connection) ValidateWithInterfaces(ifaces map[string]*Interface) error {
+
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	for _, peer := range c.PeerSettings {
+		iface, ok := ifaces[peer.InterfaceID]
+		if !ok {
+			return fmt.Errorf("interface %s not found", peer.InterfaceID)
+		}
+		if peer.NodeID != iface.NodeID {
+			return fmt.Errorf("node %s does not own interface %s", peer.NodeID, peer.InterfaceID)
+		}
+		if c.NetworkID != "" && iface.NetworkID != c.NetworkID {
+			return fmt.Errorf("interface %s belongs to network %s, not to network %s of the connection", peer.InterfaceID, iface.NetworkID, c.NetworkID)
+		}
+	}
+
+	return nil
+}
+
+// ValidateWithNetwork : validates the connection, and additionally checks that
+// its routes belong to address families supported by the network.
+func (c *Connection) ValidateWithNetwork(n *Network) error {
+
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	for _, peer := range c.PeerSettings {
+		if peer.RoutingRules == nil {
+			continue
+		}
+		for _, route := range peer.RoutingRules.AllowedIPs {
+			_, ipnet, err := net.ParseCIDR(route)
+			if err != nil {
+				return fmt.Errorf("invalid CIDR %s", route)
+			}
+			if family := cidrAddressFamily(ipnet); !n.SupportsAddressFamily(family) {
+				return fmt.Errorf("route %s is %s, but network %s only supports %s", route, family, n.ID, n.AddressFamily)
+			}
+		}
 	}
-	if connectedInterfaceIDs[0] == connectedInterfaceIDs[1] {
-		return errors.New("can't connect an interface to itself")
+
+	return nil
+}
+
+// ValidateAgainstInterfaceFamilies : checks that no peer of a connection advertises routes
+// of an address family its interface has no address of, and therefore can't originate
+// traffic for. The families of each interface, i.e. AddressFamilyIPv4 or AddressFamilyIPv6,
+// are passed as argument, keyed by interface ID. Interfaces missing from it are not checked.
+func ValidateAgainstInterfaceFamilies(c *Connection, ifaceFamilies map[string][]string) error {
+
+	for _, peer := range c.PeerSettings {
+		families, ok := ifaceFamilies[peer.InterfaceID]
+		if !ok {
+			continue
+		}
+		for _, n := range peerRoutes(peer) {
+			family := cidrAddressFamily(n)
+			if !containsString(families, family) {
+				return fmt.Errorf("interface %s advertises %s route %s, but has no %s address", peer.InterfaceID, family, n, family)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ValidatePrefixBounds : checks that none of the AllowedIPs in a connection is
+// broader than the minimum prefix length of its address family, so that traffic
+// for large portions of the internet isn't tunneled by accident. Routes listed
+// in allowed, such as the default route 0.0.0.0/0, are accepted regardless.
+func ValidatePrefixBounds(c *Connection, minV4, minV6 int, allowed ...string) error {
+
+	permitted := map[string]struct{}{}
+	for _, s := range normalizedCIDRSet(allowed) {
+		permitted[s] = struct{}{}
+	}
+
+	for _, peer := range c.PeerSettings {
+		if peer.RoutingRules == nil {
+			continue
+		}
+		for _, route := range peer.RoutingRules.AllowedIPs {
+			_, n, err := net.ParseCIDR(route)
+			if err != nil {
+				return fmt.Errorf("invalid CIDR %s", route)
+			}
+			if _, ok := permitted[n.String()]; ok {
+				continue
+			}
+			ones, _ := n.Mask.Size()
+			min := minV4
+			if cidrAddressFamily(n) == AddressFamilyIPv6 {
+				min = minV6
+			}
+			if ones < min {
+				return fmt.Errorf("route %s of interface %s is too broad: prefix must be at least /%d", route, peer.InterfaceID, min)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ValidateAgainstNodeRoutes : checks that the AllowedIPs of the peer on a given node
+// don't overlap with static routes defined on that node outside of WireGuard, which
+// would otherwise result in a routing conflict.
+func ValidateAgainstNodeRoutes(c *Connection, nodeID string, staticRoutes []string) error {
+
+	var peer *PeerSettings
+	for _, p := range c.PeerSettings {
+		if p.NodeID == nodeID {
+			peer = p
+		}
+	}
+	if peer == nil {
+		return fmt.Errorf("node %s is not part of connection %s", nodeID, c.ID)
+	}
+	if peer.RoutingRules == nil {
+		return nil
+	}
+
+	static, err := parseCIDRs(staticRoutes)
+	if err != nil {
+		return err
+	}
+
+	for _, route := range peer.RoutingRules.AllowedIPs {
+		_, n, err := net.ParseCIDR(route)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR %s", route)
+		}
+		for i, sr := range static {
+			if cidrsOverlap(n, sr) {
+				return fmt.Errorf("route %s of connection %s conflicts with static route %s on node %s", route, c.ID, staticRoutes[i], nodeID)
+			}
+		}
 	}
 
 	return nil
 }
 
+// validateEndpoint checks that an endpoint is in the host:port format. If
+// requireRoutable is set, also rejects endpoints whose host is a loopback or
+// unspecified IP address. Hostnames are not resolved, and thus not checked.
+func validateEndpoint(s string, requireRoutable bool) error {
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return errors.New("missing host")
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid port %s", port)
+	}
+
+	if requireRoutable {
+		if ip := net.ParseIP(host); ip != nil && (ip.IsLoopback() || ip.IsUnspecified()) {
+			return fmt.Errorf("%s is not a routable address", host)
+		}
+	}
+
+	return nil
+}
+
+var labelRegexp = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+var domainLabelRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// isDomainName checks whether a string is shaped like a DNS name,
+// i.e. one or more dot-separated labels of at most 63 characters.
+func isDomainName(s string) bool {
+	if len(s) == 0 || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if !domainLabelRegexp.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// PersistentKeepaliveByInterfaceID : returns the keepalive to be used by the
+// interface whose ID is passed as argument. The peer-level value takes precedence,
+// falling back to the connection-level value when unset.
+func (c *Connection) PersistentKeepaliveByInterfaceID(s string) *int {
+	for _, peer := range c.PeerSettings {
+		if peer.InterfaceID == s && peer.PersistentKeepalive != nil {
+			return peer.PersistentKeepalive
+		}
+	}
+	return c.PersistentKeepalive
+}
+
 // ConnectedInterfaceIDs :
 func (c *Connection) ConnectedInterfaceIDs() []string {
 	ids := []string{}
@@ -62,6 +899,19 @@ func (c *Connection) ConnectedInterfaceIDs() []string {
 	return ids
 }
 
+// CanonicalKey : returns a key identifying the pair of interfaces
+// connected, regardless of the order in which peers are specified.
+func (c *Connection) CanonicalKey() string {
+	return strings.Join(c.ConnectedInterfaceIDs(), ":")
+}
+
+// Fingerprint : returns a short, stable hash of the canonical key of the connection,
+// for correlating log lines about the same link without exposing its full IDs.
+func (c *Connection) Fingerprint() string {
+	sum := sha256.Sum256([]byte(c.CanonicalKey()))
+	return hex.EncodeToString(sum[:4])
+}
+
 // ConnectedNodeIDs :
 func (c *Connection) ConnectedNodeIDs() []string {
 	ids := []string{}
@@ -72,6 +922,12 @@ func (c *Connection) ConnectedNodeIDs() []string {
 	return ids
 }
 
+// HasDistinctNodes : checks whether the peers of the connection belong to different nodes.
+func (c *Connection) HasDistinctNodes() bool {
+	ids := c.ConnectedNodeIDs()
+	return len(ids) == 2 && ids[0] != ids[1]
+}
+
 // PeerSettingsByNodeID :
 func (c *Connection) PeerSettingsByNodeID(s string) *PeerSettings {
 
@@ -96,6 +952,66 @@ func (c *Connection) PeerSettingsByInterfaceID(s string) *PeerSettings {
 	return nil
 }
 
+// RoutesForInterface : returns a copy of the AllowedIPs advertised by the
+// interface whose ID is passed as argument.
+func (c *Connection) RoutesForInterface(s string) ([]string, error) {
+
+	for _, peer := range c.PeerSettings {
+		if peer.InterfaceID == s {
+			routes := []string{}
+			if peer.RoutingRules != nil {
+				routes = append(routes, peer.RoutingRules.AllowedIPs...)
+			}
+			return routes, nil
+		}
+	}
+
+	return nil, fmt.Errorf("interface %s is not part of the connection", s)
+}
+
+// ContainsIP : checks whether the AllowedIPs of any of the peers fully
+// contain the IP address or CIDR passed as argument.
+func (c *Connection) ContainsIP(s string) bool {
+
+	target, err := parseIPOrCIDR(s)
+	if err != nil {
+		return false
+	}
+
+	for _, peer := range c.PeerSettings {
+		if peer.RoutingRules == nil {
+			continue
+		}
+		for _, route := range peer.RoutingRules.AllowedIPs {
+			if _, n, err := net.ParseCIDR(route); err == nil && cidrContains(n, target) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ReplacePeerInterface : makes the peer on the interface oldID refer to the
+// interface newID, owned by node newNodeID, instead. Other peer settings are
+// preserved. It fails if oldID is not part of the connection, or if newID
+// is the interface at the other end, which would connect it to itself.
+func (c *Connection) ReplacePeerInterface(oldID, newID, newNodeID string) error {
+
+	peer := c.PeerSettingsByInterfaceID(oldID)
+	if peer == nil {
+		return fmt.Errorf("interface %s is not part of connection %s", oldID, c.ID)
+	}
+	if other := c.OtherPeerSettingsByInterfaceID(oldID); other.InterfaceID == newID {
+		return fmt.Errorf("can't replace interface %s with %s in connection %s: can't connect an interface to itself", oldID, newID, c.ID)
+	}
+
+	peer.InterfaceID = newID
+	peer.NodeID = newNodeID
+
+	return nil
+}
+
 // OtherPeerSettingsByInterfaceID : given the ID of one of the connected interfaces,
 // returns the settings for the peer/interface at the other end of the connection.
 func (c *Connection) OtherPeerSettingsByInterfaceID(s string) *PeerSettings {
@@ -109,73 +1025,437 @@ func (c *Connection) OtherPeerSettingsByInterfaceID(s string) *PeerSettings {
 	return nil
 }
 
+// Initiator : returns the ID of the node which should initiate the handshake.
+// If one of the peers is a server, the other one always dials it, unless the
+// server is behind a NAT and can't be reached. Otherwise, if exactly one of the
+// peers is behind a NAT, that peer must initiate. If neither is, the node whose
+// ID comes first in lexicographic order is chosen, so that the result is
+// deterministic. If both are, neither can reach the other, and an error is returned.
+func (c *Connection) Initiator() (string, error) {
+
+	if len(c.PeerSettings) != 2 {
+		return "", errors.New("a connection must specify exactly two peers")
+	}
+
+	a, b := c.PeerSettings[0], c.PeerSettings[1]
+
+	for i, peer := range c.PeerSettings {
+		if peer.IsServer() {
+			if peer.IsBehindNAT() {
+				return "", fmt.Errorf("server %s is behind NAT, so it can't be dialed", peer.NodeID)
+			}
+			return c.PeerSettings[1-i].NodeID, nil
+		}
+	}
+
+	switch {
+	case a.IsBehindNAT() && b.IsBehindNAT():
+		return "", errors.New("both peers are behind NAT, so neither can initiate the handshake")
+	case a.IsBehindNAT():
+		return a.NodeID, nil
+	case b.IsBehindNAT():
+		return b.NodeID, nil
+	}
+
+	if b.NodeID < a.NodeID {
+		return b.NodeID, nil
+	}
+	return a.NodeID, nil
+}
+
+// IsSymmetric : checks whether both peers advertise the same set of
+// AllowedIPs, after normalizing, sorting, and deduplicating them.
+func (c *Connection) IsSymmetric() bool {
+
+	if len(c.PeerSettings) != 2 {
+		return false
+	}
+
+	sets := [][]string{}
+	for _, peer := range c.PeerSettings {
+		routes := []string{}
+		if peer.RoutingRules != nil {
+			routes = peer.RoutingRules.AllowedIPs
+		}
+		sets = append(sets, normalizedCIDRSet(routes))
+	}
+
+	if len(sets[0]) != len(sets[1]) {
+		return false
+	}
+	for i := range sets[0] {
+		if sets[0][i] != sets[1][i] {
+			return false
+		}
+	}
+
+	return true
+}
+
 // ConnectsInterfaces : checks whether a Connection connects two
 // interfaces whose indices are passed as arguments.
 func (c *Connection) ConnectsInterfaces(a, b string) bool {
 	if c.ConnectsInterface(a) && c.ConnectsInterface(b) {
 		return true
 	}
-	return false
+	return false
+}
+
+// ConnectsInterface : checks whether a connection connects
+// an interface whose index is passed as argument.
+func (c *Connection) ConnectsInterface(s string) bool {
+
+	if c.PeerSettings[0].InterfaceID == s || c.PeerSettings[1].InterfaceID == s {
+		return true
+	}
+	return false
+}
+
+func (c *Connection) InitializePeerSettings() error {
+
+	for _, id := range c.ConnectedInterfaceIDs() {
+
+		if c.PeerSettingsByInterfaceID(id) == nil {
+			c.PeerSettings = append(c.PeerSettings, &PeerSettings{
+				InterfaceID: id,
+				RoutingRules: &RoutingRules{
+					AllowedIPs: []string{},
+				},
+			})
+		}
+
+		// Initialize RoutingRules, if necessary
+		peer := c.PeerSettingsByInterfaceID(id)
+		if peer.RoutingRules == nil {
+			peer.RoutingRules = &RoutingRules{AllowedIPs: []string{}}
+		}
+	}
+
+	return nil
+
+}
+
+// Merge : merges the non-empty values passed as argument into a copy of the
+// connection. An error is returned if the result doesn't have exactly two peers,
+// which may happen when the connection has no peers yet, and the ones passed
+// as argument are adopted as they are.
+func (c *Connection) Merge(in *Connection) (*Connection, error) {
+
+	result := *c
+
+	if len(result.PeerSettings) != 0 && len(result.PeerSettings) != 2 {
+		return nil, fmt.Errorf("can't merge into connection %s: expected 2 peers, have %d", c.ID, len(result.PeerSettings))
+	}
+
+	if in.PeerSettings != nil {
+		if result.PeerSettings == nil {
+			result.PeerSettings = in.PeerSettings
+		} else {
+			for _, peer := range in.PeerSettings {
+				if result.PeerSettings[0].InterfaceID == peer.InterfaceID {
+					result.PeerSettings[0] = result.PeerSettings[0].Merge(peer)
+				} else if result.PeerSettings[1].InterfaceID == peer.InterfaceID {
+					result.PeerSettings[1] = result.PeerSettings[1].Merge(peer)
+				}
+			}
+		}
+	}
+
+	if in.Enabled != nil {
+		result.Enabled = in.Enabled
+	}
+
+	if in.PersistentKeepalive != nil {
+		result.PersistentKeepalive = in.PersistentKeepalive
+	}
+
+	if in.MTU != nil {
+		result.MTU = in.MTU
+	}
+
+	if in.MTUProbeInterval != nil {
+		result.MTUProbeInterval = in.MTUProbeInterval
+	}
+
+	if in.RekeyInterval != nil {
+		result.RekeyInterval = in.RekeyInterval
+	}
+
+	if in.Table != nil {
+		result.Table = in.Table
+	}
+
+	if in.FwMark != nil {
+		result.FwMark = in.FwMark
+	}
+
+	if in.Transport != "" {
+		result.Transport = in.Transport
+	}
+
+	if in.DSCP != nil {
+		result.DSCP = in.DSCP
+	}
+
+	if in.Priority != nil {
+		result.Priority = in.Priority
+	}
+
+	if in.RateLimitKbps != nil {
+		result.RateLimitKbps = in.RateLimitKbps
+	}
+
+	if in.Alerting != nil {
+		result.Alerting = c.Alerting.Merge(in.Alerting)
+	}
+
+	if in.LogLevel != nil {
+		result.LogLevel = in.LogLevel
+	}
+
+	if in.CipherSuite != nil {
+		result.CipherSuite = in.CipherSuite
+	}
+
+	if in.PresharedKeyRef != nil {
+		result.PresharedKeyRef = in.PresharedKeyRef
+	}
+
+	if in.Description != "" {
+		result.Description = in.Description
+	}
+
+	if in.Labels != nil {
+		result.Labels = unionStrings(c.Labels, in.Labels)
+	}
+
+	if in.GroupID != nil {
+		result.GroupID = in.GroupID
+	}
+
+	if in.Tags != nil {
+		result.Tags = copyStringMap(c.Tags)
+		if result.Tags == nil {
+			result.Tags = map[string]string{}
+		}
+		for k, v := range in.Tags {
+			result.Tags[k] = v
+		}
+	}
+
+	if in.ActiveUntil != nil {
+		result.ActiveUntil = in.ActiveUntil
+	}
+
+	if in.ExpireAt != nil {
+		result.ExpireAt = in.ExpireAt
+	}
+
+	if in.IdempotencyKey != "" {
+		result.IdempotencyKey = in.IdempotencyKey
+	}
+
+	if len(result.PeerSettings) != 2 {
+		return nil, fmt.Errorf("merged connection %s must have exactly 2 peers, has %d", c.ID, len(result.PeerSettings))
+	}
+
+	return &result, nil
+}
+
+// RecordChange : appends an entry to the connection history, discarding
+// the oldest entries if it grows beyond the maximum size.
+func (c *Connection) RecordChange(by, summary string) {
+	c.History = appendHistory(c.History, &ChangeEntry{
+		At:      time.Now(),
+		By:      by,
+		Summary: summary,
+	})
+}
+
+// ChurnRate : returns the number of changes in the history which were applied
+// within the window ending at now, as a measure of how unstable a connection is.
+func ChurnRate(history []*ChangeEntry, window time.Duration, now time.Time) int {
+	start := now.Add(-window)
+	n := 0
+	for _, entry := range history {
+		if !entry.At.Before(start) && !entry.At.After(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// appendHistory returns a new history slice containing the
+// entries passed as argument, capped to the maximum size.
+func appendHistory(history []*ChangeEntry, entries ...*ChangeEntry) []*ChangeEntry {
+	res := append(append([]*ChangeEntry{}, history...), entries...)
+	if len(res) > maxConnectionHistory {
+		res = res[len(res)-maxConnectionHistory:]
+	}
+	return res
+}
+
+// RecordSample : adds a sample to the telemetry window of the connection,
+// discarding the oldest samples of the same node if it grows beyond the
+// maximum size.
+func (c *Connection) RecordSample(s Sample) {
+	c.ThroughputSamples = appendSamples(c.ThroughputSamples, s)
+}
+
+// SamplesByNodeID : returns the samples reported by a node, in chronological order.
+func (c *Connection) SamplesByNodeID(nodeID string) []Sample {
+	res := []Sample{}
+	for _, s := range c.ThroughputSamples {
+		if s.NodeID == nodeID {
+			res = append(res, s)
+		}
+	}
+	return res
 }
 
-// ConnectsInterface : checks whether a connection connects
-// an interface whose index is passed as argument.
-func (c *Connection) ConnectsInterface(s string) bool {
+// appendSamples returns a new slice containing the samples passed as
+// argument, ordered by time and capped to the maximum size per node.
+func appendSamples(samples []Sample, in ...Sample) []Sample {
+	res := append(append([]Sample{}, samples...), in...)
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].At.Before(res[j].At)
+	})
 
-	if c.PeerSettings[0].InterfaceID == s || c.PeerSettings[1].InterfaceID == s {
-		return true
+	// Keep the most recent samples of each node
+	count := map[string]int{}
+	keep := make([]bool, len(res))
+	for i := len(res) - 1; i >= 0; i-- {
+		count[res[i].NodeID]++
+		keep[i] = count[res[i].NodeID] <= maxThroughputSamples
 	}
-	return false
+
+	out := res[:0]
+	for i, s := range res {
+		if keep[i] {
+			out = append(out, s)
+		}
+	}
+	return out
 }
 
-func (c *Connection) InitializePeerSettings() error {
+// Clone : returns a deep copy of the connection.
+func (c *Connection) Clone() *Connection {
 
-	for _, id := range c.ConnectedInterfaceIDs() {
+	result := *c
 
-		if c.PeerSettingsByInterfaceID(id) == nil {
-			c.PeerSettings = append(c.PeerSettings, &PeerSettings{
-				InterfaceID: id,
-				RoutingRules: &RoutingRules{
-					AllowedIPs: []string{},
-				},
-			})
+	result.Enabled = copyBoolPtr(c.Enabled)
+	result.PersistentKeepalive = copyIntPtr(c.PersistentKeepalive)
+	result.MTU = copyIntPtr(c.MTU)
+	result.MTUProbeInterval = copyIntPtr(c.MTUProbeInterval)
+	result.DiscoveredMTU = copyIntPtr(c.DiscoveredMTU)
+	result.RekeyInterval = copyIntPtr(c.RekeyInterval)
+	result.Table = copyIntPtr(c.Table)
+	result.FwMark = copyIntPtr(c.FwMark)
+	result.DSCP = copyIntPtr(c.DSCP)
+	result.Priority = copyIntPtr(c.Priority)
+	result.RateLimitKbps = copyIntPtr(c.RateLimitKbps)
+	result.Alerting = c.Alerting.Clone()
+	result.LogLevel = copyStringPtr(c.LogLevel)
+	result.CipherSuite = copyStringPtr(c.CipherSuite)
+	result.PresharedKeyRef = copyStringPtr(c.PresharedKeyRef)
+	result.Labels = copyStrings(c.Labels)
+	result.GroupID = copyStringPtr(c.GroupID)
+	result.Tags = copyStringMap(c.Tags)
+	result.ActiveUntil = copyTimePtr(c.ActiveUntil)
+	result.ExpireAt = copyTimePtr(c.ExpireAt)
+
+	if c.PeerSettings != nil {
+		result.PeerSettings = make([]*PeerSettings, len(c.PeerSettings))
+		for i, peer := range c.PeerSettings {
+			result.PeerSettings[i] = peer.Clone()
 		}
+	}
 
-		// Initialize RoutingRules, if necessary
-		peer := c.PeerSettingsByInterfaceID(id)
-		if peer.RoutingRules == nil {
-			peer.RoutingRules = &RoutingRules{AllowedIPs: []string{}}
+	if c.History != nil {
+		result.History = make([]*ChangeEntry, len(c.History))
+		for i, entry := range c.History {
+			e := *entry
+			result.History[i] = &e
 		}
 	}
 
-	return nil
+	if c.ThroughputSamples != nil {
+		result.ThroughputSamples = append([]Sample{}, c.ThroughputSamples...)
+	}
 
+	return &result
 }
 
-// Merge :
-func (c *Connection) Merge(in *Connection) *Connection {
+// ApplyPatch : applies a JSON Patch document (RFC 6902) to a copy of the
+// connection, and returns the result if it is a valid connection. The
+// connection itself is never modified.
+func (c *Connection) ApplyPatch(patch []byte) (*Connection, error) {
 
-	result := *c
+	doc, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
 
-	if in.PeerSettings != nil {
-		if result.PeerSettings == nil {
-			result.PeerSettings = in.PeerSettings
-		} else {
-			for _, peer := range in.PeerSettings {
-				if result.PeerSettings[0].InterfaceID == peer.InterfaceID {
-					result.PeerSettings[0] = result.PeerSettings[0].Merge(peer)
-				} else if result.PeerSettings[1].InterfaceID == peer.InterfaceID {
-					result.PeerSettings[1] = result.PeerSettings[1].Merge(peer)
-				}
-			}
-		}
+	doc, err = jsonpatch.Apply(doc, patch)
+	if err != nil {
+		return nil, err
 	}
 
-	if in.PersistentKeepalive != nil {
-		result.PersistentKeepalive = in.PersistentKeepalive
+	result := &Connection{}
+	if err := json.Unmarshal(doc, result); err != nil {
+		return nil, fmt.Errorf("patch produced an invalid connection: %v", err)
+	}
+	if err := result.Validate(); err != nil {
+		return nil, fmt.Errorf("patch produced an invalid connection: %v", err)
 	}
 
-	return &result
+	return result, nil
+}
+
+// Redacted : returns a copy of the connection with sensitive fields cleared,
+// which can be safely logged or returned to clients without access to secrets.
+func (c *Connection) Redacted() *Connection {
+
+	result := c.Clone()
+
+	result.PresharedKeyRef = nil
+	for _, peer := range result.PeerSettings {
+		peer.Endpoint = nil
+		peer.Endpoints = nil
+	}
+
+	return result
+}
+
+// IsActive : checks whether the connection is enabled, and
+// its active window, if any, hasn't elapsed yet.
+func (c *Connection) IsActive(now time.Time) bool {
+	return c.IsEnabled() && (c.ActiveUntil == nil || now.Before(*c.ActiveUntil))
+}
+
+// IsExpired : checks whether the connection expiration time has passed.
+func (c *Connection) IsExpired(now time.Time) bool {
+	return c.ExpireAt != nil && !now.Before(*c.ExpireAt)
+}
+
+// IsEnabled : checks whether the connection is enabled.
+func (c *Connection) IsEnabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+// InGroup : checks whether the connection belongs to the group passed as argument.
+func (c *Connection) InGroup(id string) bool {
+	return c.GroupID != nil && *c.GroupID == id
+}
+
+// HasLabel : checks whether the connection has the label passed as argument.
+func (c *Connection) HasLabel(l string) bool {
+	for _, label := range c.Labels {
+		if label == l {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *Connection) AllowIPBidirectional(ip string) error {
@@ -186,10 +1466,17 @@ func (c *Connection) AllowIPBidirectional(ip string) error {
 }
 
 // Stub :
-func (c *Connection) Stub() *ConnectionListStub {
+func (c *Connection) Stub() (*ConnectionListStub, error) {
+
+	if len(c.PeerSettings) != 2 {
+		return nil, fmt.Errorf("can't build stub for connection %s: expected 2 peers, have %d", c.ID, len(c.PeerSettings))
+	}
 
 	peers := []string{}
 	for _, peer := range c.PeerSettings {
+		if peer == nil {
+			return nil, fmt.Errorf("can't build stub for connection %s: missing peer settings", c.ID)
+		}
 		peers = append(peers, peer.InterfaceID)
 	}
 
@@ -199,10 +1486,20 @@ func (c *Connection) Stub() *ConnectionListStub {
 		Peers:               peers,
 		PeerSettings:        c.PeerSettings,
 		PersistentKeepalive: c.PersistentKeepalive,
+		MTU:                 c.MTU,
+		MTUProbeInterval:    c.MTUProbeInterval,
+		DiscoveredMTU:       c.DiscoveredMTU,
+		DSCP:                c.DSCP,
+		Transport:           c.Transport,
+		CipherSuite:         c.CipherSuite,
+		GroupID:             c.GroupID,
+		Alerting:            c.Alerting,
+		ActiveUntil:         c.ActiveUntil,
+		ExpireAt:            c.ExpireAt,
 		BytesTransferred:    0,
 		CreatedAt:           c.CreatedAt,
 		UpdatedAt:           c.UpdatedAt,
-	}
+	}, nil
 }
 
 // ConnectionListStub :
@@ -213,9 +1510,97 @@ type ConnectionListStub struct {
 	Peers               []string
 	PeerSettings        []*PeerSettings
 	PersistentKeepalive *int
+	MTU                 *int
+	MTUProbeInterval    *int
+	DSCP                *int
+	Transport           string
+	CipherSuite         *string
+	GroupID             *string
+	Alerting            *AlertConfig
+	ActiveUntil         *time.Time
+	ExpireAt            *time.Time
 	BytesTransferred    uint64
 	CreatedAt           time.Time
 	UpdatedAt           time.Time
+
+	// ThroughputSamples contain the recent telemetry window of the
+	// connection, and are only set if requested with IncludeSamples.
+	ThroughputSamples []Sample
+
+	// DiscoveredMTU is the path MTU probed and reported by the agents,
+	// which may differ from the configured MTU.
+	DiscoveredMTU *int
+}
+
+// Bounds on the thresholds of alerting rules. WireGuard peers complete a
+// handshake at least every two minutes while exchanging traffic, so any
+// shorter timeout would trigger false alerts.
+const (
+	minAlertHandshakeTimeout  = 180
+	maxAlertHandshakeTimeout  = 7 * 24 * 60 * 60
+	maxAlertMinThroughputKbps = 100 * 1000 * 1000
+)
+
+// AlertConfig : contains the thresholds read by alerting rules for a connection.
+type AlertConfig struct {
+	// HandshakeTimeout is the time, in seconds, after which an alert is
+	// raised if the peers haven't completed a handshake.
+	HandshakeTimeout *int
+
+	// MinThroughputKbps is the throughput below which an alert is raised.
+	MinThroughputKbps *int
+}
+
+func (a *AlertConfig) validate() error {
+	if a.HandshakeTimeout != nil && (*a.HandshakeTimeout < minAlertHandshakeTimeout || *a.HandshakeTimeout > maxAlertHandshakeTimeout) {
+		return fmt.Errorf("invalid handshake timeout %d: must be between %d and %d seconds",
+			*a.HandshakeTimeout, minAlertHandshakeTimeout, maxAlertHandshakeTimeout)
+	}
+	if a.MinThroughputKbps != nil && (*a.MinThroughputKbps < 0 || *a.MinThroughputKbps > maxAlertMinThroughputKbps) {
+		return fmt.Errorf("invalid minimum throughput %d: must be between 0 and %d kbps",
+			*a.MinThroughputKbps, maxAlertMinThroughputKbps)
+	}
+	return nil
+}
+
+// Merge : merges the non-nil thresholds passed as argument into a copy of
+// the alerting settings. The receiver may be nil.
+func (a *AlertConfig) Merge(in *AlertConfig) *AlertConfig {
+	result := &AlertConfig{}
+	if a != nil {
+		result = a.Clone()
+	}
+	if in.HandshakeTimeout != nil {
+		result.HandshakeTimeout = copyIntPtr(in.HandshakeTimeout)
+	}
+	if in.MinThroughputKbps != nil {
+		result.MinThroughputKbps = copyIntPtr(in.MinThroughputKbps)
+	}
+	return result
+}
+
+// Clone :
+func (a *AlertConfig) Clone() *AlertConfig {
+	if a == nil {
+		return nil
+	}
+	return &AlertConfig{
+		HandshakeTimeout:  copyIntPtr(a.HandshakeTimeout),
+		MinThroughputKbps: copyIntPtr(a.MinThroughputKbps),
+	}
+}
+
+// Roles a peer can have in a connection.
+const (
+	PeerRoleClient = "client"
+	PeerRoleServer = "server"
+	PeerRolePeer   = "peer"
+)
+
+var peerRoles = map[string]struct{}{
+	PeerRoleClient: {},
+	PeerRoleServer: {},
+	PeerRolePeer:   {},
 }
 
 // PeerSettings :
@@ -223,6 +1608,240 @@ type PeerSettings struct {
 	NodeID       string
 	InterfaceID  string
 	RoutingRules *RoutingRules
+
+	// PersistentKeepalive overrides the connection-level keepalive
+	// for this peer only. If nil, the connection-level value is used.
+	PersistentKeepalive *int
+
+	// BehindNAT indicates whether the peer is behind a NAT, in which case
+	// it can't be reached unless it initiates the connection itself.
+	BehindNAT *bool
+
+	// Endpoint is a static host:port at which the peer can be reached.
+	// If nil, the address advertised by the node is used.
+	Endpoint *string
+
+	// Endpoints is a list of host:port at which the peer can be reached,
+	// by order of preference. If set, the first one takes precedence over
+	// Endpoint. Only that one is handed to agents, which don't fail over
+	// to the others yet.
+	Endpoints []string
+
+	// Role is the role of the peer in the connection, i.e. PeerRoleServer
+	// for hubs which are dialed, PeerRoleClient for spokes which dial, or
+	// PeerRolePeer if both may. If empty, PeerRolePeer is assumed.
+	Role string
+
+	// ListenPort overrides the port the peer's interface listens on
+	// for this connection. If nil, the interface's port is used.
+	ListenPort *int
+
+	// SourcePortRange restricts the source ports from which the peer sends
+	// traffic for this connection, in the form low-high, for traversing
+	// firewalls which only permit specific ports. If nil, any port is used.
+	SourcePortRange *string
+
+	// DNS contains the IP addresses of the resolvers to be used by the peer,
+	// and SearchDomains the domains to be appended to unqualified names.
+	DNS           []string
+	SearchDomains []string
+}
+
+// Clone : returns a deep copy of the peer settings.
+func (r *PeerSettings) Clone() *PeerSettings {
+
+	result := *r
+
+	if r.RoutingRules != nil {
+		rules := *r.RoutingRules
+		rules.AllowedIPs = copyStrings(r.RoutingRules.AllowedIPs)
+		if r.RoutingRules.RouteTags != nil {
+			rules.RouteTags = make(map[string][]string, len(r.RoutingRules.RouteTags))
+			for k, v := range r.RoutingRules.RouteTags {
+				rules.RouteTags[k] = copyStrings(v)
+			}
+		}
+		result.RoutingRules = &rules
+	}
+
+	result.PersistentKeepalive = copyIntPtr(r.PersistentKeepalive)
+	result.BehindNAT = copyBoolPtr(r.BehindNAT)
+	result.Endpoint = copyStringPtr(r.Endpoint)
+	result.Endpoints = copyStrings(r.Endpoints)
+	result.ListenPort = copyIntPtr(r.ListenPort)
+	result.SourcePortRange = copyStringPtr(r.SourcePortRange)
+	result.DNS = copyStrings(r.DNS)
+	result.SearchDomains = copyStrings(r.SearchDomains)
+
+	return &result
+}
+
+// Validate : validates the settings of a single peer, returning the first error.
+// Connections check the identifiers of their peers themselves.
+func (r *PeerSettings) Validate() error {
+	if r.InterfaceID == "" {
+		return errors.New("missing interface ID")
+	}
+	if r.NodeID == "" {
+		return errors.New("missing node ID")
+	}
+	if errs := r.validate(&ConnectionValidationOptions{}); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// validate returns all the errors in the settings of the peer.
+func (r *PeerSettings) validate(opts *ConnectionValidationOptions) []error {
+
+	errs := []error{}
+
+	if r.RoutingRules != nil {
+		for _, ip := range r.RoutingRules.AllowedIPs {
+			_, n, err := net.ParseCIDR(ip)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid allowed IP %s", ip))
+				continue
+			}
+			// IPv4-mapped addresses are rejected rather than silently normalized,
+			// since they usually point at a client mixing up address families.
+			if isIPv4MappedCIDR(n) {
+				errs = append(errs, fmt.Errorf("allowed IP %s is an IPv4-mapped IPv6 address, use %s instead", ip, n))
+			}
+			if opts.RequireCanonicalCIDRs && n.String() != ip {
+				errs = append(errs, fmt.Errorf("allowed IP %s is not in canonical form, use %s instead", ip, n))
+			}
+			if opts.RejectDocumentationRanges {
+				if dr := documentationRange(n); dr != nil {
+					errs = append(errs, fmt.Errorf("allowed IP %s is within the documentation range %s, and can't be routed", ip, dr))
+				}
+			}
+		}
+		routes := map[string]struct{}{}
+		for _, ip := range normalizedCIDRSet(r.RoutingRules.AllowedIPs) {
+			routes[ip] = struct{}{}
+		}
+		for k := range r.RoutingRules.RouteTags {
+			if _, ok := routes[normalizeCIDR(k)]; !ok {
+				errs = append(errs, fmt.Errorf("route tags for %s, which is not an allowed IP", k))
+			}
+		}
+	}
+
+	if r.PersistentKeepalive != nil {
+		if err := validateKeepalive(*r.PersistentKeepalive); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if r.Endpoint != nil {
+		if err := validateEndpoint(*r.Endpoint, opts.RequireRoutableEndpoints); err != nil {
+			errs = append(errs, fmt.Errorf("invalid endpoint: %v", err))
+		}
+	}
+	for _, e := range r.Endpoints {
+		if err := validateEndpoint(e, opts.RequireRoutableEndpoints); err != nil {
+			errs = append(errs, fmt.Errorf("invalid endpoint %s: %v", e, err))
+		}
+	}
+
+	if r.Role != "" {
+		if _, ok := peerRoles[r.Role]; !ok {
+			errs = append(errs, fmt.Errorf("invalid role %s: must be one of %s", r.Role, strings.Join(sortedKeys(peerRoles), ", ")))
+		}
+	}
+
+	if r.ListenPort != nil && (*r.ListenPort < 1 || *r.ListenPort > 65535) {
+		errs = append(errs, fmt.Errorf("invalid listen port %d: must be between 1 and 65535", *r.ListenPort))
+	}
+
+	if r.SourcePortRange != nil {
+		if _, _, err := parsePortRange(*r.SourcePortRange); err != nil {
+			errs = append(errs, fmt.Errorf("invalid source port range %s: %v", *r.SourcePortRange, err))
+		}
+	}
+
+	for _, s := range r.DNS {
+		if net.ParseIP(s) == nil {
+			errs = append(errs, fmt.Errorf("invalid DNS server %s", s))
+		}
+	}
+	for _, s := range r.SearchDomains {
+		if !isDomainName(s) {
+			errs = append(errs, fmt.Errorf("invalid DNS search domain %s", s))
+		}
+	}
+
+	return errs
+}
+
+// parsePortRange parses a range of ports in the form low-high,
+// checking that both are valid ports, and that low <= high.
+func parsePortRange(s string) (int, int, error) {
+
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("must be in the form low-high")
+	}
+
+	ports := make([]int, 2)
+	for i, part := range parts {
+		p, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid port %s", part)
+		}
+		if p < 1 || p > 65535 {
+			return 0, 0, fmt.Errorf("invalid port %d: must be between 1 and 65535", p)
+		}
+		ports[i] = p
+	}
+
+	if ports[0] > ports[1] {
+		return 0, 0, fmt.Errorf("low port %d is greater than high port %d", ports[0], ports[1])
+	}
+
+	return ports[0], ports[1], nil
+}
+
+// validateKeepalive checks that a keepalive interval, in seconds, is within
+// the range accepted by WireGuard. A value of zero disables keepalives.
+func validateKeepalive(v int) error {
+	if v < 0 || v > 65535 {
+		return fmt.Errorf("invalid persistent keepalive %d: must be between 0 and 65535", v)
+	}
+	return nil
+}
+
+// PrimaryEndpoint : returns the preferred endpoint of the peer, which is the
+// first of Endpoints if any, or else Endpoint, or nil if none is configured.
+func (r *PeerSettings) PrimaryEndpoint() *string {
+	if len(r.Endpoints) > 0 {
+		return &r.Endpoints[0]
+	}
+	return r.Endpoint
+}
+
+// IsBehindNAT : checks whether the peer is flagged as being behind a NAT.
+func (r *PeerSettings) IsBehindNAT() bool {
+	return r.BehindNAT != nil && *r.BehindNAT
+}
+
+// IsServer : checks whether the peer has the server role.
+func (r *PeerSettings) IsServer() bool {
+	return r.Role == PeerRoleServer
+}
+
+// IsClient : checks whether the peer has the client role.
+func (r *PeerSettings) IsClient() bool {
+	return r.Role == PeerRoleClient
+}
+
+// DNSDirective : returns the value of the WireGuard DNS directive for
+// the peer, combining resolvers and search domains, in this order.
+func (r *PeerSettings) DNSDirective() string {
+	entries := append([]string{}, r.DNS...)
+	entries = append(entries, r.SearchDomains...)
+	return strings.Join(entries, ", ")
 }
 
 // Merge :
@@ -237,6 +1856,33 @@ func (r *PeerSettings) Merge(in *PeerSettings) *PeerSettings {
 	if in.RoutingRules != nil {
 		result.RoutingRules = r.RoutingRules.Merge(in.RoutingRules)
 	}
+	if in.PersistentKeepalive != nil {
+		result.PersistentKeepalive = in.PersistentKeepalive
+	}
+	if in.BehindNAT != nil {
+		result.BehindNAT = in.BehindNAT
+	}
+	if in.Endpoint != nil {
+		result.Endpoint = in.Endpoint
+	}
+	if in.Endpoints != nil {
+		result.Endpoints = in.Endpoints
+	}
+	if in.Role != "" {
+		result.Role = in.Role
+	}
+	if in.ListenPort != nil {
+		result.ListenPort = in.ListenPort
+	}
+	if in.SourcePortRange != nil {
+		result.SourcePortRange = in.SourcePortRange
+	}
+	if in.DNS != nil {
+		result.DNS = in.DNS
+	}
+	if in.SearchDomains != nil {
+		result.SearchDomains = in.SearchDomains
+	}
 	return &result
 }
 
@@ -247,17 +1893,127 @@ type RoutingRules struct {
 	// will accept traffic for itself (192.0.2.3/32), and for all nodes in the
 	// local network (192.168.1.1/24).
 	AllowedIPs []string
+
+	// RouteTags contains tags attached to individual AllowedIPs, keyed by
+	// their canonical CIDR, such as whether they are critical or monitored.
+	RouteTags map[string][]string
 }
 
-// Merge :
+// MarshalJSON : marshals the routing rules with AllowedIPs sorted canonically,
+// so that the serialized form does not depend on insertion order.
+func (r *RoutingRules) MarshalJSON() ([]byte, error) {
+	type alias RoutingRules
+	out := alias(*r)
+	if out.AllowedIPs != nil {
+		out.AllowedIPs = sortedCIDRs(out.AllowedIPs)
+	}
+	return json.Marshal(out)
+}
+
+// Merge : returns the merged routing rules, with AllowedIPs in canonical order,
+// so that merged connections can be compared regardless of insertion order.
+// Tags of routes which are no longer allowed are dropped.
 func (r *RoutingRules) Merge(in *RoutingRules) *RoutingRules {
 	result := *r
 	if in.AllowedIPs != nil {
-		result.AllowedIPs = in.AllowedIPs
+		result.AllowedIPs = sortedCIDRs(in.AllowedIPs)
+	}
+	if r.RouteTags == nil && in.RouteTags == nil {
+		return &result
+	}
+
+	allowed := map[string]struct{}{}
+	for _, s := range result.AllowedIPs {
+		allowed[normalizeCIDR(s)] = struct{}{}
+	}
+
+	result.RouteTags = map[string][]string{}
+	for k, v := range r.RouteTags {
+		if _, ok := allowed[normalizeCIDR(k)]; ok {
+			result.RouteTags[k] = v
+		}
+	}
+	for k, v := range in.RouteTags {
+		k = normalizeCIDR(k)
+		if _, ok := allowed[k]; ok {
+			result.RouteTags[k] = unionStrings(result.RouteTags[k], v)
+		}
+	}
+	return &result
+}
+
+// MergeTemplate : returns a copy of the routing rules with the AllowedIPs of
+// the template added, except for the ones marked in overrides as manually
+// managed, keyed by CIDR. Existing routes are always preserved, and the
+// result is deduplicated and kept in canonical order, as done by Merge.
+func (r *RoutingRules) MergeTemplate(template *RoutingRules, overrides map[string]bool) *RoutingRules {
+
+	manual := map[string]struct{}{}
+	for k, v := range overrides {
+		if v {
+			manual[normalizeCIDR(k)] = struct{}{}
+		}
+	}
+
+	result := *r
+	result.AllowedIPs = copyStrings(r.AllowedIPs)
+
+	seen := map[string]struct{}{}
+	for _, s := range r.AllowedIPs {
+		seen[normalizeCIDR(s)] = struct{}{}
+	}
+	for _, s := range template.AllowedIPs {
+		n := normalizeCIDR(s)
+		if _, ok := manual[n]; ok {
+			continue
+		}
+		if _, ok := seen[n]; !ok {
+			seen[n] = struct{}{}
+			result.AllowedIPs = append(result.AllowedIPs, n)
+		}
 	}
+	result.AllowedIPs = sortedCIDRs(result.AllowedIPs)
+
 	return &result
 }
 
+// AddFromList reads newline-delimited CIDRs from r, and adds the ones not
+// yet present to AllowedIPs, in their canonical form, after which AllowedIPs
+// is kept in canonical order, as done by Merge. Blank lines and
+// lines starting with # are skipped. If any line is invalid, an error is
+// returned and AllowedIPs is left untouched.
+func (r *RoutingRules) AddFromList(in io.Reader) (int, error) {
+
+	seen := map[string]struct{}{}
+	for _, s := range r.AllowedIPs {
+		seen[normalizeCIDR(s)] = struct{}{}
+	}
+
+	added := []string{}
+	scanner := bufio.NewScanner(in)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(line)
+		if err != nil {
+			return 0, fmt.Errorf("invalid CIDR %s on line %d", line, n)
+		}
+		if _, ok := seen[ipNet.String()]; !ok {
+			seen[ipNet.String()] = struct{}{}
+			added = append(added, ipNet.String())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	r.AllowedIPs = sortedCIDRs(append(r.AllowedIPs, added...))
+
+	return len(added), nil
+}
+
 // ConnectionSpecificRequest :
 type ConnectionSpecificRequest struct {
 	ConnectionID string
@@ -276,6 +2032,10 @@ type SingleConnectionResponse struct {
 type ConnectionUpsertRequest struct {
 	Connection *Connection
 
+	// IdempotencyKey identifies the request, so that retrying it
+	// updates the connection created by the first attempt.
+	IdempotencyKey string
+
 	WriteRequest
 }
 
@@ -283,6 +2043,9 @@ type ConnectionUpsertRequest struct {
 type ConnectionDeleteRequest struct {
 	ConnectionIDs []string
 
+	// GroupID additionally deletes all the connections in the group.
+	GroupID string
+
 	WriteRequest
 }
 
@@ -292,9 +2055,54 @@ type ConnectionListRequest struct {
 	NodeID      string
 	NetworkID   string
 
+	// NodeIDs restricts results to connections involving any of the
+	// nodes, and ContainsIP to connections whose AllowedIPs contain
+	// the IP address or CIDR.
+	NodeIDs    []string
+	ContainsIP string
+
+	// ExcludeIDs omits the listed connections from the results.
+	ExcludeIDs []string
+
+	// GroupID restricts results to connections in the group.
+	GroupID string
+
+	// IncludeSamples adds the recent throughput samples to each stub.
+	IncludeSamples bool
+
 	QueryOptions
 }
 
+// Validate : checks that the request filters are coherent before querying the repository.
+func (r *ConnectionListRequest) Validate() error {
+
+	for _, id := range r.NodeIDs {
+		if id == "" {
+			return errors.New("empty node ID in node filter")
+		}
+	}
+
+	if r.NodeID != "" && len(r.NodeIDs) > 0 {
+		found := false
+		for _, id := range r.NodeIDs {
+			if id == r.NodeID {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("node %s is not within the requested set of nodes", r.NodeID)
+		}
+	}
+
+	if r.ContainsIP != "" {
+		if _, err := parseIPOrCIDR(r.ContainsIP); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // ConnectionListResponse :
 type ConnectionListResponse struct {
 	Items []*ConnectionListStub
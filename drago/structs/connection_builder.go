@@ -0,0 +1,67 @@
+package structs
+
+// ConnectionBuilder : builds connections through chainable method calls,
+// deferring validation to Build.
+type ConnectionBuilder struct {
+	networkID string
+	peers     []*PeerSettings
+	keepalive *int
+	routes    []string
+}
+
+// NewConnectionBuilder : returns a builder for a new connection.
+func NewConnectionBuilder() *ConnectionBuilder {
+	return &ConnectionBuilder{}
+}
+
+// Network : sets the network of the connection.
+func (b *ConnectionBuilder) Network(id string) *ConnectionBuilder {
+	b.networkID = id
+	return b
+}
+
+// Peer : adds the interface with the given ID, owned by the given
+// node, to the connection.
+func (b *ConnectionBuilder) Peer(interfaceID, nodeID string) *ConnectionBuilder {
+	b.peers = append(b.peers, &PeerSettings{InterfaceID: interfaceID, NodeID: nodeID})
+	return b
+}
+
+// Keepalive : sets the persistent keepalive of the connection, in seconds.
+func (b *ConnectionBuilder) Keepalive(seconds int) *ConnectionBuilder {
+	b.keepalive = &seconds
+	return b
+}
+
+// AllowBidirectional : allows traffic to the given CIDR in both directions.
+func (b *ConnectionBuilder) AllowBidirectional(cidr string) *ConnectionBuilder {
+	b.routes = append(b.routes, cidr)
+	return b
+}
+
+// Build : returns the connection, with its peer settings initialized,
+// or an error if it is not valid.
+func (b *ConnectionBuilder) Build() (*Connection, error) {
+
+	c := NewConnection()
+	c.NetworkID = b.networkID
+	c.PersistentKeepalive = copyIntPtr(b.keepalive)
+
+	for _, peer := range b.peers {
+		c.PeerSettings = append(c.PeerSettings, peer.Clone())
+	}
+
+	if err := c.InitializePeerSettings(); err != nil {
+		return nil, err
+	}
+
+	for _, cidr := range b.routes {
+		c.AllowIPBidirectional(cidr)
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
@@ -0,0 +1,49 @@
+package structs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConnectionBuilder(t *testing.T) {
+
+	c, err := NewConnectionBuilder().
+		Network("network-1").
+		Peer("iface-a", "node-a").
+		Peer("iface-b", "node-b").
+		Keepalive(25).
+		AllowBidirectional("10.0.0.0/24").
+		Build()
+	if err != nil {
+		t.Fatalf("b.Build() failed, unexpected error: %v", err)
+	}
+
+	if c.ID == "" || c.NetworkID != "network-1" || *c.PersistentKeepalive != 25 {
+		t.Fatalf("b.Build() failed, unexpected connection %+v", c)
+	}
+	for _, id := range []string{"iface-a", "iface-b"} {
+		peer := c.PeerSettingsByInterfaceID(id)
+		if peer == nil || peer.RoutingRules == nil {
+			t.Fatalf("b.Build() failed, expected initialized settings for interface %s", id)
+		}
+		if !reflect.DeepEqual(peer.RoutingRules.AllowedIPs, []string{"10.0.0.0/24"}) {
+			t.Fatalf("b.Build() failed, expected %v, have %v", []string{"10.0.0.0/24"}, peer.RoutingRules.AllowedIPs)
+		}
+	}
+}
+
+func TestConnectionBuilderErrors(t *testing.T) {
+
+	builders := map[string]*ConnectionBuilder{
+		"single peer":       NewConnectionBuilder().Peer("iface-a", "node-a"),
+		"self connection":   NewConnectionBuilder().Peer("iface-a", "node-a").Peer("iface-a", "node-a"),
+		"invalid keepalive": NewConnectionBuilder().Peer("iface-a", "node-a").Peer("iface-b", "node-b").Keepalive(-1),
+		"invalid CIDR":      NewConnectionBuilder().Peer("iface-a", "node-a").Peer("iface-b", "node-b").AllowBidirectional("10.0.0.0"),
+	}
+
+	for name, b := range builders {
+		if _, err := b.Build(); err == nil {
+			t.Fatalf("b.Build() failed, expected error for %s", name)
+		}
+	}
+}
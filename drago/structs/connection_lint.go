@@ -0,0 +1,220 @@
+package structs
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// connectionLinters contains the checks run by LintConnection. Each of them
+// returns a list of human-readable warnings, or an empty list if the check passes.
+var connectionLinters = []func(c *Connection) []string{
+	lintEmptyAllowedIPs,
+	lintMissingKeepaliveBehindNAT,
+	lintRedundantKeepalive,
+	lintAsymmetricRoutes,
+	lintPublicRoutesOverlappingPrivate,
+	lintMismatchedAddressFamilies,
+	lintSubsumedAllowedIPs,
+	lintKeepaliveOnLAN,
+}
+
+// LintConnection : runs advisory checks against a connection, returning a list
+// of warnings for configurations which are valid but most likely a mistake.
+// Contrary to Validate, these never prevent a connection from being stored.
+func LintConnection(c *Connection) []string {
+	return LintConnectionAt(c, time.Now())
+}
+
+// LintConnectionAt : same as LintConnection, but evaluating the checks
+// which depend on the current time against the one passed as argument.
+func LintConnectionAt(c *Connection, now time.Time) []string {
+	warnings := []string{}
+	for _, lint := range connectionLinters {
+		warnings = append(warnings, lint(c)...)
+	}
+	warnings = append(warnings, lintElapsedActiveWindow(c, now)...)
+	return warnings
+}
+
+// An enabled connection whose active window has elapsed is no longer
+// established, which is confusing to anyone inspecting it.
+func lintElapsedActiveWindow(c *Connection, now time.Time) []string {
+	if !c.IsEnabled() || c.ActiveUntil == nil || now.Before(*c.ActiveUntil) {
+		return nil
+	}
+	return []string{fmt.Sprintf("connection is enabled, but its active window elapsed at %s, so it should be disabled or the window updated",
+		c.ActiveUntil.Format(time.RFC3339))}
+}
+
+// A connection in which neither peer advertises any routes
+// establishes a tunnel which does not carry any traffic.
+func lintEmptyAllowedIPs(c *Connection) []string {
+	for _, peer := range c.PeerSettings {
+		if peer.RoutingRules != nil && len(peer.RoutingRules.AllowedIPs) > 0 {
+			return nil
+		}
+	}
+	return []string{"neither peer advertises any AllowedIPs, so the connection will not carry any traffic"}
+}
+
+// Peers behind a NAT must send keepalives, otherwise the mapping in the
+// NAT table expires, and the connection silently dies while idle.
+func lintMissingKeepaliveBehindNAT(c *Connection) []string {
+	warnings := []string{}
+	for _, peer := range c.PeerSettings {
+		if peer.IsBehindNAT() && !c.hasKeepalive(peer) {
+			warnings = append(warnings, fmt.Sprintf("interface %s is behind NAT, but has no persistent keepalive", peer.InterfaceID))
+		}
+	}
+	return warnings
+}
+
+// In a link between a public peer and one behind NAT, only the latter needs
+// to send keepalives for the NAT mapping to be kept open.
+func lintRedundantKeepalive(c *Connection) []string {
+	warnings := []string{}
+	for i, peer := range c.PeerSettings {
+		if len(c.PeerSettings) != 2 {
+			break
+		}
+		other := c.PeerSettings[1-i]
+		if !peer.IsBehindNAT() && other.IsBehindNAT() && c.hasKeepalive(peer) && c.hasKeepalive(other) {
+			warnings = append(warnings, fmt.Sprintf("interface %s is not behind NAT, so its persistent keepalive is redundant and can be removed", peer.InterfaceID))
+		}
+	}
+	return warnings
+}
+
+// Asymmetric routes are expected in hub-and-spoke topologies, but in
+// full-mesh ones they usually indicate an accidental one-directional link.
+func lintAsymmetricRoutes(c *Connection) []string {
+	if len(c.PeerSettings) != 2 || c.IsSymmetric() {
+		return nil
+	}
+	return []string{"peers advertise different AllowedIPs, so routing is asymmetric"}
+}
+
+// If a peer advertises a public range which overlaps the private subnets of
+// the other peer, traffic to internal hosts may be unintentionally routed
+// through the tunnel, or internal hosts unintentionally exposed.
+func lintPublicRoutesOverlappingPrivate(c *Connection) []string {
+
+	if len(c.PeerSettings) != 2 {
+		return nil
+	}
+
+	warnings := []string{}
+	for i, peer := range c.PeerSettings {
+		other := c.PeerSettings[1-i]
+		if peer.RoutingRules == nil || other.RoutingRules == nil {
+			continue
+		}
+
+		private := []*net.IPNet{}
+		for _, route := range other.RoutingRules.AllowedIPs {
+			if _, n, err := net.ParseCIDR(route); err == nil && isPrivateCIDR(n) {
+				private = append(private, n)
+			}
+		}
+
+		for _, route := range peer.RoutingRules.AllowedIPs {
+			_, n, err := net.ParseCIDR(route)
+			if err != nil || isPrivateCIDR(n) {
+				continue
+			}
+			for _, p := range private {
+				if cidrsOverlap(n, p) {
+					warnings = append(warnings, fmt.Sprintf("interface %s advertises public range %s, which overlaps private subnet %s of interface %s",
+						peer.InterfaceID, route, p, other.InterfaceID))
+				}
+			}
+		}
+	}
+
+	return warnings
+}
+
+// If one of the peers routes an address family the other one doesn't,
+// traffic of that family can be sent through the tunnel in one direction,
+// but replies have no route back.
+func lintMismatchedAddressFamilies(c *Connection) []string {
+
+	if len(c.PeerSettings) != 2 {
+		return nil
+	}
+
+	families := make([]map[string]struct{}, 2)
+	for i, peer := range c.PeerSettings {
+		families[i] = map[string]struct{}{}
+		for _, n := range peerRoutes(peer) {
+			families[i][cidrAddressFamily(n)] = struct{}{}
+		}
+		if len(families[i]) == 0 {
+			return nil
+		}
+	}
+
+	warnings := []string{}
+	for i, peer := range c.PeerSettings {
+		other := c.PeerSettings[1-i]
+		for _, family := range []string{AddressFamilyIPv4, AddressFamilyIPv6} {
+			_, a := families[i][family]
+			_, b := families[1-i][family]
+			if a && !b {
+				warnings = append(warnings, fmt.Sprintf("interface %s routes %s traffic, but interface %s doesn't",
+					peer.InterfaceID, family, other.InterfaceID))
+			}
+		}
+	}
+
+	return warnings
+}
+
+// Peers on the same LAN reach each other directly, without any NAT
+// mappings to be kept open, so keepalives are pure overhead.
+func lintKeepaliveOnLAN(c *Connection) []string {
+	if !c.sharesLAN() {
+		return nil
+	}
+	warnings := []string{}
+	for _, peer := range c.PeerSettings {
+		if c.hasKeepalive(peer) {
+			warnings = append(warnings, fmt.Sprintf("interface %s shares a LAN with its peer, so its persistent keepalive is redundant and can be removed", peer.InterfaceID))
+		}
+	}
+	return warnings
+}
+
+// A route fully contained in another one advertised by the same peer has
+// no effect, and usually is a leftover from a change to the wider range.
+func lintSubsumedAllowedIPs(c *Connection) []string {
+
+	warnings := []string{}
+	for _, peer := range c.PeerSettings {
+		if peer.RoutingRules == nil {
+			continue
+		}
+
+		routes := map[string]*net.IPNet{}
+		for _, route := range peer.RoutingRules.AllowedIPs {
+			if _, n, err := net.ParseCIDR(route); err == nil {
+				routes[route] = n
+			}
+		}
+
+		for _, inner := range peer.RoutingRules.AllowedIPs {
+			for _, outer := range peer.RoutingRules.AllowedIPs {
+				ni, no := routes[inner], routes[outer]
+				if ni == nil || no == nil || ni.String() == no.String() || !cidrContains(no, ni) {
+					continue
+				}
+				warnings = append(warnings, fmt.Sprintf("interface %s advertises %s, which is contained in %s and can be removed",
+					peer.InterfaceID, inner, outer))
+				break
+			}
+		}
+	}
+
+	return warnings
+}
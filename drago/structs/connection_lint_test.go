@@ -0,0 +1,217 @@
+package structs
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// countWarnings returns how many of the warnings contain the substring passed as argument.
+func countWarnings(warnings []string, substr string) int {
+	n := 0
+	for _, w := range warnings {
+		if strings.Contains(w, substr) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLintConnectionEmptyAllowedIPs(t *testing.T) {
+
+	const warning = "neither peer advertises any AllowedIPs"
+
+	// Both populated
+	c := newTestConnection()
+	if w := LintConnection(c); countWarnings(w, warning) != 0 {
+		t.Fatalf("LintConnection() failed, expected no warnings, have %v", w)
+	}
+
+	// One empty
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{}
+	if w := LintConnection(c); countWarnings(w, warning) != 0 {
+		t.Fatalf("LintConnection() failed, expected no warnings, have %v", w)
+	}
+
+	// Both empty
+	c.PeerSettings[1].RoutingRules.AllowedIPs = []string{}
+	if w := LintConnection(c); countWarnings(w, warning) != 1 {
+		t.Fatalf("LintConnection() failed, expected %d warning, have %v", 1, w)
+	}
+}
+
+func TestLintConnectionAsymmetricRoutes(t *testing.T) {
+
+	const warning = "routing is asymmetric"
+
+	c := newTestConnection()
+	if w := LintConnection(c); countWarnings(w, warning) != 1 {
+		t.Fatalf("LintConnection() failed, expected %d warning, have %v", 1, w)
+	}
+
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.0/24"}
+	c.PeerSettings[1].RoutingRules.AllowedIPs = []string{"10.0.0.0/24"}
+	if w := LintConnection(c); countWarnings(w, warning) != 0 {
+		t.Fatalf("LintConnection() failed, expected no warnings, have %v", w)
+	}
+}
+
+func TestLintConnectionPublicRoutesOverlappingPrivate(t *testing.T) {
+
+	const warning = "overlaps private subnet"
+
+	// Clean configuration
+	c := newTestConnection()
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.0/24", "203.0.113.0/24"}
+	c.PeerSettings[1].RoutingRules.AllowedIPs = []string{"192.168.1.0/24"}
+	if w := LintConnection(c); countWarnings(w, warning) != 0 {
+		t.Fatalf("LintConnection() failed, expected no warnings, have %v", w)
+	}
+
+	// Public range covering the other peer's private subnet
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.0/24", "192.0.0.0/2"}
+	if w := LintConnection(c); countWarnings(w, warning) != 1 {
+		t.Fatalf("LintConnection() failed, expected %d warning, have %v", 1, w)
+	}
+}
+
+func TestLintConnectionMismatchedAddressFamilies(t *testing.T) {
+
+	const warning = "traffic, but interface"
+
+	// Both IPv4
+	c := newTestConnection()
+	if w := LintConnection(c); countWarnings(w, warning) != 0 {
+		t.Fatalf("LintConnection() failed, expected no warnings, have %v", w)
+	}
+
+	// Both dual-stack
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.1/32", "fd00::1/128"}
+	c.PeerSettings[1].RoutingRules.AllowedIPs = []string{"10.0.0.2/32", "fd00::2/128"}
+	if w := LintConnection(c); countWarnings(w, warning) != 0 {
+		t.Fatalf("LintConnection() failed, expected no warnings, have %v", w)
+	}
+
+	// One peer with an extra family
+	c.PeerSettings[1].RoutingRules.AllowedIPs = []string{"10.0.0.2/32"}
+	w := LintConnection(c)
+	if countWarnings(w, "interface iface-a routes ipv6 traffic, but interface iface-b doesn't") != 1 {
+		t.Fatalf("LintConnection() failed, expected %d warning, have %v", 1, w)
+	}
+	if countWarnings(w, warning) != 1 {
+		t.Fatalf("LintConnection() failed, expected %d warning, have %v", 1, w)
+	}
+}
+
+func TestLintConnectionRedundantKeepalive(t *testing.T) {
+
+	const warning = "keepalive is redundant"
+
+	c := newTestConnection()
+	c.PeerSettings[1].BehindNAT = boolPtr(true)
+
+	// Keepalive on both peers
+	c.PeerSettings[0].PersistentKeepalive = intPtr(25)
+	c.PeerSettings[1].PersistentKeepalive = intPtr(25)
+	if w := LintConnection(c); countWarnings(w, "interface iface-a is not behind NAT, so its persistent "+warning) != 1 {
+		t.Fatalf("LintConnection() failed, expected %d warning, have %v", 1, w)
+	}
+
+	// Keepalive on the NAT side only
+	c.PeerSettings[0].PersistentKeepalive = nil
+	if w := LintConnection(c); countWarnings(w, warning) != 0 || countWarnings(w, "keepalive") != 0 {
+		t.Fatalf("LintConnection() failed, expected no warnings, have %v", w)
+	}
+
+	// Keepalive on the public side only
+	c.PeerSettings[0].PersistentKeepalive = intPtr(25)
+	c.PeerSettings[1].PersistentKeepalive = nil
+	w := LintConnection(c)
+	if countWarnings(w, warning) != 0 || countWarnings(w, "interface iface-b is behind NAT, but has no persistent keepalive") != 1 {
+		t.Fatalf("LintConnection() failed, expected missing keepalive warning, have %v", w)
+	}
+}
+
+func TestLintConnectionSubsumedAllowedIPs(t *testing.T) {
+
+	const warning = "can be removed"
+
+	// Disjoint routes
+	c := newTestConnection()
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.0/24", "10.1.0.0/16"}
+	if w := LintConnection(c); countWarnings(w, warning) != 0 {
+		t.Fatalf("LintConnection() failed, expected no warnings, have %v", w)
+	}
+
+	// Route contained in a supernet advertised by the same peer
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.0/24", "10.0.0.0/8"}
+	w := LintConnection(c)
+	if countWarnings(w, warning) != 1 || countWarnings(w, "10.0.0.0/24, which is contained in 10.0.0.0/8") != 1 {
+		t.Fatalf("LintConnection() failed, expected %d warning, have %v", 1, w)
+	}
+}
+
+func TestLintConnectionElapsedActiveWindow(t *testing.T) {
+
+	const warning = "active window elapsed"
+
+	now := time.Date(2020, 5, 4, 12, 0, 0, 0, time.UTC)
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+
+	c := newTestConnection()
+	c.ActiveUntil = &future
+	if w := LintConnectionAt(c, now); countWarnings(w, warning) != 0 {
+		t.Fatalf("LintConnectionAt() failed, expected no warnings, have %v", w)
+	}
+
+	c.ActiveUntil = &past
+	if w := LintConnectionAt(c, now); countWarnings(w, warning) != 1 {
+		t.Fatalf("LintConnectionAt() failed, expected %d warning, have %v", 1, w)
+	}
+
+	c.Enabled = boolPtr(false)
+	if w := LintConnectionAt(c, now); countWarnings(w, warning) != 0 {
+		t.Fatalf("LintConnectionAt() failed, expected no warnings for disabled connection, have %v", w)
+	}
+}
+
+func TestLintConnectionKeepaliveOnLAN(t *testing.T) {
+
+	const warning = "shares a LAN"
+
+	opts := &ConnectionValidationOptions{RejectKeepaliveOnLAN: true}
+
+	// Peers on the same LAN
+	c := newTestConnection()
+	c.PersistentKeepalive = intPtr(25)
+	c.PeerSettings[0].Endpoint = strPtr("192.168.1.10:51820")
+	c.PeerSettings[1].Endpoint = strPtr("192.168.1.20:51820")
+	if w := LintConnection(c); countWarnings(w, warning) != 2 {
+		t.Fatalf("LintConnection() failed, expected %d warnings, have %v", 2, w)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+	}
+	if err := c.ValidateWithOptions(opts); err == nil || !strings.Contains(err.Error(), warning) {
+		t.Fatalf("c.ValidateWithOptions() failed, expected error for keepalive on LAN, have %v", err)
+	}
+
+	// Peers on a wider LAN, advertised as a route
+	c.PeerSettings[1].Endpoint = strPtr("192.168.7.20:51820")
+	c.PeerSettings[1].RoutingRules.AllowedIPs = []string{"10.0.0.2/32", "192.168.0.0/16"}
+	if err := c.ValidateWithOptions(opts); err == nil {
+		t.Fatalf("c.ValidateWithOptions() failed, expected error for keepalive on LAN")
+	}
+
+	// Peers connected over the internet
+	c = newTestConnection()
+	c.PersistentKeepalive = intPtr(25)
+	c.PeerSettings[0].Endpoint = strPtr("192.168.1.10:51820")
+	c.PeerSettings[1].Endpoint = strPtr("203.0.113.10:51820")
+	if w := LintConnection(c); countWarnings(w, warning) != 0 {
+		t.Fatalf("LintConnection() failed, expected no warnings, have %v", w)
+	}
+	if err := c.ValidateWithOptions(opts); err != nil {
+		t.Fatalf("c.ValidateWithOptions() failed, unexpected error: %v", err)
+	}
+}
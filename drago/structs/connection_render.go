@@ -0,0 +1,384 @@
+package structs
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RenderOptions : contains the interface-level settings and the callbacks
+// needed for rendering a WireGuard configuration from a set of connections.
+type RenderOptions struct {
+	PrivateKey string
+	Address    string
+	ListenPort *int
+
+	// PublicKeyResolver returns the public key of an interface.
+	PublicKeyResolver func(interfaceID string) (string, error)
+
+	// PresharedKeyResolver returns the preshared key referenced by a connection.
+	PresharedKeyResolver func(ref string) (string, error)
+}
+
+// renderedPeer accumulates the settings of a [Peer] section,
+// merged across all connections to the same remote interface.
+type renderedPeer struct {
+	interfaceID     string
+	presharedKeyRef *string
+	allowedIPs      []string
+	endpoint        *string
+	keepalive       *int
+}
+
+// RenderInterfaceConfig : renders the WireGuard configuration of an interface, with
+// an [Interface] section followed by one [Peer] section per remote interface. If more
+// than one connection leads to the same remote interface, their AllowedIPs are merged.
+// Following the agent semantics, the AllowedIPs of a [Peer] are the ones configured
+// in the settings of the local interface.
+func RenderInterfaceConfig(interfaceID string, conns []*Connection, opts RenderOptions) (string, error) {
+
+	if opts.PublicKeyResolver == nil {
+		return "", errors.New("missing public key resolver")
+	}
+
+	peers := map[string]*renderedPeer{}
+	dns := []string{}
+	var table, fwmark *int
+
+	for _, c := range conns {
+
+		local := c.PeerSettingsByInterfaceID(interfaceID)
+		remote := c.OtherPeerSettingsByInterfaceID(interfaceID)
+		if local == nil || remote == nil {
+			return "", fmt.Errorf("interface %s is not part of connection %s", interfaceID, c.ID)
+		}
+
+		p, ok := peers[remote.InterfaceID]
+		if !ok {
+			p = &renderedPeer{interfaceID: remote.InterfaceID}
+			peers[remote.InterfaceID] = p
+		}
+
+		if c.PresharedKeyRef != nil {
+			if p.presharedKeyRef != nil && *p.presharedKeyRef != *c.PresharedKeyRef {
+				return "", fmt.Errorf("conflicting preshared keys for interface %s", remote.InterfaceID)
+			}
+			p.presharedKeyRef = c.PresharedKeyRef
+		}
+		if local.RoutingRules != nil {
+			p.allowedIPs = append(p.allowedIPs, local.RoutingRules.AllowedIPs...)
+		}
+		// Clients always dial, so they are never dialed back
+		if p.endpoint == nil && !remote.IsClient() {
+			p.endpoint = remote.PrimaryEndpoint()
+		}
+		if p.keepalive == nil {
+			p.keepalive = c.PersistentKeepaliveByInterfaceID(interfaceID)
+		}
+
+		// Routing tables and firewall marks apply to the whole interface
+		if c.Table != nil {
+			if table != nil && *table != *c.Table {
+				return "", fmt.Errorf("conflicting routing tables for interface %s", interfaceID)
+			}
+			table = c.Table
+		}
+		if c.FwMark != nil {
+			if fwmark != nil && *fwmark != *c.FwMark {
+				return "", fmt.Errorf("conflicting firewall marks for interface %s", interfaceID)
+			}
+			fwmark = c.FwMark
+		}
+
+		dns = append(dns, local.DNS...)
+		dns = append(dns, local.SearchDomains...)
+	}
+
+	b := &strings.Builder{}
+
+	fmt.Fprintf(b, "[Interface]\n")
+	fmt.Fprintf(b, "PrivateKey = %s\n", opts.PrivateKey)
+	if opts.Address != "" {
+		fmt.Fprintf(b, "Address = %s\n", opts.Address)
+	}
+	if opts.ListenPort != nil {
+		fmt.Fprintf(b, "ListenPort = %d\n", *opts.ListenPort)
+	}
+	if table != nil {
+		if *table == ConnectionTableOff {
+			fmt.Fprintf(b, "Table = off\n")
+		} else {
+			fmt.Fprintf(b, "Table = %d\n", *table)
+		}
+	}
+	if fwmark != nil {
+		fmt.Fprintf(b, "FwMark = %d\n", *fwmark)
+	}
+	if len(dns) > 0 {
+		fmt.Fprintf(b, "DNS = %s\n", strings.Join(unionStrings(dns), ", "))
+	}
+
+	ids := []string{}
+	for id := range peers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		p := peers[id]
+
+		publicKey, err := opts.PublicKeyResolver(id)
+		if err != nil {
+			return "", fmt.Errorf("could not resolve public key of interface %s: %v", id, err)
+		}
+
+		fmt.Fprintf(b, "\n[Peer]\n")
+		fmt.Fprintf(b, "PublicKey = %s\n", publicKey)
+
+		if p.presharedKeyRef != nil {
+			if opts.PresharedKeyResolver == nil {
+				return "", errors.New("missing preshared key resolver")
+			}
+			psk, err := opts.PresharedKeyResolver(*p.presharedKeyRef)
+			if err != nil {
+				return "", fmt.Errorf("could not resolve preshared key %s: %v", *p.presharedKeyRef, err)
+			}
+			fmt.Fprintf(b, "PresharedKey = %s\n", psk)
+		}
+
+		if routes := normalizedCIDRSet(p.allowedIPs); len(routes) > 0 {
+			fmt.Fprintf(b, "AllowedIPs = %s\n", strings.Join(routes, ", "))
+		}
+		if p.endpoint != nil {
+			fmt.Fprintf(b, "Endpoint = %s\n", *p.endpoint)
+		}
+		if p.keepalive != nil && *p.keepalive > 0 {
+			fmt.Fprintf(b, "PersistentKeepalive = %d\n", *p.keepalive)
+		}
+	}
+
+	return b.String(), nil
+}
+
+// AllowedIPDelta : computes the changes to the AllowedIPs of the [Peer] at the far end
+// of a connection, as configured on the interface passed as argument, when the connection
+// is updated from old to new. Either of them can be nil, for connections being created
+// or removed. Routes are compared in their canonical form, and returned sorted.
+func AllowedIPDelta(old, new *Connection, interfaceID string) ([]string, []string, error) {
+
+	routes := func(c *Connection) ([]string, string, error) {
+		if c == nil {
+			return []string{}, "", nil
+		}
+		local := c.PeerSettingsByInterfaceID(interfaceID)
+		if local == nil {
+			return nil, "", fmt.Errorf("interface %s is not part of connection %s", interfaceID, c.ID)
+		}
+		res := []string{}
+		if local.RoutingRules != nil {
+			res = normalizedCIDRSet(local.RoutingRules.AllowedIPs)
+		}
+		return res, c.OtherPeerSettingsByInterfaceID(interfaceID).InterfaceID, nil
+	}
+
+	before, oldPeer, err := routes(old)
+	if err != nil {
+		return nil, nil, err
+	}
+	after, newPeer, err := routes(new)
+	if err != nil {
+		return nil, nil, err
+	}
+	if oldPeer != "" && newPeer != "" && oldPeer != newPeer {
+		return nil, nil, fmt.Errorf("far peer changed from interface %s to %s", oldPeer, newPeer)
+	}
+
+	return subtractStrings(after, before), subtractStrings(before, after), nil
+}
+
+// subtractStrings returns the elements of a which are not in b, preserving their order.
+func subtractStrings(a, b []string) []string {
+	exclude := map[string]struct{}{}
+	for _, s := range b {
+		exclude[s] = struct{}{}
+	}
+	res := []string{}
+	for _, s := range a {
+		if _, ok := exclude[s]; !ok {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// Length of base64-encoded WireGuard keys.
+const wireguardKeyLength = 44
+
+// EstimateConfigSize : estimates the size, in bytes, of the [Peer] sections rendered
+// by RenderInterfaceConfig for an interface, without resolving any keys, so that
+// pathologically large configurations can be detected before being committed.
+// Connections the interface is not part of are ignored.
+func EstimateConfigSize(conns []*Connection, interfaceID string) int {
+
+	type estimatedPeer struct {
+		psk       bool
+		routes    []string
+		endpoint  *string
+		keepalive *int
+	}
+
+	peers := map[string]*estimatedPeer{}
+	for _, c := range conns {
+		local := c.PeerSettingsByInterfaceID(interfaceID)
+		remote := c.OtherPeerSettingsByInterfaceID(interfaceID)
+		if local == nil || remote == nil {
+			continue
+		}
+		p, ok := peers[remote.InterfaceID]
+		if !ok {
+			p = &estimatedPeer{}
+			peers[remote.InterfaceID] = p
+		}
+		p.psk = p.psk || c.PresharedKeyRef != nil
+		if local.RoutingRules != nil {
+			p.routes = append(p.routes, local.RoutingRules.AllowedIPs...)
+		}
+		if p.endpoint == nil {
+			p.endpoint = remote.PrimaryEndpoint()
+		}
+		if p.keepalive == nil {
+			p.keepalive = c.PersistentKeepaliveByInterfaceID(interfaceID)
+		}
+	}
+
+	size := 0
+	for _, p := range peers {
+		size += len("\n[Peer]\n")
+		size += len("PublicKey = \n") + wireguardKeyLength
+		if p.psk {
+			size += len("PresharedKey = \n") + wireguardKeyLength
+		}
+		if routes := normalizedCIDRSet(p.routes); len(routes) > 0 {
+			size += len("AllowedIPs = \n") + len(strings.Join(routes, ", "))
+		}
+		if p.endpoint != nil {
+			size += len("Endpoint = \n") + len(*p.endpoint)
+		}
+		if p.keepalive != nil && *p.keepalive > 0 {
+			size += len("PersistentKeepalive = \n") + len(strconv.Itoa(*p.keepalive))
+		}
+	}
+
+	return size
+}
+
+// RenderDOT : renders a set of connections as a Graphviz digraph, with one vertex per
+// node, labeled by its name in nodeNames if present, or by its ID otherwise, and one
+// edge per connection, labeled by its ID so that parallel edges can be told apart.
+// Connections which are inactive or expired at the time passed as argument, which agents
+// no longer set up, are drawn with dashed lines.
+func RenderDOT(conns []*Connection, nodeNames map[string]string, now time.Time) string {
+
+	endpointID := func(peer *PeerSettings) string {
+		if peer.NodeID != "" {
+			return peer.NodeID
+		}
+		return peer.InterfaceID
+	}
+
+	sorted := []*Connection{}
+	nodes := map[string]struct{}{}
+	for _, c := range conns {
+		if len(c.PeerSettings) != 2 {
+			continue
+		}
+		sorted = append(sorted, c)
+		for _, peer := range c.PeerSettings {
+			nodes[endpointID(peer)] = struct{}{}
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	ids := []string{}
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "digraph drago {\n")
+
+	for _, id := range ids {
+		label := id
+		if name, ok := nodeNames[id]; ok && name != "" {
+			label = name
+		}
+		fmt.Fprintf(b, "  %s [label=%s];\n", strconv.Quote(id), strconv.Quote(label))
+	}
+
+	for _, c := range sorted {
+		attrs := fmt.Sprintf("key=%s, label=%s, dir=both", strconv.Quote(c.ID), strconv.Quote(c.ID))
+		if !c.IsActive(now) || c.IsExpired(now) {
+			attrs += ", style=dashed"
+		}
+		fmt.Fprintf(b, "  %s -> %s [%s];\n",
+			strconv.Quote(endpointID(c.PeerSettings[0])), strconv.Quote(endpointID(c.PeerSettings[1])), attrs)
+	}
+
+	fmt.Fprintf(b, "}\n")
+
+	return b.String()
+}
+
+// connectionCSVHeader contains the columns written by ExportCSV.
+var connectionCSVHeader = []string{
+	"id", "network_id",
+	"interface_a", "node_a", "allowed_ips_a",
+	"interface_b", "node_b", "allowed_ips_b",
+	"persistent_keepalive", "created_at", "updated_at",
+}
+
+// ExportCSV : writes a set of connections as CSV, with a header row followed by one row
+// per connection. The AllowedIPs of each peer are joined by semicolons, timestamps are
+// formatted as RFC3339, and unset values are left empty.
+func ExportCSV(stubs []*ConnectionListStub, w io.Writer) error {
+
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write(connectionCSVHeader); err != nil {
+		return err
+	}
+
+	for _, stub := range stubs {
+		if len(stub.PeerSettings) != 2 {
+			return fmt.Errorf("can't export connection %s: expected 2 peers, have %d", stub.ID, len(stub.PeerSettings))
+		}
+
+		row := []string{stub.ID, stub.NetworkID}
+		for _, peer := range stub.PeerSettings {
+			routes := []string{}
+			if peer.RoutingRules != nil {
+				routes = sortedCIDRs(peer.RoutingRules.AllowedIPs)
+			}
+			row = append(row, peer.InterfaceID, peer.NodeID, strings.Join(routes, ";"))
+		}
+
+		keepalive := ""
+		if stub.PersistentKeepalive != nil {
+			keepalive = strconv.Itoa(*stub.PersistentKeepalive)
+		}
+		row = append(row, keepalive, stub.CreatedAt.Format(time.RFC3339), stub.UpdatedAt.Format(time.RFC3339))
+
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,295 @@
+package structs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRenderConnections() []*Connection {
+
+	// Hub connected to a NAT-ed spoke, keeping the tunnel alive from the hub side
+	a := newTestConnection()
+	a.PeerSettings[0].InterfaceID = "iface-hub"
+	a.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.2/32", "192.168.2.0/24"}
+	a.PeerSettings[0].DNS = []string{"10.0.0.53"}
+	a.PeerSettings[0].SearchDomains = []string{"corp.example.com"}
+	a.PeerSettings[0].PersistentKeepalive = intPtr(25)
+	a.PeerSettings[1].InterfaceID = "iface-nat"
+	a.PeerSettings[1].BehindNAT = boolPtr(true)
+	a.PresharedKeyRef = strPtr("psk/nat")
+	a.Table = intPtr(100)
+	a.FwMark = intPtr(51820)
+
+	// Hub connected to a public peer, with a static endpoint
+	b := newTestConnection()
+	b.PeerSettings[0].InterfaceID = "iface-public"
+	b.PeerSettings[0].Endpoints = []string{"203.0.113.10:51820", "198.51.100.10:51820"}
+	b.PeerSettings[1].InterfaceID = "iface-hub"
+	b.PeerSettings[1].RoutingRules.AllowedIPs = []string{"10.0.0.3/32"}
+	b.PeerSettings[1].DNS = []string{"10.0.0.53"}
+
+	// Duplicate connection to the public peer, whose routes are merged
+	c := newTestConnection()
+	c.PeerSettings[0].InterfaceID = "iface-hub"
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.3/32", "172.16.0.0/16"}
+	c.PeerSettings[1].InterfaceID = "iface-public"
+
+	return []*Connection{a, b, c}
+}
+
+func TestRenderInterfaceConfig(t *testing.T) {
+
+	opts := RenderOptions{
+		PrivateKey: "hub-private-key",
+		Address:    "10.0.0.1/24",
+		ListenPort: intPtr(51820),
+		PublicKeyResolver: func(id string) (string, error) {
+			return id + "-public-key", nil
+		},
+		PresharedKeyResolver: func(ref string) (string, error) {
+			return ref + "-secret", nil
+		},
+	}
+
+	res, err := RenderInterfaceConfig("iface-hub", newTestRenderConnections(), opts)
+	if err != nil {
+		t.Fatalf("RenderInterfaceConfig() failed, unexpected error: %v", err)
+	}
+
+	golden, err := ioutil.ReadFile(filepath.Join("testdata", "render_interface_config.golden"))
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile() failed, unexpected error: %v", err)
+	}
+
+	if res != string(golden) {
+		t.Fatalf("RenderInterfaceConfig() failed, expected:\n%s\nhave:\n%s", golden, res)
+	}
+}
+
+func TestRenderInterfaceConfigRoles(t *testing.T) {
+
+	conns := newTestRenderConnections()[1:2]
+	conns[0].PeerSettings[0].Role = PeerRoleClient
+	conns[0].PeerSettings[1].Role = PeerRoleServer
+
+	opts := RenderOptions{
+		PublicKeyResolver: func(id string) (string, error) { return id, nil },
+	}
+
+	res, err := RenderInterfaceConfig("iface-hub", conns, opts)
+	if err != nil {
+		t.Fatalf("RenderInterfaceConfig() failed, unexpected error: %v", err)
+	}
+	if strings.Contains(res, "Endpoint") {
+		t.Fatalf("RenderInterfaceConfig() failed, expected no endpoint for client peer, have:\n%s", res)
+	}
+}
+
+func TestRenderInterfaceConfigErrors(t *testing.T) {
+
+	conns := newTestRenderConnections()
+
+	opts := RenderOptions{
+		PublicKeyResolver: func(id string) (string, error) {
+			return "", fmt.Errorf("unknown interface %s", id)
+		},
+	}
+	if _, err := RenderInterfaceConfig("iface-hub", conns, opts); err == nil {
+		t.Fatalf("RenderInterfaceConfig() failed, expected error for unresolvable public key")
+	}
+
+	opts.PublicKeyResolver = func(id string) (string, error) { return id, nil }
+	if _, err := RenderInterfaceConfig("iface-hub", conns, opts); err == nil {
+		t.Fatalf("RenderInterfaceConfig() failed, expected error for missing preshared key resolver")
+	}
+
+	conns[1].Table = intPtr(ConnectionTableOff)
+	opts.PresharedKeyResolver = func(ref string) (string, error) { return ref, nil }
+	if _, err := RenderInterfaceConfig("iface-hub", conns, opts); err == nil {
+		t.Fatalf("RenderInterfaceConfig() failed, expected error for conflicting routing tables")
+	}
+
+	conns[1].Table = nil
+	conns[1].FwMark = intPtr(1)
+	if _, err := RenderInterfaceConfig("iface-hub", conns, opts); err == nil {
+		t.Fatalf("RenderInterfaceConfig() failed, expected error for conflicting firewall marks")
+	}
+
+	if _, err := RenderInterfaceConfig("iface-unknown", conns, opts); err == nil {
+		t.Fatalf("RenderInterfaceConfig() failed, expected error for unknown interface")
+	}
+}
+
+func TestAllowedIPDelta(t *testing.T) {
+
+	old := newTestConnection()
+	old.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.2/32", "192.168.1.0/24"}
+
+	tests := []struct {
+		routes  []string
+		added   []string
+		removed []string
+	}{
+		{[]string{"192.168.1.0/24", "10.0.0.2/32", "172.16.0.0/16"}, []string{"172.16.0.0/16"}, []string{}},
+		{[]string{"10.0.0.2/32"}, []string{}, []string{"192.168.1.0/24"}},
+		{[]string{"10.0.0.2/32", "192.168.2.0/24"}, []string{"192.168.2.0/24"}, []string{"192.168.1.0/24"}},
+		{[]string{"192.168.1.1/24", "10.0.0.2/32"}, []string{}, []string{}},
+	}
+
+	for _, test := range tests {
+		new := old.Clone()
+		new.PeerSettings[0].RoutingRules.AllowedIPs = test.routes
+
+		added, removed, err := AllowedIPDelta(old, new, "iface-a")
+		if err != nil {
+			t.Fatalf("AllowedIPDelta() failed, unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(added, test.added) || !reflect.DeepEqual(removed, test.removed) {
+			t.Fatalf("AllowedIPDelta() failed, expected +%v -%v, have +%v -%v", test.added, test.removed, added, removed)
+		}
+	}
+
+	// New connection
+	added, removed, err := AllowedIPDelta(nil, old, "iface-a")
+	if err != nil || !reflect.DeepEqual(added, []string{"10.0.0.2/32", "192.168.1.0/24"}) || len(removed) != 0 {
+		t.Fatalf("AllowedIPDelta() failed, expected all routes added, have +%v -%v (%v)", added, removed, err)
+	}
+
+	if _, _, err := AllowedIPDelta(old, old, "iface-unknown"); err == nil {
+		t.Fatalf("AllowedIPDelta() failed, expected error for unknown interface")
+	}
+}
+
+func TestRenderDOT(t *testing.T) {
+
+	a := newTestConnection()
+	a.ID = "conn-1"
+
+	// Parallel link between the same nodes, which is disabled
+	b := newTestConnection()
+	b.ID = "conn-2"
+	b.PeerSettings[0].InterfaceID = "iface-c"
+	b.Enabled = boolPtr(false)
+
+	// Expiration is relative to the time passed, instead of the current time
+	now := time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC)
+	notYet, expired := now.Add(time.Hour), now.Add(-time.Hour)
+
+	c := newTestConnection()
+	c.ID = "conn-3"
+	c.PeerSettings[0].NodeID = "node-c"
+	c.ExpireAt = &notYet
+
+	d := newTestConnection()
+	d.ID = "conn-4"
+	d.PeerSettings[0].InterfaceID = "iface-d"
+	d.ExpireAt = &expired
+
+	// Active window which has elapsed
+	e := newTestConnection()
+	e.ID = "conn-5"
+	e.PeerSettings[0].InterfaceID = "iface-e"
+	e.ActiveUntil = &expired
+
+	res := RenderDOT([]*Connection{e, d, c, b, a}, map[string]string{"node-a": "Gateway", "node-b": "Database"}, now)
+
+	golden, err := ioutil.ReadFile(filepath.Join("testdata", "render_dot.golden"))
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile() failed, unexpected error: %v", err)
+	}
+
+	if res != string(golden) {
+		t.Fatalf("RenderDOT() failed, expected:\n%s\nhave:\n%s", golden, res)
+	}
+}
+
+func TestEstimateConfigSize(t *testing.T) {
+
+	key := strings.Repeat("k", wireguardKeyLength)
+	opts := RenderOptions{
+		PrivateKey:           key,
+		PublicKeyResolver:    func(string) (string, error) { return key, nil },
+		PresharedKeyResolver: func(string) (string, error) { return key, nil },
+	}
+
+	// Hub with many spokes, each routing a number of subnets
+	hub := []*Connection{}
+	for i := 0; i < 50; i++ {
+		c := newTestConnection()
+		c.PeerSettings[0].InterfaceID = "iface-hub"
+		c.PeerSettings[1].InterfaceID = fmt.Sprintf("iface-%d", i)
+		c.PeerSettings[1].Endpoint = strPtr(fmt.Sprintf("203.0.113.%d:51820", i))
+		c.PeerSettings[0].RoutingRules.AllowedIPs = []string{}
+		for j := 0; j < i%8; j++ {
+			c.PeerSettings[0].RoutingRules.AllowedIPs = append(c.PeerSettings[0].RoutingRules.AllowedIPs, fmt.Sprintf("10.%d.%d.0/24", i, j))
+		}
+		hub = append(hub, c)
+	}
+
+	topologies := map[string][]*Connection{
+		"render fixture": newTestRenderConnections(),
+		"hub and spoke":  hub,
+		"single link":    {newTestConnection()},
+	}
+
+	for name, conns := range topologies {
+
+		iface := conns[0].PeerSettings[0].InterfaceID
+
+		res, err := RenderInterfaceConfig(iface, conns, opts)
+		if err != nil {
+			t.Fatalf("RenderInterfaceConfig() failed, unexpected error: %v", err)
+		}
+		actual := len(res) - strings.Index(res, "\n[Peer]")
+
+		estimate := EstimateConfigSize(conns, iface)
+		if diff := estimate - actual; diff*10 > actual || diff*10 < -actual {
+			t.Fatalf("EstimateConfigSize() failed for %s, expected approximately %d bytes, have %d", name, actual, estimate)
+		}
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+
+	at := time.Date(2020, 5, 4, 12, 30, 0, 0, time.UTC)
+
+	a := newTestConnection()
+	a.ID = "conn-a"
+	a.NetworkID = "lab, east"
+	a.PersistentKeepalive = intPtr(25)
+	a.PeerSettings[0].RoutingRules.AllowedIPs = []string{"192.168.1.0/24", "10.0.0.1/32"}
+	a.CreatedAt, a.UpdatedAt = at, at.Add(time.Hour)
+
+	b := newTestConnection()
+	b.ID = "conn-b"
+	b.CreatedAt, b.UpdatedAt = at, at
+
+	stubs := []*ConnectionListStub{}
+	for _, c := range []*Connection{a, b} {
+		stub, err := c.Stub()
+		if err != nil {
+			t.Fatalf("c.Stub() failed, unexpected error: %v", err)
+		}
+		stubs = append(stubs, stub)
+	}
+
+	buf := &strings.Builder{}
+	if err := ExportCSV(stubs, buf); err != nil {
+		t.Fatalf("ExportCSV() failed, unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"id,network_id,interface_a,node_a,allowed_ips_a,interface_b,node_b,allowed_ips_b,persistent_keepalive,created_at,updated_at",
+		`conn-a,"lab, east",iface-a,node-a,10.0.0.1/32;192.168.1.0/24,iface-b,node-b,10.0.0.2/32,25,2020-05-04T12:30:00Z,2020-05-04T13:30:00Z`,
+		"conn-b,network-1,iface-a,node-a,10.0.0.1/32,iface-b,node-b,10.0.0.2/32,,2020-05-04T12:30:00Z,2020-05-04T12:30:00Z",
+		"",
+	}
+	if res := buf.String(); res != strings.Join(expected, "\n") {
+		t.Fatalf("ExportCSV() failed, expected:\n%s\nhave:\n%s", strings.Join(expected, "\n"), res)
+	}
+}
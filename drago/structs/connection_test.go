@@ -0,0 +1,1972 @@
+package structs
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// maxInt is the largest int, which is platform-dependent.
+const maxInt = int64(^uint(0) >> 1)
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func newTestConnection() *Connection {
+	c := NewConnection()
+	c.NetworkID = "network-1"
+	c.PeerSettings = []*PeerSettings{
+		{
+			NodeID:       "node-a",
+			InterfaceID:  "iface-a",
+			RoutingRules: &RoutingRules{AllowedIPs: []string{"10.0.0.1/32"}},
+		},
+		{
+			NodeID:       "node-b",
+			InterfaceID:  "iface-b",
+			RoutingRules: &RoutingRules{AllowedIPs: []string{"10.0.0.2/32"}},
+		},
+	}
+	return c
+}
+
+func mustMerge(t *testing.T, c, in *Connection) *Connection {
+	t.Helper()
+	res, err := c.Merge(in)
+	if err != nil {
+		t.Fatalf("c.Merge() failed, unexpected error: %v", err)
+	}
+	return res
+}
+
+func TestConnectionMergePeerCount(t *testing.T) {
+
+	in := newTestConnection()
+
+	res, err := (&Connection{ID: "conn-1"}).Merge(in)
+	if err != nil {
+		t.Fatalf("c.Merge() failed, unexpected error: %v", err)
+	}
+	if len(res.PeerSettings) != 2 || res.ID != "conn-1" {
+		t.Fatalf("c.Merge() failed, expected connection conn-1 with 2 peers, have %s with %d", res.ID, len(res.PeerSettings))
+	}
+
+	in.PeerSettings = append(in.PeerSettings, &PeerSettings{InterfaceID: "iface-c", NodeID: "node-c"})
+	if _, err := (&Connection{ID: "conn-1"}).Merge(in); err == nil {
+		t.Fatalf("c.Merge() failed, expected error for three peers")
+	}
+
+	if _, err := (&Connection{ID: "conn-1"}).Merge(&Connection{}); err == nil {
+		t.Fatalf("c.Merge() failed, expected error for missing peers")
+	}
+}
+
+func TestConnectionMerge(t *testing.T) {
+
+	c := newTestConnection()
+	c.Table = intPtr(100)
+	c.DSCP = intPtr(46)
+	c.FwMark = intPtr(51820)
+	c.Transport = TransportObfuscated
+	c.MTUProbeInterval = intPtr(600)
+	c.RekeyInterval = intPtr(60)
+	c.LogLevel = strPtr(ConnectionLogLevelDebug)
+	c.CipherSuite = strPtr(CipherSuiteAES256GCM)
+
+	// Fields which are unset in the input are preserved
+	unset := &Connection{PersistentKeepalive: intPtr(25)}
+
+	tests := []struct {
+		name     string
+		in       *Connection
+		field    func(*Connection) interface{}
+		expected interface{}
+	}{
+		{"unset table", unset, func(c *Connection) interface{} { return c.Table }, intPtr(100)},
+		{"set table", &Connection{Table: intPtr(ConnectionTableOff)}, func(c *Connection) interface{} { return c.Table }, intPtr(ConnectionTableOff)},
+		{"unset DSCP", unset, func(c *Connection) interface{} { return c.DSCP }, intPtr(46)},
+		{"set DSCP", &Connection{DSCP: intPtr(10)}, func(c *Connection) interface{} { return c.DSCP }, intPtr(10)},
+		{"unset firewall mark", unset, func(c *Connection) interface{} { return c.FwMark }, intPtr(51820)},
+		{"set firewall mark", &Connection{FwMark: intPtr(1)}, func(c *Connection) interface{} { return c.FwMark }, intPtr(1)},
+		{"unset transport", unset, func(c *Connection) interface{} { return c.Transport }, TransportObfuscated},
+		{"set transport", &Connection{Transport: TransportWireGuardOverTCP}, func(c *Connection) interface{} { return c.Transport }, TransportWireGuardOverTCP},
+		{"unset probe interval", unset, func(c *Connection) interface{} { return c.MTUProbeInterval }, intPtr(600)},
+		{"set probe interval", &Connection{MTUProbeInterval: intPtr(60)}, func(c *Connection) interface{} { return c.MTUProbeInterval }, intPtr(60)},
+		{"unset rekey interval", unset, func(c *Connection) interface{} { return c.RekeyInterval }, intPtr(60)},
+		{"set rekey interval", &Connection{RekeyInterval: intPtr(30)}, func(c *Connection) interface{} { return c.RekeyInterval }, intPtr(30)},
+		{"unset log level", unset, func(c *Connection) interface{} { return c.LogLevel }, strPtr(ConnectionLogLevelDebug)},
+		{"set log level", &Connection{LogLevel: strPtr(ConnectionLogLevelTrace)}, func(c *Connection) interface{} { return c.LogLevel }, strPtr(ConnectionLogLevelTrace)},
+		{"unset cipher suite", unset, func(c *Connection) interface{} { return c.CipherSuite }, strPtr(CipherSuiteAES256GCM)},
+		{"set cipher suite", &Connection{CipherSuite: strPtr(CipherSuiteAES128GCM)}, func(c *Connection) interface{} { return c.CipherSuite }, strPtr(CipherSuiteAES128GCM)},
+	}
+
+	for _, tt := range tests {
+		res := mustMerge(t, c, tt.in)
+		if have := tt.field(res); !reflect.DeepEqual(have, tt.expected) {
+			t.Fatalf("%s: c.Merge() failed, expected %v, have %v", tt.name, reflect.Indirect(reflect.ValueOf(tt.expected)), reflect.Indirect(reflect.ValueOf(have)))
+		}
+	}
+}
+
+func TestConnectionValidateKeepalive(t *testing.T) {
+
+	// Connection-level keepalive only
+	c := newTestConnection()
+	c.PersistentKeepalive = intPtr(25)
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+	}
+	if v := c.PersistentKeepaliveByInterfaceID("iface-a"); v == nil || *v != 25 {
+		t.Fatalf("c.PersistentKeepaliveByInterfaceID() failed, expected %d, have %v", 25, v)
+	}
+
+	// Peer-level keepalive only takes effect on its own peer
+	c = newTestConnection()
+	c.PeerSettings[0].PersistentKeepalive = intPtr(15)
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+	}
+	if v := c.PersistentKeepaliveByInterfaceID("iface-a"); v == nil || *v != 15 {
+		t.Fatalf("c.PersistentKeepaliveByInterfaceID() failed, expected %d, have %v", 15, v)
+	}
+	if v := c.PersistentKeepaliveByInterfaceID("iface-b"); v != nil {
+		t.Fatalf("c.PersistentKeepaliveByInterfaceID() failed, expected nil, have %d", *v)
+	}
+
+	// Both set to the same value
+	c = newTestConnection()
+	c.PersistentKeepalive = intPtr(25)
+	c.PeerSettings[1].PersistentKeepalive = intPtr(25)
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+	}
+
+	// Both set to different values
+	c = newTestConnection()
+	c.PersistentKeepalive = intPtr(25)
+	c.PeerSettings[1].PersistentKeepalive = intPtr(10)
+	if err := c.Validate(); err == nil {
+		t.Fatalf("c.Validate() failed, expected error for conflicting keepalive values")
+	}
+}
+
+func TestConnectionMarshalJSONSortsAllowedIPs(t *testing.T) {
+
+	a := newTestConnection()
+	a.PeerSettings[0].RoutingRules.AllowedIPs = []string{"fd00::/64", "192.168.1.0/24", "10.0.0.0/8", "10.0.0.0/16"}
+
+	b := newTestConnection()
+	b.ID = a.ID
+	b.CreatedAt = a.CreatedAt
+	b.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.0/16", "fd00::/64", "10.0.0.0/8", "192.168.1.0/24"}
+
+	ja, err := json.Marshal(a)
+	if err != nil {
+		t.Fatalf("json.Marshal() failed, unexpected error: %v", err)
+	}
+	jb, err := json.Marshal(b)
+	if err != nil {
+		t.Fatalf("json.Marshal() failed, unexpected error: %v", err)
+	}
+
+	if string(ja) != string(jb) {
+		t.Fatalf("json.Marshal() failed, expected identical output, have %s and %s", ja, jb)
+	}
+
+	expected := `"AllowedIPs":["10.0.0.0/8","10.0.0.0/16","192.168.1.0/24","fd00::/64"]`
+	if !strings.Contains(string(ja), expected) {
+		t.Fatalf("json.Marshal() failed, expected output to contain %s, have %s", expected, ja)
+	}
+
+	// In-memory order must not be affected
+	if b.PeerSettings[0].RoutingRules.AllowedIPs[0] != "10.0.0.0/16" {
+		t.Fatalf("json.Marshal() failed, in-memory AllowedIPs were reordered")
+	}
+}
+
+func TestNewConnectionBetween(t *testing.T) {
+
+	c, err := NewConnectionBetween("network-1", "iface-a", "node-a", "iface-b", "node-b")
+	if err != nil {
+		t.Fatalf("NewConnectionBetween() failed, unexpected error: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("NewConnectionBetween() failed, connection does not validate: %v", err)
+	}
+	if c.ID == "" || c.NetworkID != "network-1" {
+		t.Fatalf("NewConnectionBetween() failed, unexpected ID %q or network %q", c.ID, c.NetworkID)
+	}
+
+	for _, id := range []string{"iface-a", "iface-b"} {
+		peer := c.PeerSettingsByInterfaceID(id)
+		if peer == nil {
+			t.Fatalf("NewConnectionBetween() failed, missing peer settings for %s", id)
+		}
+		if peer.RoutingRules == nil || peer.RoutingRules.AllowedIPs == nil {
+			t.Fatalf("NewConnectionBetween() failed, routing rules not initialized for %s", id)
+		}
+	}
+
+	if _, err := NewConnectionBetween("network-1", "iface-a", "node-a", "iface-a", "node-a"); err == nil {
+		t.Fatalf("NewConnectionBetween() failed, expected error when connecting an interface to itself")
+	}
+}
+
+func TestConnectionRoutesForInterface(t *testing.T) {
+
+	c := newTestConnection()
+
+	routes, err := c.RoutesForInterface("iface-a")
+	if err != nil {
+		t.Fatalf("c.RoutesForInterface() failed, unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(routes, []string{"10.0.0.1/32"}) {
+		t.Fatalf("c.RoutesForInterface() failed, expected %v, have %v", []string{"10.0.0.1/32"}, routes)
+	}
+
+	// Mutating the result must not affect the connection
+	routes[0] = "0.0.0.0/0"
+	if c.PeerSettings[0].RoutingRules.AllowedIPs[0] != "10.0.0.1/32" {
+		t.Fatalf("c.RoutesForInterface() failed, returned the backing slice")
+	}
+
+	routes, err = c.RoutesForInterface("iface-b")
+	if err != nil {
+		t.Fatalf("c.RoutesForInterface() failed, unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(routes, []string{"10.0.0.2/32"}) {
+		t.Fatalf("c.RoutesForInterface() failed, expected %v, have %v", []string{"10.0.0.2/32"}, routes)
+	}
+
+	if _, err := c.RoutesForInterface("iface-unknown"); err == nil {
+		t.Fatalf("c.RoutesForInterface() failed, expected error for unknown interface")
+	}
+}
+
+func TestConnectionValidateDNS(t *testing.T) {
+
+	c := newTestConnection()
+	c.PeerSettings[0].DNS = []string{"10.0.0.53", "fd00::53"}
+	c.PeerSettings[0].SearchDomains = []string{"corp.example.com", "example"}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+	}
+
+	expected := "10.0.0.53, fd00::53, corp.example.com, example"
+	if d := c.PeerSettings[0].DNSDirective(); d != expected {
+		t.Fatalf("DNSDirective() failed, expected %q, have %q", expected, d)
+	}
+
+	c.PeerSettings[0].SearchDomains = []string{"corp.example.com", "-invalid_.com"}
+	if err := c.Validate(); err == nil {
+		t.Fatalf("c.Validate() failed, expected error for invalid search domain")
+	}
+
+	c.PeerSettings[0].SearchDomains = nil
+	c.PeerSettings[0].DNS = []string{"not-an-ip"}
+	if err := c.Validate(); err == nil {
+		t.Fatalf("c.Validate() failed, expected error for invalid DNS server")
+	}
+}
+
+func TestPeerSettingsMergeDNS(t *testing.T) {
+
+	p := &PeerSettings{
+		InterfaceID:   "iface-a",
+		DNS:           []string{"10.0.0.53"},
+		SearchDomains: []string{"corp.example.com"},
+	}
+
+	// Unset fields are preserved
+	res := p.Merge(&PeerSettings{DNS: []string{"10.0.0.54"}})
+	if !reflect.DeepEqual(res.DNS, []string{"10.0.0.54"}) {
+		t.Fatalf("p.Merge() failed, expected DNS %v, have %v", []string{"10.0.0.54"}, res.DNS)
+	}
+	if !reflect.DeepEqual(res.SearchDomains, []string{"corp.example.com"}) {
+		t.Fatalf("p.Merge() failed, expected search domains %v, have %v", []string{"corp.example.com"}, res.SearchDomains)
+	}
+
+	// Set fields are overwritten
+	res = p.Merge(&PeerSettings{SearchDomains: []string{"lab.example.com"}})
+	if !reflect.DeepEqual(res.SearchDomains, []string{"lab.example.com"}) {
+		t.Fatalf("p.Merge() failed, expected search domains %v, have %v", []string{"lab.example.com"}, res.SearchDomains)
+	}
+}
+
+func TestConnectionValidateWithInterfaces(t *testing.T) {
+
+	ifaces := map[string]*Interface{
+		"iface-a": {ID: "iface-a", NodeID: "node-a", NetworkID: "network-1"},
+		"iface-b": {ID: "iface-b", NodeID: "node-b", NetworkID: "network-1"},
+	}
+
+	// Consistent pairing
+	c := newTestConnection()
+	if err := c.ValidateWithInterfaces(ifaces); err != nil {
+		t.Fatalf("c.ValidateWithInterfaces() failed, unexpected error: %v", err)
+	}
+
+	// Inconsistent pairing
+	c.PeerSettings[0].NodeID = "node-b"
+	if err := c.ValidateWithInterfaces(ifaces); err == nil {
+		t.Fatalf("c.ValidateWithInterfaces() failed, expected error for mismatching node")
+	}
+
+	// Unknown interface
+	c = newTestConnection()
+	delete(ifaces, "iface-b")
+	if err := c.ValidateWithInterfaces(ifaces); err == nil {
+		t.Fatalf("c.ValidateWithInterfaces() failed, expected error for unknown interface")
+	}
+}
+
+func TestConnectionLabels(t *testing.T) {
+
+	c := newTestConnection()
+	c.Labels = []string{"web", "db-replica"}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+	}
+
+	for _, l := range []string{"Web", "db_replica", "", strings.Repeat("a", maxLabelLength+1)} {
+		c.Labels = []string{l}
+		if err := c.Validate(); err == nil {
+			t.Fatalf("c.Validate() failed, expected error for label %q", l)
+		}
+	}
+
+	c.Labels = []string{"web", "db-replica"}
+	res := mustMerge(t, c, &Connection{Labels: []string{"db-replica", "monitoring"}})
+	expected := []string{"web", "db-replica", "monitoring"}
+	if !reflect.DeepEqual(res.Labels, expected) {
+		t.Fatalf("c.Merge() failed, expected labels %v, have %v", expected, res.Labels)
+	}
+
+	if !res.HasLabel("monitoring") {
+		t.Fatalf("c.HasLabel() failed, expected label %q to be present", "monitoring")
+	}
+	if res.HasLabel("cache") {
+		t.Fatalf("c.HasLabel() failed, expected label %q to be absent", "cache")
+	}
+}
+
+func TestConnectionListRequestValidate(t *testing.T) {
+
+	valid := []*ConnectionListRequest{
+		{},
+		{NodeID: "node-a", NodeIDs: []string{"node-a", "node-b"}},
+		{NodeIDs: []string{"node-a"}},
+		{ContainsIP: "10.0.0.1"},
+		{ContainsIP: "10.0.0.0/24"},
+		{ContainsIP: "fd00::1"},
+	}
+	for _, r := range valid {
+		if err := r.Validate(); err != nil {
+			t.Fatalf("r.Validate() failed, unexpected error for %+v: %v", r, err)
+		}
+	}
+
+	invalid := []*ConnectionListRequest{
+		{NodeID: "node-c", NodeIDs: []string{"node-a", "node-b"}}, // contradictory node filters
+		{NodeIDs: []string{"node-a", ""}},                         // empty node ID
+		{ContainsIP: "10.0.0.300"},                                // unparseable IP
+		{ContainsIP: "10.0.0.0/33"},                               // unparseable CIDR
+	}
+	for _, r := range invalid {
+		if err := r.Validate(); err == nil {
+			t.Fatalf("r.Validate() failed, expected error for %+v", r)
+		}
+	}
+}
+
+func TestConnectionContainsIP(t *testing.T) {
+
+	c := newTestConnection()
+	c.PeerSettings[1].RoutingRules.AllowedIPs = []string{"192.168.0.0/16"}
+
+	for _, s := range []string{"10.0.0.1", "192.168.1.1", "192.168.1.0/24"} {
+		if !c.ContainsIP(s) {
+			t.Fatalf("c.ContainsIP() failed, expected %s to be contained", s)
+		}
+	}
+	for _, s := range []string{"10.0.0.2", "192.0.0.0/8", "invalid"} {
+		if c.ContainsIP(s) {
+			t.Fatalf("c.ContainsIP() failed, expected %s not to be contained", s)
+		}
+	}
+}
+
+func TestConnectionHistory(t *testing.T) {
+
+	c := newTestConnection()
+
+	for i := 0; i < maxConnectionHistory+5; i++ {
+		c.RecordChange("token-1", fmt.Sprintf("change %d", i))
+	}
+
+	if len(c.History) != maxConnectionHistory {
+		t.Fatalf("c.RecordChange() failed, expected %d entries, have %d", maxConnectionHistory, len(c.History))
+	}
+	if c.History[0].Summary != "change 5" {
+		t.Fatalf("c.RecordChange() failed, expected oldest entry %q, have %q", "change 5", c.History[0].Summary)
+	}
+	for i := 1; i < len(c.History); i++ {
+		if c.History[i].At.Before(c.History[i-1].At) {
+			t.Fatalf("c.RecordChange() failed, entries are not in chronological order")
+		}
+	}
+
+	// Merge ignores incoming entries, and preserves the existing ones
+	c = newTestConnection()
+	c.RecordChange("token-1", "first")
+	res := mustMerge(t, c, &Connection{History: []*ChangeEntry{{By: "token-2", Summary: "forged"}}})
+	if len(res.History) != 1 || res.History[0].Summary != "first" {
+		t.Fatalf("c.Merge() failed, unexpected history %v", res.History)
+	}
+	res = mustMerge(t, c, c.Clone())
+	if len(res.History) != 1 {
+		t.Fatalf("c.Merge() failed, expected %d entry, have %d", 1, len(res.History))
+	}
+}
+
+func TestChurnRate(t *testing.T) {
+
+	now := time.Now()
+	history := []*ChangeEntry{
+		{At: now.Add(-48 * time.Hour)},
+		{At: now.Add(-25 * time.Hour)},
+		{At: now.Add(-24 * time.Hour)},
+		{At: now.Add(-time.Hour)},
+		{At: now},
+	}
+
+	tests := []struct {
+		name     string
+		window   time.Duration
+		expected int
+	}{
+		{"last day", 24 * time.Hour, 3},
+		{"last hour", time.Hour, 2},
+		{"last minute", time.Minute, 1},
+		{"whole history", 72 * time.Hour, 5},
+	}
+
+	for _, tt := range tests {
+		if n := ChurnRate(history, tt.window, now); n != tt.expected {
+			t.Fatalf("%s: ChurnRate() failed, expected %d, have %d", tt.name, tt.expected, n)
+		}
+	}
+
+	// Changes after now are outside the window
+	if n := ChurnRate(history, time.Hour, now.Add(-2*time.Hour)); n != 0 {
+		t.Fatalf("ChurnRate() failed, expected %d, have %d", 0, n)
+	}
+}
+
+func TestConnectionRecordSample(t *testing.T) {
+
+	c := newTestConnection()
+
+	// Samples are kept in time order, even if reported out of order
+	start := time.Now()
+	for i := maxThroughputSamples + 5; i > 0; i-- {
+		c.RecordSample(Sample{At: start.Add(time.Duration(i) * time.Second), RxBytes: uint64(i)})
+	}
+
+	if len(c.ThroughputSamples) != maxThroughputSamples {
+		t.Fatalf("c.RecordSample() failed, expected %d samples, have %d", maxThroughputSamples, len(c.ThroughputSamples))
+	}
+	if c.ThroughputSamples[0].RxBytes != 6 {
+		t.Fatalf("c.RecordSample() failed, expected oldest sample %d, have %d", 6, c.ThroughputSamples[0].RxBytes)
+	}
+	for i := 1; i < len(c.ThroughputSamples); i++ {
+		if c.ThroughputSamples[i].At.Before(c.ThroughputSamples[i-1].At) {
+			t.Fatalf("c.RecordSample() failed, samples are not in time order")
+		}
+	}
+
+	// Samples of another node don't push out the existing ones
+	c.RecordSample(Sample{At: start, NodeID: "node-b", RxBytes: 1})
+	if n := len(c.SamplesByNodeID("")); n != maxThroughputSamples {
+		t.Fatalf("c.RecordSample() failed, expected %d samples, have %d", maxThroughputSamples, n)
+	}
+	if samples := c.SamplesByNodeID("node-b"); len(samples) != 1 || samples[0].RxBytes != 1 {
+		t.Fatalf("c.SamplesByNodeID() failed, expected a single sample of node-b, have %v", samples)
+	}
+
+	stub, err := c.Stub()
+	if err != nil {
+		t.Fatalf("c.Stub() failed, unexpected error: %v", err)
+	}
+	if stub.ThroughputSamples != nil {
+		t.Fatalf("c.Stub() failed, expected no samples, have %d", len(stub.ThroughputSamples))
+	}
+}
+
+func TestConnectionValidateWithNetwork(t *testing.T) {
+
+	c := newTestConnection()
+	c.PeerSettings[1].RoutingRules.AllowedIPs = []string{"10.0.0.2/32", "fd00::2/128"}
+
+	// IPv4-only network with an accidental IPv6 route
+	n := &Network{ID: "network-1", AddressFamily: AddressFamilyIPv4}
+	err := c.ValidateWithNetwork(n)
+	if err == nil {
+		t.Fatalf("c.ValidateWithNetwork() failed, expected error for IPv6 route in IPv4-only network")
+	}
+	if !strings.Contains(err.Error(), "fd00::2/128") {
+		t.Fatalf("c.ValidateWithNetwork() failed, expected error to name the offending CIDR, have %v", err)
+	}
+
+	// Dual-stack networks accept both
+	for _, family := range []string{AddressFamilyDual, ""} {
+		n = &Network{ID: "network-1", AddressFamily: family}
+		if err := c.ValidateWithNetwork(n); err != nil {
+			t.Fatalf("c.ValidateWithNetwork() failed, unexpected error: %v", err)
+		}
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestConnectionValidateEndpoint(t *testing.T) {
+
+	strict := &ConnectionValidationOptions{RequireRoutableEndpoints: true}
+
+	tests := []struct {
+		endpoint    string
+		validStrict bool
+		valid       bool
+	}{
+		{"127.0.0.1:51820", false, true},   // loopback
+		{"0.0.0.0:51820", false, true},     // unspecified
+		{"[::]:51820", false, true},        // unspecified
+		{"[::1]:51820", false, true},       // loopback
+		{"203.0.113.10:51820", true, true}, // public IP
+		{"vpn.example.com:51820", true, true},
+		{"203.0.113.10", false, false}, // missing port
+		{"203.0.113.10:0", false, false},
+	}
+
+	for _, test := range tests {
+		c := newTestConnection()
+		c.PeerSettings[0].Endpoint = strPtr(test.endpoint)
+
+		if err := c.Validate(); (err == nil) != test.valid {
+			t.Fatalf("c.Validate() failed for %s, expected valid=%v, have error %v", test.endpoint, test.valid, err)
+		}
+		if err := c.ValidateWithOptions(strict); (err == nil) != test.validStrict {
+			t.Fatalf("c.ValidateWithOptions() failed for %s, expected valid=%v, have error %v", test.endpoint, test.validStrict, err)
+		}
+	}
+
+	p := (&PeerSettings{Endpoint: strPtr("203.0.113.10:51820")}).Merge(&PeerSettings{})
+	if p.Endpoint == nil || *p.Endpoint != "203.0.113.10:51820" {
+		t.Fatalf("p.Merge() failed, expected endpoint to be preserved")
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestConnectionInitiator(t *testing.T) {
+
+	// One behind NAT
+	c := newTestConnection()
+	c.PeerSettings[1].BehindNAT = boolPtr(true)
+	if id, err := c.Initiator(); err != nil || id != "node-b" {
+		t.Fatalf("c.Initiator() failed, expected %s, have %s (%v)", "node-b", id, err)
+	}
+
+	// Neither behind NAT, regardless of peer ordering
+	c = newTestConnection()
+	c.PeerSettings[0].BehindNAT = boolPtr(false)
+	c.PeerSettings[0], c.PeerSettings[1] = c.PeerSettings[1], c.PeerSettings[0]
+	if id, err := c.Initiator(); err != nil || id != "node-a" {
+		t.Fatalf("c.Initiator() failed, expected %s, have %s (%v)", "node-a", id, err)
+	}
+
+	// Both behind NAT
+	c = newTestConnection()
+	c.PeerSettings[0].BehindNAT = boolPtr(true)
+	c.PeerSettings[1].BehindNAT = boolPtr(true)
+	if _, err := c.Initiator(); err == nil {
+		t.Fatalf("c.Initiator() failed, expected error when both peers are behind NAT")
+	}
+}
+
+func TestConnectionValidateRoles(t *testing.T) {
+
+	tests := []struct {
+		roles [2]string
+		valid bool
+	}{
+		{[2]string{"", ""}, true},
+		{[2]string{PeerRolePeer, PeerRolePeer}, true},
+		{[2]string{PeerRoleServer, PeerRoleClient}, true},
+		{[2]string{PeerRoleServer, PeerRoleServer}, false},
+		{[2]string{"hub", PeerRoleClient}, false},
+	}
+
+	for _, tt := range tests {
+		c := newTestConnection()
+		c.PeerSettings[0].Role, c.PeerSettings[1].Role = tt.roles[0], tt.roles[1]
+		if err := c.Validate(); (err == nil) != tt.valid {
+			t.Fatalf("c.Validate() failed for roles %v, expected valid=%v, have %v", tt.roles, tt.valid, err)
+		}
+	}
+
+	c := newTestConnection()
+	res := mustMerge(t, c, &Connection{PeerSettings: []*PeerSettings{{InterfaceID: "iface-a", Role: PeerRoleServer}}})
+	if !res.PeerSettings[0].IsServer() || res.PeerSettings[1].Role != "" {
+		t.Fatalf("c.Merge() failed, expected roles %v, have %v", []string{PeerRoleServer, ""},
+			[]string{res.PeerSettings[0].Role, res.PeerSettings[1].Role})
+	}
+}
+
+func TestConnectionInitiatorRoles(t *testing.T) {
+
+	// The client dials the server, even if it comes later in lexicographic order
+	c := newTestConnection()
+	c.PeerSettings[0].Role = PeerRoleServer
+	c.PeerSettings[1].Role = PeerRoleClient
+	if id, err := c.Initiator(); err != nil || id != "node-b" {
+		t.Fatalf("c.Initiator() failed, expected %s, have %s (%v)", "node-b", id, err)
+	}
+
+	c.PeerSettings[0].BehindNAT = boolPtr(true)
+	if _, err := c.Initiator(); err == nil {
+		t.Fatalf("c.Initiator() failed, expected error when the server is behind NAT")
+	}
+}
+
+func TestPeerSettingsValidate(t *testing.T) {
+
+	valid := func() *PeerSettings {
+		return &PeerSettings{
+			NodeID:       "node-a",
+			InterfaceID:  "iface-a",
+			RoutingRules: &RoutingRules{AllowedIPs: []string{"10.0.0.0/24", "fd00::/64"}},
+		}
+	}
+
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("p.Validate() failed, unexpected error: %v", err)
+	}
+
+	tests := map[string]func(p *PeerSettings){
+		"missing interface ID":  func(p *PeerSettings) { p.InterfaceID = "" },
+		"invalid allowed IP":    func(p *PeerSettings) { p.RoutingRules.AllowedIPs = []string{"10.0.0.0/24", "10.0.0.1"} },
+		"negative keepalive":    func(p *PeerSettings) { p.PersistentKeepalive = intPtr(-1) },
+		"oversized keepalive":   func(p *PeerSettings) { p.PersistentKeepalive = intPtr(65536) },
+		"invalid endpoint":      func(p *PeerSettings) { p.Endpoint = strPtr("vpn.example.com") },
+		"invalid DNS server":    func(p *PeerSettings) { p.DNS = []string{"vpn.example.com"} },
+		"invalid search":        func(p *PeerSettings) { p.SearchDomains = []string{"corp..example.com"} },
+		"zero listen port":      func(p *PeerSettings) { p.ListenPort = intPtr(0) },
+		"oversized listen port": func(p *PeerSettings) { p.ListenPort = intPtr(65536) },
+	}
+
+	for name, mutate := range tests {
+		p := valid()
+		mutate(p)
+		if err := p.Validate(); err == nil {
+			t.Fatalf("p.Validate() failed, expected error for %s", name)
+		}
+	}
+
+	// Peer errors are surfaced by the connection
+	c := newTestConnection()
+	c.PeerSettings[1].PersistentKeepalive = intPtr(-1)
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "iface-b") {
+		t.Fatalf("c.Validate() failed, expected error naming the interface, have %v", err)
+	}
+}
+
+func TestConnectionExpiry(t *testing.T) {
+
+	now := time.Now()
+	past, future := now.Add(-time.Second), now.Add(time.Second)
+
+	c := newTestConnection()
+	if c.IsExpired(now) {
+		t.Fatalf("c.IsExpired() failed, connection without expiration should never expire")
+	}
+
+	c.ExpireAt = &past
+	if !c.IsExpired(now) {
+		t.Fatalf("c.IsExpired() failed, expected connection to be expired")
+	}
+
+	c = mustMerge(t, c, &Connection{ExpireAt: &future})
+	if c.IsExpired(now) {
+		t.Fatalf("c.Merge() failed, expected expiration time to be updated")
+	}
+}
+
+func TestConnectionValidateKeepaliveBehindNAT(t *testing.T) {
+
+	strict := &ConnectionValidationOptions{RequireKeepaliveBehindNAT: true}
+
+	// NAT with keepalive, either at the peer or at the connection level
+	c := newTestConnection()
+	c.PeerSettings[0].BehindNAT = boolPtr(true)
+	c.PeerSettings[0].PersistentKeepalive = intPtr(25)
+	if err := c.ValidateWithOptions(strict); err != nil {
+		t.Fatalf("c.ValidateWithOptions() failed, unexpected error: %v", err)
+	}
+	c.PeerSettings[0].PersistentKeepalive = nil
+	c.PersistentKeepalive = intPtr(25)
+	if err := c.ValidateWithOptions(strict); err != nil {
+		t.Fatalf("c.ValidateWithOptions() failed, unexpected error: %v", err)
+	}
+
+	// NAT without keepalive
+	c.PersistentKeepalive = nil
+	if err := c.ValidateWithOptions(strict); err == nil {
+		t.Fatalf("c.ValidateWithOptions() failed, expected error for NAT without keepalive")
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error in permissive mode: %v", err)
+	}
+	if w := LintConnection(c); countWarnings(w, "behind NAT") != 1 {
+		t.Fatalf("LintConnection() failed, expected %d warning, have %v", 1, w)
+	}
+
+	// No NAT
+	c = newTestConnection()
+	if err := c.ValidateWithOptions(strict); err != nil {
+		t.Fatalf("c.ValidateWithOptions() failed, unexpected error: %v", err)
+	}
+}
+
+func TestConnectionValidatePeerKeepalivesBehindNAT(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		natted     bool
+		connection *int
+		keepalive  [2]*int
+		valid      bool
+	}{
+		{"contradictory", true, nil, [2]*int{intPtr(0), intPtr(0)}, false},
+		{"asymmetric", true, nil, [2]*int{intPtr(25), intPtr(0)}, true},
+		{"asymmetric, unset", true, nil, [2]*int{nil, intPtr(0)}, true},
+		{"no NAT", false, nil, [2]*int{intPtr(0), intPtr(0)}, true},
+		{"disabled by connection", true, intPtr(0), [2]*int{nil, nil}, false},
+		{"disabled by connection, no NAT", false, intPtr(0), [2]*int{nil, nil}, true},
+	}
+
+	for _, tt := range tests {
+		c := newTestConnection()
+		c.PersistentKeepalive = tt.connection
+		c.PeerSettings[1].BehindNAT = boolPtr(tt.natted)
+		c.PeerSettings[0].PersistentKeepalive = tt.keepalive[0]
+		c.PeerSettings[1].PersistentKeepalive = tt.keepalive[1]
+		err := c.Validate()
+		if (err == nil) != tt.valid {
+			t.Fatalf("%s: c.Validate() failed, expected valid %v, have error %v", tt.name, tt.valid, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "both peers disable persistent keepalives") {
+			t.Fatalf("%s: c.Validate() failed, unexpected error: %v", tt.name, err)
+		}
+	}
+}
+
+func TestConnectionValidateMinKeepalive(t *testing.T) {
+
+	strict := &ConnectionValidationOptions{MinKeepalive: DefaultMinKeepalive}
+
+	tests := []struct {
+		name      string
+		keepalive *int
+		peer      *int
+		valid     bool
+	}{
+		{"below floor", intPtr(1), nil, false},
+		{"below floor at the peer level", nil, intPtr(2), false},
+		{"disabled", intPtr(0), nil, true},
+		{"unset", nil, nil, true},
+		{"at floor", intPtr(DefaultMinKeepalive), nil, true},
+		{"normal", intPtr(25), nil, true},
+	}
+
+	for _, tt := range tests {
+		c := newTestConnection()
+		c.PersistentKeepalive = tt.keepalive
+		c.PeerSettings[1].PersistentKeepalive = tt.peer
+		if err := c.ValidateWithOptions(strict); (err == nil) != tt.valid {
+			t.Fatalf("%s: c.ValidateWithOptions() failed, expected valid %v, have error %v", tt.name, tt.valid, err)
+		}
+		if err := c.Validate(); err != nil {
+			t.Fatalf("%s: c.Validate() failed, unexpected error in permissive mode: %v", tt.name, err)
+		}
+	}
+}
+
+func TestConnectionIsSymmetric(t *testing.T) {
+
+	// Symmetric, after normalization and regardless of order
+	c := newTestConnection()
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.0/24", "192.168.1.1/24"}
+	c.PeerSettings[1].RoutingRules.AllowedIPs = []string{"192.168.1.0/24", "10.0.0.0/24", "10.0.0.0/24"}
+	if !c.IsSymmetric() {
+		t.Fatalf("c.IsSymmetric() failed, expected connection to be symmetric")
+	}
+
+	// Asymmetric
+	c.PeerSettings[1].RoutingRules.AllowedIPs = []string{"10.0.0.0/24"}
+	if c.IsSymmetric() {
+		t.Fatalf("c.IsSymmetric() failed, expected connection to be asymmetric")
+	}
+
+	// Empty on both
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{}
+	c.PeerSettings[1].RoutingRules = nil
+	if !c.IsSymmetric() {
+		t.Fatalf("c.IsSymmetric() failed, expected connection to be symmetric")
+	}
+}
+
+func TestConnectionRedacted(t *testing.T) {
+
+	c := newTestConnection()
+	c.PresharedKeyRef = strPtr("secret/psk")
+	c.PersistentKeepalive = intPtr(25)
+	c.Labels = []string{"web"}
+	c.PeerSettings[0].Endpoint = strPtr("203.0.113.10:51820")
+
+	r := c.Redacted()
+
+	if r.PresharedKeyRef != nil {
+		t.Fatalf("c.Redacted() failed, preshared key reference was not cleared")
+	}
+	for _, peer := range r.PeerSettings {
+		if peer.Endpoint != nil {
+			t.Fatalf("c.Redacted() failed, endpoint was not cleared for %s", peer.InterfaceID)
+		}
+	}
+
+	// The rest is intact
+	if r.ID != c.ID || r.NetworkID != c.NetworkID || *r.PersistentKeepalive != 25 || !r.HasLabel("web") {
+		t.Fatalf("c.Redacted() failed, non-sensitive fields were modified")
+	}
+	if !reflect.DeepEqual(r.ConnectedInterfaceIDs(), c.ConnectedInterfaceIDs()) ||
+		!reflect.DeepEqual(r.PeerSettings[0].RoutingRules, c.PeerSettings[0].RoutingRules) {
+		t.Fatalf("c.Redacted() failed, peer settings were modified")
+	}
+
+	// The original is not modified
+	if c.PresharedKeyRef == nil || c.PeerSettings[0].Endpoint == nil {
+		t.Fatalf("c.Redacted() failed, original connection was modified")
+	}
+}
+
+func TestConnectionClone(t *testing.T) {
+
+	c := newTestConnection()
+	c.PersistentKeepalive = intPtr(25)
+	c.RecordChange("token-1", "created")
+
+	clone := c.Clone()
+	if !reflect.DeepEqual(c, clone) {
+		t.Fatalf("c.Clone() failed, expected clone to be equal to the original")
+	}
+
+	*clone.PersistentKeepalive = 10
+	clone.PeerSettings[0].RoutingRules.AllowedIPs[0] = "0.0.0.0/0"
+	clone.History[0].Summary = "modified"
+
+	if *c.PersistentKeepalive != 25 || c.PeerSettings[0].RoutingRules.AllowedIPs[0] != "10.0.0.1/32" || c.History[0].Summary != "created" {
+		t.Fatalf("c.Clone() failed, modifying the clone affected the original")
+	}
+}
+
+func TestPeerSettingsEndpoints(t *testing.T) {
+
+	c := newTestConnection()
+	c.PeerSettings[0].Endpoints = []string{"203.0.113.10:51820", "backup.example.com:51820"}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+	}
+
+	c.PeerSettings[0].Endpoints = []string{"203.0.113.10:51820", "backup.example.com"}
+	if err := c.Validate(); err == nil {
+		t.Fatalf("c.Validate() failed, expected error for endpoint without port")
+	}
+
+	// Ordering is preserved on merge
+	p := &PeerSettings{InterfaceID: "iface-a"}
+	p = p.Merge(&PeerSettings{Endpoints: []string{"b.example.com:51820", "a.example.com:51820"}})
+	if !reflect.DeepEqual(p.Endpoints, []string{"b.example.com:51820", "a.example.com:51820"}) {
+		t.Fatalf("p.Merge() failed, unexpected endpoints %v", p.Endpoints)
+	}
+	p = p.Merge(&PeerSettings{})
+	if len(p.Endpoints) != 2 {
+		t.Fatalf("p.Merge() failed, expected endpoints to be preserved")
+	}
+
+	// Compatibility accessor
+	if e := p.PrimaryEndpoint(); e == nil || *e != "b.example.com:51820" {
+		t.Fatalf("p.PrimaryEndpoint() failed, expected %s, have %v", "b.example.com:51820", e)
+	}
+	p = &PeerSettings{Endpoint: strPtr("c.example.com:51820")}
+	if e := p.PrimaryEndpoint(); e == nil || *e != "c.example.com:51820" {
+		t.Fatalf("p.PrimaryEndpoint() failed, expected %s, have %v", "c.example.com:51820", e)
+	}
+	if e := (&PeerSettings{}).PrimaryEndpoint(); e != nil {
+		t.Fatalf("p.PrimaryEndpoint() failed, expected nil, have %s", *e)
+	}
+}
+
+func TestValidateAgainstNodeRoutes(t *testing.T) {
+
+	c := newTestConnection()
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.0/24", "192.168.10.0/24"}
+
+	// Non-overlapping static routes
+	if err := ValidateAgainstNodeRoutes(c, "node-a", []string{"172.16.0.0/12", "192.168.11.0/24"}); err != nil {
+		t.Fatalf("ValidateAgainstNodeRoutes() failed, unexpected error: %v", err)
+	}
+
+	// Overlapping static route
+	err := ValidateAgainstNodeRoutes(c, "node-a", []string{"172.16.0.0/12", "192.168.0.0/16"})
+	if err == nil || !strings.Contains(err.Error(), "192.168.0.0/16") {
+		t.Fatalf("ValidateAgainstNodeRoutes() failed, expected error naming the static route, have %v", err)
+	}
+
+	// Routes of the other peer are not considered
+	if err := ValidateAgainstNodeRoutes(c, "node-b", []string{"192.168.0.0/16"}); err != nil {
+		t.Fatalf("ValidateAgainstNodeRoutes() failed, unexpected error: %v", err)
+	}
+
+	if err := ValidateAgainstNodeRoutes(c, "node-c", nil); err == nil {
+		t.Fatalf("ValidateAgainstNodeRoutes() failed, expected error for unknown node")
+	}
+}
+
+func TestConnectionStub(t *testing.T) {
+
+	c := newTestConnection()
+	stub, err := c.Stub()
+	if err != nil {
+		t.Fatalf("c.Stub() failed, unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(stub.Peers, []string{"iface-a", "iface-b"}) {
+		t.Fatalf("c.Stub() failed, expected %v, have %v", []string{"iface-a", "iface-b"}, stub.Peers)
+	}
+
+	until := time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC)
+	c.ActiveUntil = &until
+	if stub, _ := c.Stub(); stub.ActiveUntil == nil || !stub.ActiveUntil.Equal(until) {
+		t.Fatalf("c.Stub() failed, expected active until %v, have %v", until, stub.ActiveUntil)
+	}
+
+	c.PeerSettings = c.PeerSettings[:1]
+	if stub, err := c.Stub(); err == nil {
+		t.Fatalf("c.Stub() failed, expected error for one-peer connection, have %+v", stub)
+	}
+
+	c.PeerSettings = []*PeerSettings{c.PeerSettings[0], nil}
+	if stub, err := c.Stub(); err == nil {
+		t.Fatalf("c.Stub() failed, expected error for nil peer, have %+v", stub)
+	}
+}
+
+func TestRoutingRulesMergeSorted(t *testing.T) {
+
+	expected := []string{"10.0.0.0/24", "172.16.0.0/12", "192.168.1.0/24", "fd00::/64"}
+
+	orders := [][]string{
+		{"fd00::/64", "192.168.1.0/24", "172.16.0.0/12", "10.0.0.0/24"},
+		{"172.16.0.0/12", "10.0.0.0/24", "fd00::/64", "192.168.1.0/24"},
+		expected,
+	}
+	for _, routes := range orders {
+		r := &RoutingRules{AllowedIPs: []string{"10.1.0.0/16"}}
+		res := r.Merge(&RoutingRules{AllowedIPs: routes})
+		if !reflect.DeepEqual(res.AllowedIPs, expected) {
+			t.Fatalf("r.Merge() failed, expected %v, have %v", expected, res.AllowedIPs)
+		}
+	}
+
+	// The input is left untouched
+	if orders[0][0] != "fd00::/64" {
+		t.Fatalf("r.Merge() failed, input routes were reordered")
+	}
+}
+
+func TestRoutingRulesMergeTemplate(t *testing.T) {
+
+	r := &RoutingRules{AllowedIPs: []string{"10.0.0.1/32", "192.168.5.0/24"}}
+	template := &RoutingRules{AllowedIPs: []string{"172.16.0.0/12", "192.168.1.0/24", "192.168.5.0/24"}}
+
+	// The override suppresses a template route, and keeps a manual one
+	overrides := map[string]bool{
+		"192.168.1.1/24": true,
+		"192.168.5.0/24": true,
+		"172.16.0.0/12":  false,
+	}
+
+	res := r.MergeTemplate(template, overrides)
+	expected := []string{"10.0.0.1/32", "172.16.0.0/12", "192.168.5.0/24"}
+	if !reflect.DeepEqual(res.AllowedIPs, expected) {
+		t.Fatalf("r.MergeTemplate() failed, expected %v, have %v", expected, res.AllowedIPs)
+	}
+	if len(r.AllowedIPs) != 2 {
+		t.Fatalf("r.MergeTemplate() failed, original routes were modified")
+	}
+
+	res = r.MergeTemplate(template, nil)
+	expected = []string{"10.0.0.1/32", "172.16.0.0/12", "192.168.1.0/24", "192.168.5.0/24"}
+	if !reflect.DeepEqual(res.AllowedIPs, expected) {
+		t.Fatalf("r.MergeTemplate() failed, expected %v, have %v", expected, res.AllowedIPs)
+	}
+}
+
+func TestRoutingRulesAddFromList(t *testing.T) {
+
+	r := &RoutingRules{AllowedIPs: []string{"10.0.0.0/24"}}
+
+	list := `# provider-a
+10.0.0.1/24
+192.168.1.0/24
+
+# provider-b
+172.16.0.0/12
+192.168.1.0/24
+`
+	added, err := r.AddFromList(strings.NewReader(list))
+	if err != nil {
+		t.Fatalf("r.AddFromList() failed, unexpected error: %v", err)
+	}
+	if added != 2 {
+		t.Fatalf("r.AddFromList() failed, expected %d routes added, have %d", 2, added)
+	}
+	expected := []string{"10.0.0.0/24", "172.16.0.0/12", "192.168.1.0/24"}
+	if !reflect.DeepEqual(r.AllowedIPs, expected) {
+		t.Fatalf("r.AddFromList() failed, expected %v, have %v", expected, r.AllowedIPs)
+	}
+
+	// Invalid lines cause the whole list to be rejected
+	if _, err := r.AddFromList(strings.NewReader("10.1.0.0/16\nnot-a-cidr\n")); err == nil {
+		t.Fatalf("r.AddFromList() failed, expected error for invalid line")
+	}
+	if !reflect.DeepEqual(r.AllowedIPs, expected) {
+		t.Fatalf("r.AddFromList() failed, expected %v after error, have %v", expected, r.AllowedIPs)
+	}
+}
+
+func TestPeerSettingsListenPort(t *testing.T) {
+
+	p := &PeerSettings{InterfaceID: "iface-a", NodeID: "node-a", ListenPort: intPtr(51820)}
+	if err := p.Validate(); err != nil {
+		t.Fatalf("p.Validate() failed, unexpected error: %v", err)
+	}
+	p.ListenPort = intPtr(65535)
+	if err := p.Validate(); err != nil {
+		t.Fatalf("p.Validate() failed, unexpected error: %v", err)
+	}
+
+	// Unset port is preserved
+	res := p.Merge(&PeerSettings{DNS: []string{"10.0.0.53"}})
+	if res.ListenPort == nil || *res.ListenPort != 65535 {
+		t.Fatalf("p.Merge() failed, expected listen port %d, have %v", 65535, res.ListenPort)
+	}
+
+	// Set port is overwritten
+	res = p.Merge(&PeerSettings{ListenPort: intPtr(51821)})
+	if res.ListenPort == nil || *res.ListenPort != 51821 {
+		t.Fatalf("p.Merge() failed, expected listen port %d, have %v", 51821, res.ListenPort)
+	}
+}
+
+func TestPeerSettingsSourcePortRange(t *testing.T) {
+
+	tests := map[string]string{
+		"1024-2047":   "",
+		"51820-51820": "",
+		"2047-1024":   "greater than high port",
+		"0-1024":      "invalid port 0",
+		"1024-65536":  "invalid port 65536",
+		"1024":        "low-high",
+		"low-high":    "invalid port low",
+	}
+
+	for r, expected := range tests {
+		p := &PeerSettings{InterfaceID: "iface-a", NodeID: "node-a", SourcePortRange: strPtr(r)}
+		err := p.Validate()
+		if expected == "" && err != nil {
+			t.Fatalf("p.Validate() failed, unexpected error for range %s: %v", r, err)
+		}
+		if expected != "" && (err == nil || !strings.Contains(err.Error(), expected)) {
+			t.Fatalf("p.Validate() failed, expected error containing %q for range %s, have %v", expected, r, err)
+		}
+	}
+
+	p := &PeerSettings{InterfaceID: "iface-a", NodeID: "node-a", SourcePortRange: strPtr("1024-2047")}
+	if res := p.Merge(&PeerSettings{ListenPort: intPtr(51820)}); res.SourcePortRange == nil || *res.SourcePortRange != "1024-2047" {
+		t.Fatalf("p.Merge() failed, expected source port range to be preserved, have %v", res.SourcePortRange)
+	}
+	if res := p.Merge(&PeerSettings{SourcePortRange: strPtr("4000-4999")}); res.SourcePortRange == nil || *res.SourcePortRange != "4000-4999" {
+		t.Fatalf("p.Merge() failed, expected source port range %s, have %v", "4000-4999", res.SourcePortRange)
+	}
+}
+
+func TestConnectionFingerprint(t *testing.T) {
+
+	a := newTestConnection()
+	fp := a.Fingerprint()
+	if len(fp) != 8 {
+		t.Fatalf("c.Fingerprint() failed, expected %d hex characters, have %q", 8, fp)
+	}
+
+	// Stable across peer ordering and connection IDs
+	b := newTestConnection()
+	b.PeerSettings[0], b.PeerSettings[1] = b.PeerSettings[1], b.PeerSettings[0]
+	if res := b.Fingerprint(); res != fp {
+		t.Fatalf("c.Fingerprint() failed, expected %s, have %s", fp, res)
+	}
+
+	seen := map[string]string{fp: a.CanonicalKey()}
+	for i := 0; i < 100; i++ {
+		c := newTestConnection()
+		c.PeerSettings[1].InterfaceID = fmt.Sprintf("iface-%d", i)
+		if key, ok := seen[c.Fingerprint()]; ok {
+			t.Fatalf("c.Fingerprint() failed, connections %s and %s have the same fingerprint", key, c.CanonicalKey())
+		}
+		seen[c.Fingerprint()] = c.CanonicalKey()
+	}
+}
+
+func TestConnectionValidateSharedInterface(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		modify func(c *Connection)
+		err    string
+	}{
+		{"distinct interfaces", func(c *Connection) {}, ""},
+		{"same interface and node", func(c *Connection) {
+			c.PeerSettings[1].InterfaceID, c.PeerSettings[1].NodeID = "iface-a", "node-a"
+		}, "can't connect an interface to itself"},
+		{"same interface, different nodes", func(c *Connection) {
+			c.PeerSettings[1].InterfaceID = "iface-a"
+		}, "interface iface-a is referenced by both nodes node-a and node-b"},
+	}
+
+	for _, tt := range tests {
+		c := newTestConnection()
+		tt.modify(c)
+		err := c.Validate()
+		if tt.err == "" && err != nil {
+			t.Fatalf("%s: c.Validate() failed, unexpected error: %v", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Fatalf("%s: c.Validate() failed, expected error containing %q, have %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestConnectionValidateDistinctNodes(t *testing.T) {
+
+	opts := &ConnectionValidationOptions{RequireDistinctNodes: true}
+
+	c := newTestConnection()
+	if !c.HasDistinctNodes() {
+		t.Fatalf("c.HasDistinctNodes() failed, expected true for nodes %v", c.ConnectedNodeIDs())
+	}
+	if err := c.ValidateWithOptions(opts); err != nil {
+		t.Fatalf("c.ValidateWithOptions() failed, unexpected error: %v", err)
+	}
+
+	c.PeerSettings[1].NodeID = "node-a"
+	if c.HasDistinctNodes() {
+		t.Fatalf("c.HasDistinctNodes() failed, expected false for nodes %v", c.ConnectedNodeIDs())
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+	}
+	if err := c.ValidateWithOptions(opts); err == nil || !strings.Contains(err.Error(), "node-a") {
+		t.Fatalf("c.ValidateWithOptions() failed, expected error for same-node connection, have %v", err)
+	}
+}
+
+func TestConnectionValidateStrictMesh(t *testing.T) {
+
+	strict := &ConnectionValidationOptions{StrictMesh: true}
+
+	// Cross-node connection
+	c := newTestConnection()
+	if err := c.ValidateWithOptions(strict); err != nil {
+		t.Fatalf("c.ValidateWithOptions() failed, unexpected error: %v", err)
+	}
+
+	// Same node, different interfaces
+	c.PeerSettings[1].NodeID = "node-a"
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+	}
+	err := c.ValidateWithOptions(strict)
+	if err == nil || !strings.Contains(err.Error(), "cannot connect a node to itself") {
+		t.Fatalf("c.ValidateWithOptions() failed, expected same-node error, have %v", err)
+	}
+}
+
+func TestValidateAgainstInterfaceFamilies(t *testing.T) {
+
+	c := newTestConnection()
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.1/32", "fd00::1/128"}
+	c.PeerSettings[1].RoutingRules.AllowedIPs = []string{"10.0.0.2/32"}
+
+	families := map[string][]string{
+		"iface-a": {AddressFamilyIPv4, AddressFamilyIPv6},
+		"iface-b": {AddressFamilyIPv4},
+	}
+	if err := ValidateAgainstInterfaceFamilies(c, families); err != nil {
+		t.Fatalf("ValidateAgainstInterfaceFamilies() failed, unexpected error: %v", err)
+	}
+
+	families["iface-a"] = []string{AddressFamilyIPv4}
+	err := ValidateAgainstInterfaceFamilies(c, families)
+	if err == nil || !strings.Contains(err.Error(), "interface iface-a advertises ipv6 route fd00::1/128") {
+		t.Fatalf("ValidateAgainstInterfaceFamilies() failed, expected error for mismatching family, have %v", err)
+	}
+}
+
+func TestValidatePrefixBounds(t *testing.T) {
+
+	c := newTestConnection()
+
+	// Prefixes exactly at the limit
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.0/8", "fd00::/32"}
+	if err := ValidatePrefixBounds(c, 8, 32); err != nil {
+		t.Fatalf("ValidatePrefixBounds() failed, unexpected error: %v", err)
+	}
+
+	// Over-broad prefix
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.0/8", "8.0.0.0/7"}
+	err := ValidatePrefixBounds(c, 8, 32)
+	if err == nil || !strings.Contains(err.Error(), "8.0.0.0/7") {
+		t.Fatalf("ValidatePrefixBounds() failed, expected error naming the route, have %v", err)
+	}
+
+	// Default route, only when explicitly allowed
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"0.0.0.0/0"}
+	if err := ValidatePrefixBounds(c, 8, 32); err == nil {
+		t.Fatalf("ValidatePrefixBounds() failed, expected error for default route")
+	}
+	if err := ValidatePrefixBounds(c, 8, 32, "0.0.0.0/0"); err != nil {
+		t.Fatalf("ValidatePrefixBounds() failed, unexpected error: %v", err)
+	}
+}
+
+func TestConnectionApplyPatch(t *testing.T) {
+
+	c := newTestConnection()
+	orig := c.Clone()
+
+	// Add
+	res, err := c.ApplyPatch([]byte(`[{"op":"add","path":"/PeerSettings/0/RoutingRules/AllowedIPs/-","value":"192.168.1.0/24"}]`))
+	if err != nil {
+		t.Fatalf("c.ApplyPatch() failed, unexpected error: %v", err)
+	}
+	expected := []string{"10.0.0.1/32", "192.168.1.0/24"}
+	if !reflect.DeepEqual(res.PeerSettings[0].RoutingRules.AllowedIPs, expected) {
+		t.Fatalf("c.ApplyPatch() failed, expected %v, have %v", expected, res.PeerSettings[0].RoutingRules.AllowedIPs)
+	}
+
+	// Remove
+	res, err = c.ApplyPatch([]byte(`[{"op":"remove","path":"/PeerSettings/1/RoutingRules/AllowedIPs/0"}]`))
+	if err != nil {
+		t.Fatalf("c.ApplyPatch() failed, unexpected error: %v", err)
+	}
+	if len(res.PeerSettings[1].RoutingRules.AllowedIPs) != 0 {
+		t.Fatalf("c.ApplyPatch() failed, expected no routes, have %v", res.PeerSettings[1].RoutingRules.AllowedIPs)
+	}
+
+	// Clear
+	c.Table = intPtr(100)
+	orig.Table = intPtr(100)
+	res, err = c.ApplyPatch([]byte(`[{"op":"replace","path":"/Table","value":null}]`))
+	if err != nil {
+		t.Fatalf("c.ApplyPatch() failed, unexpected error: %v", err)
+	}
+	if res.Table != nil {
+		t.Fatalf("c.ApplyPatch() failed, expected no table, have %d", *res.Table)
+	}
+
+	// Patch producing an invalid connection
+	if _, err := c.ApplyPatch([]byte(`[{"op":"remove","path":"/PeerSettings/1"}]`)); err == nil {
+		t.Fatalf("c.ApplyPatch() failed, expected error for invalid connection")
+	}
+
+	// Invalid patch
+	if _, err := c.ApplyPatch([]byte(`[{"op":"remove","path":"/Unknown"}]`)); err == nil {
+		t.Fatalf("c.ApplyPatch() failed, expected error for invalid patch")
+	}
+
+	if !reflect.DeepEqual(c, orig) {
+		t.Fatalf("c.ApplyPatch() failed, original connection was modified")
+	}
+}
+
+func TestConnectionStubMTU(t *testing.T) {
+
+	c := newTestConnection()
+	c.MTU = intPtr(1420)
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+	}
+
+	stub, err := c.Stub()
+	if err != nil {
+		t.Fatalf("c.Stub() failed, unexpected error: %v", err)
+	}
+	if stub.DiscoveredMTU != nil {
+		t.Fatalf("c.Stub() failed, expected no discovered MTU, have %d", *stub.DiscoveredMTU)
+	}
+
+	c.DiscoveredMTU = intPtr(1380)
+	if stub, err = c.Stub(); err != nil {
+		t.Fatalf("c.Stub() failed, unexpected error: %v", err)
+	}
+
+	b, err := json.Marshal(stub)
+	if err != nil {
+		t.Fatalf("json.Marshal() failed, unexpected error: %v", err)
+	}
+	res := &ConnectionListStub{}
+	if err := json.Unmarshal(b, res); err != nil {
+		t.Fatalf("json.Unmarshal() failed, unexpected error: %v", err)
+	}
+	if res.MTU == nil || *res.MTU != 1420 {
+		t.Fatalf("stub round-trip failed, expected MTU %d, have %v", 1420, res.MTU)
+	}
+	if res.DiscoveredMTU == nil || *res.DiscoveredMTU != 1380 {
+		t.Fatalf("stub round-trip failed, expected discovered MTU %d, have %v", 1380, res.DiscoveredMTU)
+	}
+
+	c.MTU = intPtr(100)
+	if err := c.Validate(); err == nil {
+		t.Fatalf("c.Validate() failed, expected error for invalid MTU")
+	}
+}
+
+func TestConnectionTable(t *testing.T) {
+
+	tables := []int{ConnectionTableOff, 1, 100}
+
+	// The highest table ID only fits in an int on 64-bit platforms
+	if upper := maxTableID; upper <= maxInt {
+		tables = append(tables, int(upper))
+	}
+
+	for _, table := range tables {
+		c := newTestConnection()
+		c.Table = intPtr(table)
+		if err := c.Validate(); err != nil {
+			t.Fatalf("c.Validate() failed, unexpected error for table %d: %v", table, err)
+		}
+	}
+
+	for _, table := range []int{0, -2} {
+		c := newTestConnection()
+		c.Table = intPtr(table)
+		if err := c.Validate(); err == nil {
+			t.Fatalf("c.Validate() failed, expected error for table %d", table)
+		}
+	}
+}
+
+func TestConnectionDSCP(t *testing.T) {
+
+	for _, dscp := range []int{0, 46, 63} {
+		c := newTestConnection()
+		c.DSCP = intPtr(dscp)
+		if err := c.Validate(); err != nil {
+			t.Fatalf("c.Validate() failed, unexpected error for DSCP %d: %v", dscp, err)
+		}
+	}
+
+	for _, dscp := range []int{-1, 64} {
+		c := newTestConnection()
+		c.DSCP = intPtr(dscp)
+		if err := c.Validate(); err == nil {
+			t.Fatalf("c.Validate() failed, expected error for DSCP %d", dscp)
+		}
+	}
+
+	c := newTestConnection()
+	c.DSCP = intPtr(10)
+
+	stub, _ := c.Stub()
+	if stub.DSCP == nil || *stub.DSCP != 10 {
+		t.Fatalf("c.Stub() failed, expected DSCP %d, have %v", 10, stub.DSCP)
+	}
+}
+
+func TestConnectionMigrate(t *testing.T) {
+
+	if c := NewConnection(); c.SchemaVersion != ConnectionSchemaVersion {
+		t.Fatalf("NewConnection() failed, expected schema version %d, have %d", ConnectionSchemaVersion, c.SchemaVersion)
+	}
+
+	// Version 1 record, without schema version
+	c := &Connection{
+		ID:        "conn-1",
+		NetworkID: "network-1",
+		PeerSettings: []*PeerSettings{
+			{InterfaceID: "iface-a", RoutingRules: &RoutingRules{AllowedIPs: []string{"10.0.0.1/24", "10.0.0.0/24"}}},
+			{InterfaceID: "iface-b"},
+		},
+	}
+	if err := c.Migrate(c.SchemaVersion); err != nil {
+		t.Fatalf("c.Migrate() failed, unexpected error: %v", err)
+	}
+	if c.SchemaVersion != ConnectionSchemaVersion {
+		t.Fatalf("c.Migrate() failed, expected schema version %d, have %d", ConnectionSchemaVersion, c.SchemaVersion)
+	}
+	if !reflect.DeepEqual(c.PeerSettings[0].RoutingRules.AllowedIPs, []string{"10.0.0.0/24"}) {
+		t.Fatalf("c.Migrate() failed, expected %v, have %v", []string{"10.0.0.0/24"}, c.PeerSettings[0].RoutingRules.AllowedIPs)
+	}
+	if c.PeerSettings[1].RoutingRules == nil {
+		t.Fatalf("c.Migrate() failed, expected routing rules to be initialized")
+	}
+
+	// Future version
+	if err := c.Migrate(ConnectionSchemaVersion + 1); err == nil {
+		t.Fatalf("c.Migrate() failed, expected error for future schema version")
+	}
+}
+
+func TestConnectionValidateOverlappingPeerRoutes(t *testing.T) {
+
+	strict := &ConnectionValidationOptions{RejectOverlappingPeerRoutes: true}
+
+	tests := []struct {
+		a, b  []string
+		valid bool
+	}{
+		{[]string{"10.0.0.0/24"}, []string{"10.0.0.0/24"}, false},
+		{[]string{"10.0.0.0/16"}, []string{"192.168.0.0/24", "10.0.1.0/24"}, false},
+		{[]string{"10.0.0.0/24", "fd00::/64"}, []string{"10.0.1.0/24", "fd01::/64"}, true},
+		{[]string{"0.0.0.0/0", "::/0"}, []string{"0.0.0.0/0", "::/0"}, true},
+		{[]string{"0.0.0.0/0"}, []string{"10.0.1.0/24"}, false},
+	}
+
+	for _, test := range tests {
+		c := newTestConnection()
+		c.PeerSettings[0].RoutingRules.AllowedIPs = test.a
+		c.PeerSettings[1].RoutingRules.AllowedIPs = test.b
+
+		if err := c.Validate(); err != nil {
+			t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+		}
+
+		err := c.ValidateWithOptions(strict)
+		if test.valid && err != nil {
+			t.Fatalf("c.ValidateWithOptions() failed, unexpected error for %v and %v: %v", test.a, test.b, err)
+		}
+		if !test.valid && (err == nil || !strings.Contains(err.Error(), "overlaps")) {
+			t.Fatalf("c.ValidateWithOptions() failed, expected overlap error for %v and %v, have %v", test.a, test.b, err)
+		}
+	}
+}
+
+func TestConnectionValidateIPv4MappedAllowedIPs(t *testing.T) {
+
+	c := newTestConnection()
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.1/32", "192.168.1.0/24", "fd00::/64"}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+	}
+
+	tests := map[string]string{
+		"::ffff:10.0.0.1/128":    "use 10.0.0.1/32 instead",
+		"::ffff:192.168.1.0/120": "use 192.168.1.0/24 instead",
+	}
+	for ip, expected := range tests {
+		c.PeerSettings[0].RoutingRules.AllowedIPs = []string{ip}
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("c.Validate() failed, expected error containing %q for %s, have %v", expected, ip, err)
+		}
+	}
+}
+
+func TestConnectionValidateCanonicalCIDRs(t *testing.T) {
+
+	opts := &ConnectionValidationOptions{RequireCanonicalCIDRs: true}
+
+	c := newTestConnection()
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.1/32", "192.168.1.0/24", "fd00::/64"}
+	if err := c.ValidateWithOptions(opts); err != nil {
+		t.Fatalf("c.ValidateWithOptions() failed, unexpected error: %v", err)
+	}
+
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.1/32", "192.168.1.7/24"}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+	}
+	if err := c.ValidateWithOptions(opts); err == nil || !strings.Contains(err.Error(), "192.168.1.7/24 is not in canonical form, use 192.168.1.0/24") {
+		t.Fatalf("c.ValidateWithOptions() failed, expected error for non-canonical CIDR, have %v", err)
+	}
+}
+
+func TestConnectionValidateDocumentationRanges(t *testing.T) {
+
+	strict := &ConnectionValidationOptions{RejectDocumentationRanges: true}
+
+	for _, route := range []string{"192.0.2.0/24", "198.51.100.7/32", "203.0.113.128/25"} {
+		c := newTestConnection()
+		c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.1/32", route}
+		if err := c.Validate(); err != nil {
+			t.Fatalf("c.Validate() failed, unexpected error for %s: %v", route, err)
+		}
+		err := c.ValidateWithOptions(strict)
+		if err == nil || !strings.Contains(err.Error(), "documentation range") {
+			t.Fatalf("c.ValidateWithOptions() failed, expected documentation range error for %s, have %v", route, err)
+		}
+	}
+
+	c := newTestConnection()
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"198.51.0.0/24"}
+	if err := c.ValidateWithOptions(strict); err != nil {
+		t.Fatalf("c.ValidateWithOptions() failed, unexpected error: %v", err)
+	}
+}
+
+func TestConnectionValidateTags(t *testing.T) {
+
+	c := newTestConnection()
+	c.Tags = map[string]string{}
+	for i := 0; i < 32; i++ {
+		c.Tags[fmt.Sprintf("key-%d", i)] = "value"
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+	}
+
+	c.Tags["key-32"] = "value"
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "too many tags") {
+		t.Fatalf("c.Validate() failed, expected error for too many tags, have %v", err)
+	}
+
+	c.Tags = map[string]string{"owner": strings.Repeat("a", 255)}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+	}
+
+	c.Tags["owner"] += "a"
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "owner") {
+		t.Fatalf("c.Validate() failed, expected error for oversized tag value, have %v", err)
+	}
+
+	c.Tags = map[string]string{strings.Repeat("k", 64): "value"}
+	if err := c.Validate(); err == nil {
+		t.Fatalf("c.Validate() failed, expected error for oversized tag key")
+	}
+}
+
+func TestConnectionValidateIdentifiers(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		modify func(c *Connection)
+		err    string
+	}{
+		{"clean IDs", func(c *Connection) {}, ""},
+		{"trailing space in interface ID", func(c *Connection) { c.PeerSettings[0].InterfaceID = "iface-a " }, "whitespace"},
+		{"leading space in node ID", func(c *Connection) { c.PeerSettings[1].NodeID = " node-b" }, "whitespace"},
+		{"embedded newline in node ID", func(c *Connection) { c.PeerSettings[0].NodeID = "node\na" }, "non-printable"},
+		{"control character in network ID", func(c *Connection) { c.NetworkID = "network\x001" }, "non-printable"},
+	}
+
+	for _, tt := range tests {
+		c := newTestConnection()
+		tt.modify(c)
+		err := c.Validate()
+		if tt.err == "" && err != nil {
+			t.Fatalf("%s: c.Validate() failed, unexpected error: %v", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Fatalf("%s: c.Validate() failed, expected error containing %q, have %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestConnectionValidateDescription(t *testing.T) {
+
+	c := newTestConnection()
+	c.Description = strings.Repeat("a", 256)
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+	}
+
+	// Over the limit in bytes, but not in characters
+	c.Description = strings.Repeat("ø", 200)
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+	}
+
+	c.Description = strings.Repeat("ø", 257)
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "description too long") {
+		t.Fatalf("c.Validate() failed, expected error for oversized description, have %v", err)
+	}
+}
+
+func TestConnectionValidateAlerting(t *testing.T) {
+
+	tests := []struct {
+		alerting *AlertConfig
+		valid    bool
+	}{
+		{&AlertConfig{}, true},
+		{&AlertConfig{HandshakeTimeout: intPtr(300), MinThroughputKbps: intPtr(1000)}, true},
+		{&AlertConfig{HandshakeTimeout: intPtr(60)}, false},
+		{&AlertConfig{HandshakeTimeout: intPtr(8 * 24 * 60 * 60)}, false},
+		{&AlertConfig{MinThroughputKbps: intPtr(0)}, true},
+		{&AlertConfig{MinThroughputKbps: intPtr(-1)}, false},
+	}
+
+	for _, tt := range tests {
+		c := newTestConnection()
+		c.Alerting = tt.alerting
+		if err := c.Validate(); (err == nil) != tt.valid {
+			t.Fatalf("c.Validate() failed for %+v, expected valid=%v, have %v", tt.alerting, tt.valid, err)
+		}
+	}
+}
+
+func TestConnectionMergeAlerting(t *testing.T) {
+
+	c := newTestConnection()
+	c.Alerting = &AlertConfig{HandshakeTimeout: intPtr(300)}
+
+	res := mustMerge(t, c, &Connection{Alerting: &AlertConfig{MinThroughputKbps: intPtr(1000)}})
+	expected := &AlertConfig{HandshakeTimeout: intPtr(300), MinThroughputKbps: intPtr(1000)}
+	if !reflect.DeepEqual(res.Alerting, expected) {
+		t.Fatalf("c.Merge() failed, expected %+v, have %+v", expected, res.Alerting)
+	}
+	if c.Alerting.MinThroughputKbps != nil {
+		t.Fatalf("c.Merge() failed, original alerting settings were modified")
+	}
+
+	if res := mustMerge(t, c, &Connection{}); !reflect.DeepEqual(res.Alerting, c.Alerting) {
+		t.Fatalf("c.Merge() failed, expected %+v, have %+v", c.Alerting, res.Alerting)
+	}
+
+	c.Alerting = nil
+	if res := mustMerge(t, c, &Connection{Alerting: expected}); !reflect.DeepEqual(res.Alerting, expected) {
+		t.Fatalf("c.Merge() failed, expected %+v, have %+v", expected, res.Alerting)
+	}
+}
+
+func TestConnectionMTUProbeInterval(t *testing.T) {
+
+	c := newTestConnection()
+	for _, v := range []*int{nil, intPtr(1), intPtr(600)} {
+		c.MTUProbeInterval = v
+		if err := c.Validate(); err != nil {
+			t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+		}
+	}
+	for _, v := range []int{0, -60} {
+		c.MTUProbeInterval = intPtr(v)
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "MTU probe interval") {
+			t.Fatalf("c.Validate() failed, expected error for probe interval %d, have %v", v, err)
+		}
+	}
+}
+
+func TestConnectionRekeyInterval(t *testing.T) {
+
+	c := newTestConnection()
+	for _, v := range []*int{nil, intPtr(10), intPtr(60), intPtr(120)} {
+		c.RekeyInterval = v
+		if err := c.Validate(); err != nil {
+			t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+		}
+	}
+	for _, v := range []int{0, 9, 121, 180} {
+		c.RekeyInterval = intPtr(v)
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "rekey interval") {
+			t.Fatalf("c.Validate() failed, expected error for rekey interval %d, have %v", v, err)
+		}
+	}
+}
+
+func TestConnectionLogLevel(t *testing.T) {
+
+	c := newTestConnection()
+	for _, l := range []string{"off", "info", "debug", "trace"} {
+		c.LogLevel = strPtr(l)
+		if err := c.Validate(); err != nil {
+			t.Fatalf("c.Validate() failed, unexpected error for log level %s: %v", l, err)
+		}
+	}
+	for _, l := range []string{"", "warn", "DEBUG"} {
+		c.LogLevel = strPtr(l)
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "invalid log level") {
+			t.Fatalf("c.Validate() failed, expected error for log level %q, have %v", l, err)
+		}
+	}
+}
+
+func TestConnectionCipherSuite(t *testing.T) {
+
+	c := newTestConnection()
+	for _, s := range []string{CipherSuiteAES128GCM, CipherSuiteAES256GCM, CipherSuiteChaCha20Poly1305} {
+		c.CipherSuite = strPtr(s)
+		if err := c.Validate(); err != nil {
+			t.Fatalf("c.Validate() failed, unexpected error for cipher suite %s: %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "rc4", "AES-256-GCM"} {
+		c.CipherSuite = strPtr(s)
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "invalid cipher suite") {
+			t.Fatalf("c.Validate() failed, expected error for cipher suite %q, have %v", s, err)
+		}
+	}
+
+	c.CipherSuite = strPtr(CipherSuiteAES256GCM)
+	stub, err := c.Stub()
+	if err != nil {
+		t.Fatalf("c.Stub() failed, unexpected error: %v", err)
+	}
+	if stub.CipherSuite == nil || *stub.CipherSuite != CipherSuiteAES256GCM {
+		t.Fatalf("c.Stub() failed, expected cipher suite %s, have %v", CipherSuiteAES256GCM, stub.CipherSuite)
+	}
+}
+
+func TestConnectionMergeTags(t *testing.T) {
+
+	c := newTestConnection()
+	c.Tags = map[string]string{"owner": "team-a", "purpose": "backup"}
+
+	res := mustMerge(t, c, &Connection{Tags: map[string]string{"owner": "team-b", "env": "prod"}})
+	expected := map[string]string{"owner": "team-b", "purpose": "backup", "env": "prod"}
+	if !reflect.DeepEqual(res.Tags, expected) {
+		t.Fatalf("c.Merge() failed, expected %v, have %v", expected, res.Tags)
+	}
+	if c.Tags["owner"] != "team-a" {
+		t.Fatalf("c.Merge() failed, original tags were modified")
+	}
+}
+
+func TestConnectionMergeGroupID(t *testing.T) {
+
+	c := newTestConnection()
+	c.GroupID = strPtr("site-a")
+
+	if res := mustMerge(t, c, &Connection{}); !res.InGroup("site-a") {
+		t.Fatalf("c.Merge() failed, expected group to be preserved, have %v", res.GroupID)
+	}
+
+	res := mustMerge(t, c, &Connection{GroupID: strPtr("site-b")})
+	if !res.InGroup("site-b") {
+		t.Fatalf("c.Merge() failed, expected group site-b, have %v", res.GroupID)
+	}
+	if !c.InGroup("site-a") {
+		t.Fatalf("c.Merge() failed, original group was modified")
+	}
+
+	stub, err := res.Stub()
+	if err != nil {
+		t.Fatalf("res.Stub() failed, unexpected error: %v", err)
+	}
+	if stub.GroupID == nil || *stub.GroupID != "site-b" {
+		t.Fatalf("res.Stub() failed, expected group site-b, have %v", stub.GroupID)
+	}
+}
+
+func TestRoutingRulesRouteTags(t *testing.T) {
+
+	r := &RoutingRules{
+		AllowedIPs: []string{"10.0.0.0/24", "192.168.1.0/24"},
+		RouteTags:  map[string][]string{"10.0.0.0/24": {"critical"}},
+	}
+
+	// Tags are merged additively, regardless of the form of the CIDR
+	res := r.Merge(&RoutingRules{RouteTags: map[string][]string{
+		"10.0.0.1/24":    {"monitored", "critical"},
+		"192.168.1.0/24": {"monitored"},
+	}})
+	expected := map[string][]string{
+		"10.0.0.0/24":    {"critical", "monitored"},
+		"192.168.1.0/24": {"monitored"},
+	}
+	if !reflect.DeepEqual(res.RouteTags, expected) {
+		t.Fatalf("r.Merge() failed, expected %v, have %v", expected, res.RouteTags)
+	}
+	if !reflect.DeepEqual(r.RouteTags, map[string][]string{"10.0.0.0/24": {"critical"}}) {
+		t.Fatalf("r.Merge() failed, original tags were modified")
+	}
+
+	// Tags of removed routes are dropped
+	removed := res.Merge(&RoutingRules{AllowedIPs: []string{"10.1.0.0/24", "192.168.1.0/24"}})
+	expected = map[string][]string{"192.168.1.0/24": {"monitored"}}
+	if !reflect.DeepEqual(removed.RouteTags, expected) {
+		t.Fatalf("r.Merge() failed, expected %v, have %v", expected, removed.RouteTags)
+	}
+	if err := (&PeerSettings{InterfaceID: "iface-a", NodeID: "node-a", RoutingRules: removed}).Validate(); err != nil {
+		t.Fatalf("p.Validate() failed, unexpected error: %v", err)
+	}
+
+	p := &PeerSettings{InterfaceID: "iface-a", NodeID: "node-a", RoutingRules: res}
+	if err := p.Validate(); err != nil {
+		t.Fatalf("p.Validate() failed, unexpected error: %v", err)
+	}
+
+	// Orphan tags
+	p.RoutingRules.AllowedIPs = []string{"10.0.0.0/24"}
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "192.168.1.0/24") {
+		t.Fatalf("p.Validate() failed, expected error naming the orphan route, have %v", err)
+	}
+}
+
+func TestConnectionValidateDisabled(t *testing.T) {
+
+	c := newTestConnection()
+	c.Enabled = boolPtr(false)
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+	}
+
+	tests := map[string]func(c *Connection){
+		"single peer":     func(c *Connection) { c.PeerSettings = c.PeerSettings[:1] },
+		"self connection": func(c *Connection) { c.PeerSettings[1].InterfaceID = "iface-a" },
+		"invalid route":   func(c *Connection) { c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.1"} },
+	}
+
+	for name, mutate := range tests {
+		c := newTestConnection()
+		c.Enabled = boolPtr(false)
+		mutate(c)
+		if err := c.Validate(); err == nil {
+			t.Fatalf("c.Validate() failed, expected error for disabled connection with %s", name)
+		}
+	}
+}
+
+func TestConnectionFwMark(t *testing.T) {
+
+	marks := []int{0, 51820}
+
+	// The highest mark only fits in an int on 64-bit platforms
+	if upper := maxFwMark; upper <= maxInt {
+		marks = append(marks, int(upper))
+	}
+
+	for _, mark := range marks {
+		c := newTestConnection()
+		c.FwMark = intPtr(mark)
+		if err := c.Validate(); err != nil {
+			t.Fatalf("c.Validate() failed, unexpected error for firewall mark %d: %v", mark, err)
+		}
+	}
+
+	c := newTestConnection()
+	c.FwMark = intPtr(-1)
+	if err := c.Validate(); err == nil {
+		t.Fatalf("c.Validate() failed, expected error for negative firewall mark")
+	}
+}
+
+func TestConnectionValidateWithInterfacesNetwork(t *testing.T) {
+
+	ifaces := map[string]*Interface{
+		"iface-a": {ID: "iface-a", NodeID: "node-a", NetworkID: "network-1"},
+		"iface-b": {ID: "iface-b", NodeID: "node-b", NetworkID: "network-1"},
+	}
+
+	// Consistent network references
+	c := newTestConnection()
+	if err := c.ValidateWithInterfaces(ifaces); err != nil {
+		t.Fatalf("c.ValidateWithInterfaces() failed, unexpected error: %v", err)
+	}
+
+	// Network not yet assigned
+	c.NetworkID = ""
+	if err := c.ValidateWithInterfaces(ifaces); err != nil {
+		t.Fatalf("c.ValidateWithInterfaces() failed, unexpected error: %v", err)
+	}
+
+	// Divergent network references
+	c.NetworkID = "network-1"
+	ifaces["iface-b"].NetworkID = "network-2"
+	err := c.ValidateWithInterfaces(ifaces)
+	if err == nil || !strings.Contains(err.Error(), "network-2") {
+		t.Fatalf("c.ValidateWithInterfaces() failed, expected error naming the divergent network, have %v", err)
+	}
+}
+
+func TestConnectionTransport(t *testing.T) {
+
+	for _, transport := range []string{"", TransportWireGuard, TransportWireGuardOverTCP, TransportObfuscated} {
+		c := newTestConnection()
+		c.Transport = transport
+		if err := c.Validate(); err != nil {
+			t.Fatalf("c.Validate() failed, unexpected error for transport %q: %v", transport, err)
+		}
+	}
+
+	c := newTestConnection()
+	c.Transport = "udp"
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "invalid transport udp") {
+		t.Fatalf("c.Validate() failed, expected error for invalid transport, have %v", err)
+	}
+
+	c.Transport = TransportWireGuardOverTCP
+	if stub, _ := c.Stub(); stub.Transport != TransportWireGuardOverTCP {
+		t.Fatalf("c.Stub() failed, expected transport %s, have %s", TransportWireGuardOverTCP, stub.Transport)
+	}
+}
+
+func TestConnectionValidateMissingIDs(t *testing.T) {
+
+	c := newTestConnection()
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+	}
+
+	c.PeerSettings[1].InterfaceID = ""
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "missing an interface ID") {
+		t.Fatalf("c.Validate() failed, expected missing interface ID error, have %v", err)
+	}
+
+	c = newTestConnection()
+	c.PeerSettings[1].NodeID = ""
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "interface iface-b) is missing a node ID") {
+		t.Fatalf("c.Validate() failed, expected missing node ID error, have %v", err)
+	}
+}
+
+func TestConnectionValidateStrictMeshRouteCount(t *testing.T) {
+
+	strict := &ConnectionValidationOptions{StrictMesh: true}
+
+	// Symmetric counts, even if routes differ
+	c := newTestConnection()
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.1/32", "192.168.1.0/24"}
+	c.PeerSettings[1].RoutingRules.AllowedIPs = []string{"10.0.0.2/32", "192.168.2.0/24"}
+	if err := c.ValidateWithOptions(strict); err != nil {
+		t.Fatalf("c.ValidateWithOptions() failed, unexpected error: %v", err)
+	}
+
+	// Asymmetric counts
+	c.PeerSettings[1].RoutingRules.AllowedIPs = []string{"10.0.0.2/32"}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("c.Validate() failed, unexpected error: %v", err)
+	}
+	err := c.ValidateWithOptions(strict)
+	if err == nil || !strings.Contains(err.Error(), "asymmetric routes") {
+		t.Fatalf("c.ValidateWithOptions() failed, expected asymmetric routes error, have %v", err)
+	}
+}
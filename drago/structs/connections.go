@@ -0,0 +1,779 @@
+package structs
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GroupConnectionsBySubnet : returns, for each of the subnets passed as argument,
+// the IDs of the connections whose AllowedIPs overlap with that subnet.
+func GroupConnectionsBySubnet(conns []*Connection, subnets []string) (map[string][]string, error) {
+
+	parsed, err := parseCIDRs(subnets)
+	if err != nil {
+		return nil, err
+	}
+
+	res := map[string][]string{}
+	for _, s := range subnets {
+		res[s] = []string{}
+	}
+
+	for _, c := range conns {
+
+		routes := []string{}
+		for _, peer := range c.PeerSettings {
+			if peer.RoutingRules != nil {
+				routes = append(routes, peer.RoutingRules.AllowedIPs...)
+			}
+		}
+
+		nets, err := parseCIDRs(routes)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, subnet := range parsed {
+			for _, n := range nets {
+				if cidrsOverlap(subnet, n) {
+					res[subnets[i]] = append(res[subnets[i]], c.ID)
+					break
+				}
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// SetKeepaliveForConnections : sets the persistent keepalive of all the connections
+// passed as argument, or clears it if nil. Peer-level overrides are cleared as well,
+// so that the same value applies to every peer, and would otherwise conflict.
+func SetKeepaliveForConnections(conns []*Connection, seconds *int) error {
+
+	if seconds != nil {
+		if err := validateKeepalive(*seconds); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+
+	for _, c := range conns {
+		if seconds != nil {
+			v := *seconds
+			c.PersistentKeepalive = &v
+		} else {
+			c.PersistentKeepalive = nil
+		}
+		for _, peer := range c.PeerSettings {
+			peer.PersistentKeepalive = nil
+		}
+		c.UpdatedAt = now
+	}
+
+	return nil
+}
+
+// MergeConnections : folds connections between the same pair of interfaces
+// into a single connection, by merging them in the order they are passed.
+// Connections are returned in the order their pair first appears, and the
+// ones passed as argument are not modified.
+func MergeConnections(conns []*Connection) ([]*Connection, error) {
+
+	res := []*Connection{}
+	byKey := map[string]int{}
+
+	for _, c := range conns {
+		key := c.CanonicalKey()
+		i, ok := byKey[key]
+		if !ok {
+			byKey[key] = len(res)
+			res = append(res, c.Clone())
+			continue
+		}
+		if res[i].NetworkID != c.NetworkID {
+			return nil, fmt.Errorf("conflicting networks for interfaces %s: %s and %s", key, res[i].NetworkID, c.NetworkID)
+		}
+		merged, err := res[i].Merge(c.Clone())
+		if err != nil {
+			return nil, err
+		}
+		res[i] = merged
+	}
+
+	return res, nil
+}
+
+// SnapshotConnections : returns deep copies of the connections passed as argument,
+// which are fully independent of the originals, e.g. for staging changes to them.
+func SnapshotConnections(conns []*Connection) []*Connection {
+	res := make([]*Connection, len(conns))
+	for i, c := range conns {
+		res[i] = c.Clone()
+	}
+	return res
+}
+
+// ConnectionWritePlan : contains the writes needed for turning a set of
+// connections into another one.
+type ConnectionWritePlan struct {
+	Creates []*Connection
+	Updates []*Connection
+	Deletes []string
+}
+
+// IsEmpty : checks whether the plan contains no writes.
+func (p *ConnectionWritePlan) IsEmpty() bool {
+	return len(p.Creates) == 0 && len(p.Updates) == 0 && len(p.Deletes) == 0
+}
+
+// Reconcile : returns the minimal plan for turning the current set of connections into
+// the desired one, matching connections by ID. Connections which are identical in both
+// sets are left out of the plan, creates and updates follow the order of the desired set,
+// and deletes the order of the current one.
+func Reconcile(current, desired []*Connection) *ConnectionWritePlan {
+
+	plan := &ConnectionWritePlan{
+		Creates: []*Connection{},
+		Updates: []*Connection{},
+		Deletes: []string{},
+	}
+
+	byID := map[string]*Connection{}
+	for _, c := range current {
+		byID[c.ID] = c
+	}
+
+	wanted := map[string]struct{}{}
+	for _, c := range desired {
+		wanted[c.ID] = struct{}{}
+		old, ok := byID[c.ID]
+		switch {
+		case !ok:
+			plan.Creates = append(plan.Creates, c)
+		case !reflect.DeepEqual(old, c):
+			plan.Updates = append(plan.Updates, c)
+		}
+	}
+
+	for _, c := range current {
+		if _, ok := wanted[c.ID]; !ok {
+			plan.Deletes = append(plan.Deletes, c.ID)
+		}
+	}
+
+	return plan
+}
+
+// ReachabilityGraph : returns, for each node in the connections passed as argument,
+// the sorted IDs of the nodes it can reach. Besides the nodes it is directly connected
+// to, a node can reach another one through intermediate hops, as long as each of them
+// routes the addresses of the destination (i.e. the AllowedIPs configured for it in
+// its own connections) towards the next hop.
+func ReachabilityGraph(conns []*Connection) map[string][]string {
+
+	type link struct {
+		to     string
+		routes []*net.IPNet
+	}
+
+	links := map[string][]link{}
+	addrs := map[string][]*net.IPNet{}
+
+	for _, c := range conns {
+		if len(c.PeerSettings) != 2 {
+			continue
+		}
+		a, b := c.PeerSettings[0], c.PeerSettings[1]
+		if a.NodeID == "" || b.NodeID == "" || a.NodeID == b.NodeID {
+			continue
+		}
+		ra, rb := peerRoutes(a), peerRoutes(b)
+		links[a.NodeID] = append(links[a.NodeID], link{to: b.NodeID, routes: rb})
+		links[b.NodeID] = append(links[b.NodeID], link{to: a.NodeID, routes: ra})
+		addrs[a.NodeID] = append(addrs[a.NodeID], ra...)
+		addrs[b.NodeID] = append(addrs[b.NodeID], rb...)
+	}
+
+	routesTo := func(routes []*net.IPNet, dst string) bool {
+		for _, r := range routes {
+			for _, addr := range addrs[dst] {
+				if cidrsOverlap(r, addr) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	res := map[string][]string{}
+	for src := range links {
+		res[src] = []string{}
+		for dst := range links {
+			if dst == src {
+				continue
+			}
+			found := false
+			visited := map[string]struct{}{src: {}}
+			queue := []string{src}
+			for len(queue) > 0 && !found {
+				cur := queue[0]
+				queue = queue[1:]
+				for _, l := range links[cur] {
+					if l.to == dst {
+						found = true
+						break
+					}
+					if _, ok := visited[l.to]; !ok && routesTo(l.routes, dst) {
+						visited[l.to] = struct{}{}
+						queue = append(queue, l.to)
+					}
+				}
+			}
+			if found {
+				res[src] = append(res[src], dst)
+			}
+		}
+		sort.Strings(res[src])
+	}
+
+	return res
+}
+
+// peerRoutes returns the parsed AllowedIPs of a peer, skipping invalid ones.
+func peerRoutes(peer *PeerSettings) []*net.IPNet {
+	routes := []*net.IPNet{}
+	if peer.RoutingRules == nil {
+		return routes
+	}
+	for _, r := range peer.RoutingRules.AllowedIPs {
+		if _, n, err := net.ParseCIDR(r); err == nil {
+			routes = append(routes, n)
+		}
+	}
+	return routes
+}
+
+// ValidateConnections : validates each of the connections passed as argument,
+// returning all the errors found in each invalid connection, keyed by its index.
+// Valid connections have no entry in the result.
+func ValidateConnections(conns []*Connection) map[int][]error {
+
+	res := map[int][]error{}
+	for i, c := range conns {
+		if errs := c.ValidateAll(); len(errs) > 0 {
+			res[i] = errs
+		}
+	}
+
+	return res
+}
+
+// Limits : contains the limits enforced by ValidateNetwork. Zero values
+// mean no limit is enforced.
+type Limits struct {
+	// MaxRoutesPerConnection is the maximum number of AllowedIPs
+	// in a connection, adding up those of both peers.
+	MaxRoutesPerConnection int
+
+	// MaxConnectionsPerInterface is the maximum number of
+	// connections an interface can be part of.
+	MaxConnectionsPerInterface int
+}
+
+// ValidateNetwork : checks the invariants which span the connections of a network,
+// and which can't be checked by validating each of them separately. Unlike Validate,
+// it does not stop at the first violation, but returns all of them, so that they
+// can be reported together. The IDs passed as argument are those of the interfaces
+// in the network, which are expected to take part in at least one connection.
+func ValidateNetwork(conns []*Connection, ifaceIDs []string, limits Limits) []error {
+
+	errs := []error{}
+
+	type route struct {
+		net    *net.IPNet
+		peerID string
+		connID string
+	}
+
+	pairs := map[string]string{}
+	routesByInterface := map[string][]route{}
+	connsByInterface := map[string]int{}
+
+	for _, c := range conns {
+
+		if err := c.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("connection %s is invalid: %v", c.ID, err))
+			continue
+		}
+
+		key := c.CanonicalKey()
+		if id, ok := pairs[key]; ok {
+			errs = append(errs, fmt.Errorf("connections %s and %s connect the same interfaces %s", id, c.ID, key))
+			continue
+		}
+		pairs[key] = c.ID
+
+		count := 0
+		for i, peer := range c.PeerSettings {
+			other := c.PeerSettings[1-i]
+			connsByInterface[peer.InterfaceID]++
+			for _, n := range peerRoutes(peer) {
+				routesByInterface[peer.InterfaceID] = append(routesByInterface[peer.InterfaceID], route{net: n, peerID: other.InterfaceID, connID: c.ID})
+				count++
+			}
+		}
+
+		if limits.MaxRoutesPerConnection > 0 && count > limits.MaxRoutesPerConnection {
+			errs = append(errs, fmt.Errorf("connection %s has %d routes, exceeding the limit of %d", c.ID, count, limits.MaxRoutesPerConnection))
+		}
+	}
+
+	ids := []string{}
+	for id := range routesByInterface {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// Routes towards different peers of the same interface can't overlap,
+	// as WireGuard would not be able to tell to which peer to send traffic.
+	for _, id := range ids {
+		routes := routesByInterface[id]
+		for i := range routes {
+			for j := i + 1; j < len(routes); j++ {
+				a, b := routes[i], routes[j]
+				if a.peerID != b.peerID && cidrsOverlap(a.net, b.net) {
+					errs = append(errs, fmt.Errorf("routes %s (connection %s) and %s (connection %s) of interface %s overlap",
+						a.net, a.connID, b.net, b.connID, id))
+				}
+			}
+		}
+	}
+
+	ids = unionStrings(ifaceIDs)
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		n := connsByInterface[id]
+		if n == 0 {
+			errs = append(errs, fmt.Errorf("interface %s is not connected to any peer", id))
+		}
+		if limits.MaxConnectionsPerInterface > 0 && n > limits.MaxConnectionsPerInterface {
+			errs = append(errs, fmt.Errorf("interface %s has %d connections, exceeding the limit of %d", id, n, limits.MaxConnectionsPerInterface))
+		}
+	}
+
+	return errs
+}
+
+// ValidateRouteReachability : checks that each route advertised by the peers of a
+// connection is covered by an entry of the routing table of the peer's node, keyed
+// by node ID in the map passed as argument, and returns an error for every route
+// the node can't forward traffic to.
+func ValidateRouteReachability(c *Connection, nodeRoutes map[string][]string) []error {
+
+	errs := []error{}
+
+	for _, peer := range c.PeerSettings {
+
+		table := []*net.IPNet{}
+		for _, r := range nodeRoutes[peer.NodeID] {
+			n, err := parseIPOrCIDR(r)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid routing table entry %s of node %s: %v", r, peer.NodeID, err))
+				continue
+			}
+			table = append(table, n)
+		}
+
+		if peer.RoutingRules == nil {
+			continue
+		}
+		for _, r := range peer.RoutingRules.AllowedIPs {
+			_, n, err := net.ParseCIDR(r)
+			if err != nil {
+				continue
+			}
+			reachable := false
+			for _, t := range table {
+				if cidrContains(t, n) {
+					reachable = true
+					break
+				}
+			}
+			if !reachable {
+				errs = append(errs, fmt.Errorf("interface %s advertises %s, which node %s has no route to", peer.InterfaceID, r, peer.NodeID))
+			}
+		}
+	}
+
+	return errs
+}
+
+// ReassignInterface : replaces the interface oldID with newID, owned by node newNodeID,
+// in all the connections it is part of, and returns copies of the updated connections.
+// Unaffected connections are skipped. If any of the replacements fails, an error is
+// returned, and none of the connections is updated.
+func ReassignInterface(conns []*Connection, oldID, newID, newNodeID string) ([]*Connection, error) {
+
+	updated := []*Connection{}
+
+	for _, c := range conns {
+		if !c.ConnectsInterface(oldID) {
+			continue
+		}
+		u := c.Clone()
+		if err := u.ReplacePeerInterface(oldID, newID, newNodeID); err != nil {
+			return nil, err
+		}
+		updated = append(updated, u)
+	}
+
+	return updated, nil
+}
+
+// ToStarTopology : returns the connections forming a star topology around the hub node,
+// equivalent to the ones passed as argument. Each of the other nodes is connected only
+// to the hub, advertising the routes it advertised in any of its connections, while the
+// hub advertises the routes of all the other nodes, so that spokes can reach each other
+// through it. Other peer settings are taken from the first connection of each interface,
+// and the resulting connections are returned sorted by spoke node ID.
+func ToStarTopology(conns []*Connection, hubNode string) ([]*Connection, error) {
+
+	networkID := ""
+	peers := map[string]*PeerSettings{}
+	routes := map[string][]string{}
+
+	for _, c := range conns {
+		if networkID != "" && c.NetworkID != networkID {
+			return nil, fmt.Errorf("connections belong to different networks: %s and %s", networkID, c.NetworkID)
+		}
+		networkID = c.NetworkID
+
+		for _, peer := range c.PeerSettings {
+			if p, ok := peers[peer.NodeID]; !ok {
+				peers[peer.NodeID] = peer
+			} else if p.InterfaceID != peer.InterfaceID {
+				return nil, fmt.Errorf("node %s has more than one interface: %s and %s", peer.NodeID, p.InterfaceID, peer.InterfaceID)
+			}
+			if peer.RoutingRules != nil {
+				routes[peer.NodeID] = append(routes[peer.NodeID], peer.RoutingRules.AllowedIPs...)
+			}
+		}
+	}
+
+	hub, ok := peers[hubNode]
+	if !ok {
+		return nil, fmt.Errorf("node %s is not part of any connection", hubNode)
+	}
+
+	hubRoutes := []string{}
+	spokes := []string{}
+	for id := range peers {
+		hubRoutes = append(hubRoutes, routes[id]...)
+		if id != hubNode {
+			spokes = append(spokes, id)
+		}
+	}
+	sort.Strings(spokes)
+
+	res := []*Connection{}
+	for _, id := range spokes {
+		c := NewConnection()
+		c.NetworkID = networkID
+
+		h := hub.Clone()
+		s := peers[id].Clone()
+
+		// The hub advertises everything but the spoke's own routes
+		h.RoutingRules = &RoutingRules{AllowedIPs: subtractStrings(normalizedCIDRSet(hubRoutes), normalizedCIDRSet(routes[id]))}
+		s.RoutingRules = &RoutingRules{AllowedIPs: normalizedCIDRSet(routes[id])}
+		c.PeerSettings = []*PeerSettings{h, s}
+
+		if err := c.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid connection between %s and %s: %v", hubNode, id, err)
+		}
+		res = append(res, c)
+	}
+
+	return res, nil
+}
+
+// PeerCountByInterface : returns, for each interface in the connections passed as argument,
+// the number of peers it is connected to. Parallel connections between the same interfaces
+// count as a single peer, since they are rendered as such in the WireGuard configuration.
+func PeerCountByInterface(conns []*Connection) map[string]int {
+
+	peers := map[string]map[string]struct{}{}
+	for _, c := range conns {
+		if len(c.PeerSettings) != 2 {
+			continue
+		}
+		for i, peer := range c.PeerSettings {
+			if _, ok := peers[peer.InterfaceID]; !ok {
+				peers[peer.InterfaceID] = map[string]struct{}{}
+			}
+			peers[peer.InterfaceID][c.PeerSettings[1-i].InterfaceID] = struct{}{}
+		}
+	}
+
+	res := map[string]int{}
+	for id, p := range peers {
+		res[id] = len(p)
+	}
+
+	return res
+}
+
+// InterfacesOverPeerLimit : returns the sorted IDs of the interfaces
+// whose peer count, as returned by PeerCountByInterface, exceeds the limit.
+func InterfacesOverPeerLimit(counts map[string]int, limit int) []string {
+
+	res := []string{}
+	for id, n := range counts {
+		if n > limit {
+			res = append(res, id)
+		}
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+// FindCrossNetworkConnections : returns the IDs of the connections whose peers'
+// interfaces belong to different networks, according to the map of interface IDs
+// to network IDs passed as argument, such as after merging or splitting networks.
+// Interfaces missing from the map are ignored.
+func FindCrossNetworkConnections(conns []*Connection, ifaceNetwork map[string]string) []string {
+
+	res := []string{}
+	for _, c := range conns {
+		if len(c.PeerSettings) != 2 {
+			continue
+		}
+		a, okA := ifaceNetwork[c.PeerSettings[0].InterfaceID]
+		b, okB := ifaceNetwork[c.PeerSettings[1].InterfaceID]
+		if okA && okB && a != b {
+			res = append(res, c.ID)
+		}
+	}
+
+	return res
+}
+
+// ValidateNoPortCollision : checks that the listen ports pinned by the peers on a node
+// don't collide, i.e. that no two different interfaces of the node are set to listen on
+// the same port. Connections of the same interface may share a port, since an interface
+// listens on a single one.
+func ValidateNoPortCollision(nodeID string, conns []*Connection) error {
+
+	type binding struct {
+		interfaceID  string
+		connectionID string
+	}
+
+	ports := map[int]binding{}
+	for _, c := range conns {
+		for _, peer := range c.PeerSettings {
+			if peer.NodeID != nodeID || peer.ListenPort == nil {
+				continue
+			}
+			b, ok := ports[*peer.ListenPort]
+			if !ok {
+				ports[*peer.ListenPort] = binding{interfaceID: peer.InterfaceID, connectionID: c.ID}
+				continue
+			}
+			if b.interfaceID != peer.InterfaceID {
+				return fmt.Errorf("connections %s and %s both use listen port %d on node %s", b.connectionID, c.ID, *peer.ListenPort, nodeID)
+			}
+		}
+	}
+
+	return nil
+}
+
+// RetagConnections : sets the value of the tag key to newValue in all the connections
+// passed as argument in which it is currently set to oldValue, and returns the number
+// of connections changed. Other connections are left untouched.
+func RetagConnections(conns []*Connection, key, oldValue, newValue string) int {
+
+	now := time.Now()
+	changed := 0
+
+	for _, c := range conns {
+		if v, ok := c.Tags[key]; !ok || v != oldValue || v == newValue {
+			continue
+		}
+		c.Tags[key] = newValue
+		c.UpdatedAt = now
+		changed++
+	}
+
+	return changed
+}
+
+// InterfaceAdvertisedRoutes : returns the union of the AllowedIPs advertised by an
+// interface across all the connections passed as argument, in canonical form and
+// without duplicates. Connections not involving the interface are ignored.
+func InterfaceAdvertisedRoutes(interfaceID string, conns []*Connection) ([]string, error) {
+
+	routes := []string{}
+	for _, c := range conns {
+		peer := c.PeerSettingsByInterfaceID(interfaceID)
+		if peer == nil || peer.RoutingRules == nil {
+			continue
+		}
+		for _, r := range peer.RoutingRules.AllowedIPs {
+			if _, _, err := net.ParseCIDR(r); err != nil {
+				return nil, fmt.Errorf("invalid route %s in connection %s: %v", r, c.ID, err)
+			}
+			routes = append(routes, r)
+		}
+	}
+
+	return normalizedCIDRSet(routes), nil
+}
+
+// FindRedundantConnections : returns groups of IDs of connections between the same pair
+// of nodes in which each node advertises the same routes, and which are therefore likely
+// redundant. Connections with a failover priority are deliberately parallel, and never
+// reported. Both the groups and the IDs within them are sorted.
+func FindRedundantConnections(conns []*Connection) [][]string {
+
+	groups := map[string][]string{}
+	for _, c := range conns {
+		if c.Priority != nil || len(c.PeerSettings) != 2 {
+			continue
+		}
+		sides := []string{}
+		for _, peer := range c.PeerSettings {
+			routes := []string{}
+			if peer.RoutingRules != nil {
+				routes = normalizedCIDRSet(peer.RoutingRules.AllowedIPs)
+			}
+			sides = append(sides, peer.NodeID+"="+strings.Join(routes, ","))
+		}
+		sort.Strings(sides)
+		key := strings.Join(sides, ";")
+		groups[key] = append(groups[key], c.ID)
+	}
+
+	res := [][]string{}
+	for _, ids := range groups {
+		if len(ids) > 1 {
+			sort.Strings(ids)
+			res = append(res, ids)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i][0] < res[j][0]
+	})
+
+	return res
+}
+
+// UnlimitedBandwidth is reported by EffectiveBandwidth for
+// active connections without a rate limit.
+const UnlimitedBandwidth = -1
+
+// EffectiveBandwidth : returns, for each of the connections passed as argument, the
+// bandwidth in kbps it is allocated. Among parallel connections between the same pair
+// of nodes, only those with the lowest failover priority carry traffic, each up to its
+// rate limit, and the others are allocated nothing while on standby. Connections without
+// a priority are always active, and disabled connections are never allocated anything.
+func EffectiveBandwidth(conns []*Connection) map[string]int {
+
+	best := map[string]int{}
+	for _, c := range conns {
+		if c.Priority == nil || !c.IsEnabled() {
+			continue
+		}
+		key := nodePairKey(c)
+		if p, ok := best[key]; !ok || *c.Priority < p {
+			best[key] = *c.Priority
+		}
+	}
+
+	res := map[string]int{}
+	for _, c := range conns {
+		switch {
+		case !c.IsEnabled():
+			res[c.ID] = 0
+		case c.Priority != nil && *c.Priority > best[nodePairKey(c)]:
+			res[c.ID] = 0
+		case c.RateLimitKbps == nil:
+			res[c.ID] = UnlimitedBandwidth
+		default:
+			res[c.ID] = *c.RateLimitKbps
+		}
+	}
+
+	return res
+}
+
+// nodePairKey returns a key identifying the unordered pair of nodes linked by a connection.
+func nodePairKey(c *Connection) string {
+	return strings.Join(c.ConnectedNodeIDs(), ":")
+}
+
+// ShortestPath : returns the IDs of the nodes along one of the shortest paths between
+// two nodes, through the graph formed by the connections passed as argument, including
+// both ends. Parallel connections between the same nodes count as a single edge, and
+// ties are broken by visiting neighbors in lexicographic order.
+func ShortestPath(conns []*Connection, fromNode, toNode string) ([]string, error) {
+
+	neighbors := map[string]map[string]struct{}{}
+	for _, c := range conns {
+		if len(c.PeerSettings) != 2 {
+			continue
+		}
+		a, b := c.PeerSettings[0].NodeID, c.PeerSettings[1].NodeID
+		if a == "" || b == "" || a == b {
+			continue
+		}
+		for _, pair := range [][2]string{{a, b}, {b, a}} {
+			if _, ok := neighbors[pair[0]]; !ok {
+				neighbors[pair[0]] = map[string]struct{}{}
+			}
+			neighbors[pair[0]][pair[1]] = struct{}{}
+		}
+	}
+
+	if _, ok := neighbors[fromNode]; !ok {
+		return nil, fmt.Errorf("node %s is not part of any connection", fromNode)
+	}
+
+	previous := map[string]string{fromNode: ""}
+	queue := []string{fromNode}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+
+		if cur == toNode {
+			path := []string{}
+			for n := toNode; n != ""; n = previous[n] {
+				path = append([]string{n}, path...)
+			}
+			return path, nil
+		}
+
+		next := []string{}
+		for n := range neighbors[cur] {
+			next = append(next, n)
+		}
+		sort.Strings(next)
+		for _, n := range next {
+			if _, ok := previous[n]; !ok {
+				previous[n] = cur
+				queue = append(queue, n)
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("node %s is not reachable from node %s", toNode, fromNode)
+}
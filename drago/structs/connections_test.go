@@ -0,0 +1,724 @@
+package structs
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestGroupConnectionsBySubnet(t *testing.T) {
+
+	a := newTestConnection()
+	a.ID = "conn-a"
+	a.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.0/24"}
+	a.PeerSettings[1].RoutingRules.AllowedIPs = []string{"10.0.1.0/24"}
+
+	b := newTestConnection()
+	b.ID = "conn-b"
+	b.PeerSettings[0].RoutingRules.AllowedIPs = []string{"192.168.1.0/24"}
+	b.PeerSettings[1].RoutingRules.AllowedIPs = []string{"10.0.0.128/25"}
+
+	res, err := GroupConnectionsBySubnet([]*Connection{a, b}, []string{"10.0.0.0/16", "10.0.1.0/24", "172.16.0.0/12"})
+	if err != nil {
+		t.Fatalf("GroupConnectionsBySubnet() failed, unexpected error: %v", err)
+	}
+
+	expected := map[string][]string{
+		"10.0.0.0/16":   {"conn-a", "conn-b"}, // overlapping
+		"10.0.1.0/24":   {"conn-a"},           // exact match
+		"172.16.0.0/12": {},                   // disjoint
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("GroupConnectionsBySubnet() failed, expected %v, have %v", expected, res)
+	}
+
+	if _, err := GroupConnectionsBySubnet([]*Connection{a}, []string{"invalid"}); err == nil {
+		t.Fatalf("GroupConnectionsBySubnet() failed, expected error for invalid subnet")
+	}
+}
+
+func TestSetKeepaliveForConnections(t *testing.T) {
+
+	conns := []*Connection{newTestConnection(), newTestConnection(), newTestConnection()}
+	conns[1].PeerSettings[0].PersistentKeepalive = intPtr(10)
+
+	if err := SetKeepaliveForConnections(conns, intPtr(25)); err != nil {
+		t.Fatalf("SetKeepaliveForConnections() failed, unexpected error: %v", err)
+	}
+	for _, c := range conns {
+		if c.PersistentKeepalive == nil || *c.PersistentKeepalive != 25 {
+			t.Fatalf("SetKeepaliveForConnections() failed, expected keepalive %d, have %v", 25, c.PersistentKeepalive)
+		}
+		if c.UpdatedAt.IsZero() {
+			t.Fatalf("SetKeepaliveForConnections() failed, UpdatedAt was not touched")
+		}
+		if err := c.Validate(); err != nil {
+			t.Fatalf("SetKeepaliveForConnections() failed, connection does not validate: %v", err)
+		}
+	}
+
+	if err := SetKeepaliveForConnections(conns, nil); err != nil {
+		t.Fatalf("SetKeepaliveForConnections() failed, unexpected error: %v", err)
+	}
+	for _, c := range conns {
+		if c.PersistentKeepalive != nil {
+			t.Fatalf("SetKeepaliveForConnections() failed, expected keepalive to be cleared")
+		}
+	}
+
+	// Invalid values are rejected before any connection is modified
+	if err := SetKeepaliveForConnections(conns, intPtr(-1)); err == nil {
+		t.Fatalf("SetKeepaliveForConnections() failed, expected error for invalid keepalive")
+	}
+	for _, c := range conns {
+		if c.PersistentKeepalive != nil {
+			t.Fatalf("SetKeepaliveForConnections() failed, connections were modified despite the error")
+		}
+	}
+}
+
+func TestMergeConnections(t *testing.T) {
+
+	a := newTestConnection()
+	a.ID = "conn-a"
+
+	b := newTestConnection()
+	b.ID = "conn-b"
+	b.PeerSettings[0].InterfaceID = "iface-c"
+
+	// Disjoint connections are passed through
+	res, err := MergeConnections([]*Connection{a, b})
+	if err != nil {
+		t.Fatalf("MergeConnections() failed, unexpected error: %v", err)
+	}
+	if len(res) != 2 || res[0].ID != "conn-a" || res[1].ID != "conn-b" {
+		t.Fatalf("MergeConnections() failed, expected both connections, have %+v", res)
+	}
+
+	// Duplicate pairs are merged, regardless of peer order
+	override := &Connection{
+		NetworkID:           "network-1",
+		PersistentKeepalive: intPtr(25),
+		PeerSettings: []*PeerSettings{
+			{InterfaceID: "iface-b", RoutingRules: &RoutingRules{AllowedIPs: []string{"10.0.1.0/24"}}},
+			{InterfaceID: "iface-a"},
+		},
+	}
+	res, err = MergeConnections([]*Connection{a, b, override})
+	if err != nil {
+		t.Fatalf("MergeConnections() failed, unexpected error: %v", err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("MergeConnections() failed, expected %d connections, have %d", 2, len(res))
+	}
+	if res[0].PersistentKeepalive == nil || *res[0].PersistentKeepalive != 25 {
+		t.Fatalf("MergeConnections() failed, expected keepalive to be merged")
+	}
+	routes := res[0].PeerSettingsByInterfaceID("iface-b").RoutingRules.AllowedIPs
+	if !reflect.DeepEqual(routes, []string{"10.0.1.0/24"}) {
+		t.Fatalf("MergeConnections() failed, expected routes %v, have %v", []string{"10.0.1.0/24"}, routes)
+	}
+	if a.PersistentKeepalive != nil || a.PeerSettings[1].RoutingRules.AllowedIPs[0] != "10.0.0.2/32" {
+		t.Fatalf("MergeConnections() failed, input connection was modified")
+	}
+
+	// Conflicting networks within a group
+	override.NetworkID = "network-2"
+	if _, err := MergeConnections([]*Connection{a, override}); err == nil {
+		t.Fatalf("MergeConnections() failed, expected error for conflicting networks")
+	}
+}
+
+func TestReachabilityGraph(t *testing.T) {
+
+	link := func(nodeA, nodeB string, routesA, routesB []string) *Connection {
+		c, err := NewConnectionBetween("network-1", "iface-"+nodeA+nodeB, nodeA, "iface-"+nodeB+nodeA, nodeB)
+		if err != nil {
+			t.Fatalf("NewConnectionBetween() failed, unexpected error: %v", err)
+		}
+		c.PeerSettings[0].RoutingRules.AllowedIPs = routesA
+		c.PeerSettings[1].RoutingRules.AllowedIPs = routesB
+		return c
+	}
+
+	// Linear chain, in which B routes traffic between A and C
+	conns := []*Connection{
+		link("a", "b", []string{"10.0.0.1/32"}, []string{"10.0.0.2/32", "10.0.0.3/32"}),
+		link("b", "c", []string{"10.0.0.2/32", "10.0.0.1/32"}, []string{"10.0.0.3/32"}),
+	}
+
+	expected := map[string][]string{
+		"a": {"b", "c"},
+		"b": {"a", "c"},
+		"c": {"a", "b"},
+	}
+	if res := ReachabilityGraph(conns); !reflect.DeepEqual(res, expected) {
+		t.Fatalf("ReachabilityGraph() failed, expected %v, have %v", expected, res)
+	}
+
+	// Without B advertising the ends of the chain, plus a disconnected pair
+	conns = []*Connection{
+		link("a", "b", []string{"10.0.0.1/32"}, []string{"10.0.0.2/32"}),
+		link("b", "c", []string{"10.0.0.2/32"}, []string{"10.0.0.3/32"}),
+		link("d", "e", []string{"10.0.1.1/32"}, []string{"10.0.1.2/32"}),
+	}
+
+	expected = map[string][]string{
+		"a": {"b"},
+		"b": {"a", "c"},
+		"c": {"b"},
+		"d": {"e"},
+		"e": {"d"},
+	}
+	if res := ReachabilityGraph(conns); !reflect.DeepEqual(res, expected) {
+		t.Fatalf("ReachabilityGraph() failed, expected %v, have %v", expected, res)
+	}
+}
+
+func TestValidateConnections(t *testing.T) {
+
+	valid := newTestConnection()
+
+	// Several independent errors in the same connection
+	multi := newTestConnection()
+	multi.MTU = intPtr(100)
+	multi.DSCP = intPtr(64)
+	multi.Labels = []string{"Invalid Label"}
+	multi.PeerSettings[1].RoutingRules.AllowedIPs = []string{"invalid"}
+	multi.PeerSettings[1].ListenPort = intPtr(0)
+
+	// Structural errors don't prevent further checks
+	selfConnected := newTestConnection()
+	selfConnected.PeerSettings[1].InterfaceID = "iface-a"
+	selfConnected.PeerSettings[1].NodeID = "node-a"
+	selfConnected.MTU = intPtr(100)
+
+	res := ValidateConnections([]*Connection{valid, multi, valid.Clone(), selfConnected})
+
+	expected := map[int][]string{
+		1: {"invalid label", "invalid MTU", "invalid DSCP", "invalid allowed IP", "invalid listen port"},
+		3: {"can't connect an interface to itself", "invalid MTU"},
+	}
+	if len(res) != len(expected) {
+		t.Fatalf("ValidateConnections() failed, expected errors for %d connections, have %v", len(expected), res)
+	}
+	for i, substrs := range expected {
+		if len(res[i]) != len(substrs) {
+			t.Fatalf("ValidateConnections() failed, expected %d errors for connection %d, have %v", len(substrs), i, res[i])
+		}
+		for j, substr := range substrs {
+			if !strings.Contains(res[i][j].Error(), substr) {
+				t.Fatalf("ValidateConnections() failed, expected error containing %q, have %q", substr, res[i][j])
+			}
+		}
+	}
+}
+
+func TestSnapshotConnections(t *testing.T) {
+
+	live := []*Connection{newTestConnection(), newTestConnection(), newTestConnection(), newTestConnection()}
+	live[0].Tags = map[string]string{"owner": "team-a"}
+
+	snapshot := SnapshotConnections(live)
+	if plan := Reconcile(snapshot, live); !plan.IsEmpty() {
+		t.Fatalf("Reconcile() failed, expected empty plan, have %+v", plan)
+	}
+
+	// Stage changes to the live set
+	live[0].Tags["owner"] = "team-b"
+	live[1].PeerSettings[0].RoutingRules.AllowedIPs = append(live[1].PeerSettings[0].RoutingRules.AllowedIPs, "10.1.0.0/16")
+	deleted := live[2].ID
+	created := newTestConnection()
+	live = []*Connection{live[0], live[1], live[3], created}
+
+	if snapshot[0].Tags["owner"] != "team-a" || len(snapshot[1].PeerSettings[0].RoutingRules.AllowedIPs) != 1 {
+		t.Fatalf("SnapshotConnections() failed, snapshot was modified through the live set")
+	}
+
+	plan := Reconcile(snapshot, live)
+	if len(plan.Creates) != 1 || plan.Creates[0] != created {
+		t.Fatalf("Reconcile() failed, expected to create %s, have %v", created.ID, plan.Creates)
+	}
+	if len(plan.Updates) != 2 || plan.Updates[0] != live[0] || plan.Updates[1] != live[1] {
+		t.Fatalf("Reconcile() failed, expected %d updates, have %v", 2, plan.Updates)
+	}
+	if !reflect.DeepEqual(plan.Deletes, []string{deleted}) {
+		t.Fatalf("Reconcile() failed, expected to delete %v, have %v", []string{deleted}, plan.Deletes)
+	}
+}
+
+func TestValidateNetwork(t *testing.T) {
+
+	link := func(id, ifaceA, ifaceB string, routesA, routesB []string) *Connection {
+		c := newTestConnection()
+		c.ID = id
+		c.PeerSettings[0].InterfaceID = ifaceA
+		c.PeerSettings[0].RoutingRules.AllowedIPs = routesA
+		c.PeerSettings[1].InterfaceID = ifaceB
+		c.PeerSettings[1].RoutingRules.AllowedIPs = routesB
+		return c
+	}
+
+	limits := Limits{MaxRoutesPerConnection: 3, MaxConnectionsPerInterface: 2}
+
+	// Healthy hub and spoke network
+	conns := []*Connection{
+		link("conn-1", "hub", "spoke-1", []string{"10.0.0.2/32"}, []string{"10.0.0.1/32"}),
+		link("conn-2", "hub", "spoke-2", []string{"10.0.0.3/32"}, []string{"10.0.0.1/32"}),
+	}
+	if errs := ValidateNetwork(conns, []string{"hub", "spoke-1", "spoke-2"}, limits); len(errs) != 0 {
+		t.Fatalf("ValidateNetwork() failed, unexpected errors: %v", errs)
+	}
+
+	// Network with several violations
+	conns = append(conns,
+		link("conn-3", "spoke-1", "hub", []string{"10.0.0.1/32"}, []string{"10.0.0.2/32"}),
+		link("conn-4", "hub", "spoke-3", []string{"10.0.0.0/24", "10.1.0.0/24", "10.2.0.0/24"}, []string{"10.0.0.1/32"}),
+		link("conn-5", "spoke-3", "spoke-3", nil, nil),
+	)
+
+	errs := ValidateNetwork(conns, []string{"hub", "spoke-1", "spoke-2", "spoke-3", "spoke-4"}, limits)
+
+	expected := []string{
+		"connections conn-1 and conn-3 connect the same interfaces",
+		"connection conn-4 has 4 routes",
+		"connection conn-5 is invalid",
+		"routes 10.0.0.2/32 (connection conn-1) and 10.0.0.0/24 (connection conn-4) of interface hub overlap",
+		"routes 10.0.0.3/32 (connection conn-2) and 10.0.0.0/24 (connection conn-4) of interface hub overlap",
+		"interface hub has 3 connections",
+		"interface spoke-4 is not connected to any peer",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("ValidateNetwork() failed, expected %d errors, have %d: %v", len(expected), len(errs), errs)
+	}
+	for i, err := range errs {
+		if !strings.Contains(err.Error(), expected[i]) {
+			t.Fatalf("ValidateNetwork() failed, expected error containing %q, have %q", expected[i], err)
+		}
+	}
+}
+
+func TestValidateRouteReachability(t *testing.T) {
+
+	c := newTestConnection()
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.0.1/32", "192.168.1.0/24"}
+	c.PeerSettings[1].RoutingRules.AllowedIPs = []string{"10.0.0.2/32", "172.16.5.0/24"}
+
+	nodeRoutes := map[string][]string{
+		"node-a": {"10.0.0.0/24", "192.168.1.0/24"},
+		"node-b": {"10.0.0.2", "172.16.0.0/16"},
+	}
+	if errs := ValidateRouteReachability(c, nodeRoutes); len(errs) != 0 {
+		t.Fatalf("ValidateRouteReachability() failed, unexpected errors: %v", errs)
+	}
+
+	c.PeerSettings[0].RoutingRules.AllowedIPs = append(c.PeerSettings[0].RoutingRules.AllowedIPs, "192.168.0.0/16")
+	delete(nodeRoutes, "node-b")
+
+	errs := ValidateRouteReachability(c, nodeRoutes)
+	expected := []string{
+		"interface iface-a advertises 192.168.0.0/16",
+		"interface iface-b advertises 10.0.0.2/32",
+		"interface iface-b advertises 172.16.5.0/24",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("ValidateRouteReachability() failed, expected %d errors, have %d: %v", len(expected), len(errs), errs)
+	}
+	for i, err := range errs {
+		if !strings.Contains(err.Error(), expected[i]) {
+			t.Fatalf("ValidateRouteReachability() failed, expected error containing %q, have %q", expected[i], err)
+		}
+	}
+}
+
+func TestReassignInterface(t *testing.T) {
+
+	a := newTestConnection()
+	a.ID = "conn-a"
+
+	b := newTestConnection()
+	b.ID = "conn-b"
+	b.PeerSettings[0].InterfaceID = "iface-c"
+
+	c := newTestConnection()
+	c.ID = "conn-c"
+	c.PeerSettings[1].InterfaceID = "iface-c"
+
+	updated, err := ReassignInterface([]*Connection{a, b, c}, "iface-a", "iface-d", "node-d")
+	if err != nil {
+		t.Fatalf("ReassignInterface() failed, unexpected error: %v", err)
+	}
+	if len(updated) != 2 || updated[0].ID != "conn-a" || updated[1].ID != "conn-c" {
+		t.Fatalf("ReassignInterface() failed, expected connections conn-a and conn-c to be updated, have %+v", updated)
+	}
+	for _, u := range updated {
+		peer := u.PeerSettingsByInterfaceID("iface-d")
+		if peer == nil || peer.NodeID != "node-d" || u.ConnectsInterface("iface-a") {
+			t.Fatalf("ReassignInterface() failed, expected iface-a to be replaced in connection %s", u.ID)
+		}
+		if !reflect.DeepEqual(peer.RoutingRules.AllowedIPs, []string{"10.0.0.1/32"}) {
+			t.Fatalf("ReassignInterface() failed, expected peer settings to be preserved, have %v", peer.RoutingRules.AllowedIPs)
+		}
+	}
+	if !a.ConnectsInterface("iface-a") {
+		t.Fatalf("ReassignInterface() failed, input connection was modified")
+	}
+
+	// Reassigning to the other end of any connection fails
+	if _, err := ReassignInterface([]*Connection{a, b, c}, "iface-a", "iface-c", "node-c"); err == nil {
+		t.Fatalf("ReassignInterface() failed, expected error for self-connection")
+	}
+}
+
+func TestToStarTopology(t *testing.T) {
+
+	addrs := map[string]string{"a": "10.0.0.1/32", "b": "10.0.0.2/32", "c": "10.0.0.3/32"}
+
+	link := func(a, b string) *Connection {
+		c := newTestConnection()
+		for i, node := range []string{a, b} {
+			c.PeerSettings[i].NodeID = "node-" + node
+			c.PeerSettings[i].InterfaceID = "iface-" + node
+			c.PeerSettings[i].RoutingRules.AllowedIPs = []string{addrs[node]}
+		}
+		return c
+	}
+
+	mesh := []*Connection{link("a", "b"), link("b", "c"), link("c", "a")}
+
+	star, err := ToStarTopology(mesh, "node-a")
+	if err != nil {
+		t.Fatalf("ToStarTopology() failed, unexpected error: %v", err)
+	}
+	if len(star) != 2 {
+		t.Fatalf("ToStarTopology() failed, expected %d connections, have %d", 2, len(star))
+	}
+
+	expected := [][2][]string{
+		{{"10.0.0.1/32", "10.0.0.3/32"}, {"10.0.0.2/32"}},
+		{{"10.0.0.1/32", "10.0.0.2/32"}, {"10.0.0.3/32"}},
+	}
+	for i, c := range star {
+		if c.PeerSettings[0].NodeID != "node-a" {
+			t.Fatalf("ToStarTopology() failed, expected hub node-a, have %s", c.PeerSettings[0].NodeID)
+		}
+		for j, peer := range c.PeerSettings {
+			if !reflect.DeepEqual(peer.RoutingRules.AllowedIPs, expected[i][j]) {
+				t.Fatalf("ToStarTopology() failed, expected routes %v for %s, have %v", expected[i][j], peer.InterfaceID, peer.RoutingRules.AllowedIPs)
+			}
+		}
+	}
+
+	// Spokes reach each other through the hub
+	graph := ReachabilityGraph(star)
+	for _, node := range []string{"node-a", "node-b", "node-c"} {
+		if len(graph[node]) != 2 {
+			t.Fatalf("ReachabilityGraph() failed, expected %s to reach 2 nodes, have %v", node, graph[node])
+		}
+	}
+
+	if _, err := ToStarTopology(mesh, "node-d"); err == nil {
+		t.Fatalf("ToStarTopology() failed, expected error for unknown hub")
+	}
+}
+
+func TestPeerCountByInterface(t *testing.T) {
+
+	link := func(a, b string) *Connection {
+		c := newTestConnection()
+		c.PeerSettings[0].InterfaceID = a
+		c.PeerSettings[1].InterfaceID = b
+		return c
+	}
+
+	conns := []*Connection{
+		link("hub", "spoke-1"),
+		link("hub", "spoke-2"),
+		link("spoke-3", "hub"),
+		link("hub", "spoke-1"),
+		link("spoke-1", "spoke-2"),
+	}
+
+	counts := PeerCountByInterface(conns)
+	expected := map[string]int{"hub": 3, "spoke-1": 2, "spoke-2": 2, "spoke-3": 1}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("PeerCountByInterface() failed, expected %v, have %v", expected, counts)
+	}
+
+	tests := []struct {
+		limit    int
+		expected []string
+	}{
+		{3, []string{}},
+		{2, []string{"hub"}},
+		{1, []string{"hub", "spoke-1", "spoke-2"}},
+	}
+	for _, tt := range tests {
+		if res := InterfacesOverPeerLimit(counts, tt.limit); !reflect.DeepEqual(res, tt.expected) {
+			t.Fatalf("InterfacesOverPeerLimit() failed for limit %d, expected %v, have %v", tt.limit, tt.expected, res)
+		}
+	}
+}
+
+func TestFindCrossNetworkConnections(t *testing.T) {
+
+	link := func(id, a, b string) *Connection {
+		c := newTestConnection()
+		c.ID = id
+		c.PeerSettings[0].InterfaceID = a
+		c.PeerSettings[1].InterfaceID = b
+		return c
+	}
+
+	conns := []*Connection{
+		link("conn-1", "iface-a", "iface-b"),
+		link("conn-2", "iface-b", "iface-c"),
+		link("conn-3", "iface-c", "iface-d"),
+	}
+
+	ifaceNetwork := map[string]string{
+		"iface-a": "network-1",
+		"iface-b": "network-1",
+		"iface-c": "network-1",
+		"iface-d": "network-1",
+	}
+	if res := FindCrossNetworkConnections(conns, ifaceNetwork); len(res) != 0 {
+		t.Fatalf("FindCrossNetworkConnections() failed, expected no connections, have %v", res)
+	}
+
+	// Interfaces c and d are moved to another network
+	ifaceNetwork["iface-c"] = "network-2"
+	ifaceNetwork["iface-d"] = "network-2"
+	if res := FindCrossNetworkConnections(conns, ifaceNetwork); !reflect.DeepEqual(res, []string{"conn-2"}) {
+		t.Fatalf("FindCrossNetworkConnections() failed, expected %v, have %v", []string{"conn-2"}, res)
+	}
+}
+
+func TestValidateNoPortCollision(t *testing.T) {
+
+	a := newTestConnection()
+	a.ID = "conn-a"
+	a.PeerSettings[0].ListenPort = intPtr(51820)
+
+	// Same interface, same port
+	b := newTestConnection()
+	b.ID = "conn-b"
+	b.PeerSettings[0].ListenPort = intPtr(51820)
+	b.PeerSettings[1].InterfaceID = "iface-c"
+
+	// Different interface, different port
+	c := newTestConnection()
+	c.ID = "conn-c"
+	c.PeerSettings[0].InterfaceID = "iface-d"
+	c.PeerSettings[0].ListenPort = intPtr(51821)
+
+	// Same port on another node
+	d := newTestConnection()
+	d.ID = "conn-d"
+	d.PeerSettings[1].ListenPort = intPtr(51821)
+
+	conns := []*Connection{a, b, c, d}
+	if err := ValidateNoPortCollision("node-a", conns); err != nil {
+		t.Fatalf("ValidateNoPortCollision() failed, unexpected error: %v", err)
+	}
+
+	c.PeerSettings[0].ListenPort = intPtr(51820)
+	err := ValidateNoPortCollision("node-a", conns)
+	if err == nil || !strings.Contains(err.Error(), "conn-a") || !strings.Contains(err.Error(), "conn-c") {
+		t.Fatalf("ValidateNoPortCollision() failed, expected error naming conn-a and conn-c, have %v", err)
+	}
+}
+
+func TestRetagConnections(t *testing.T) {
+
+	tags := []map[string]string{
+		{"env": "stage", "owner": "team-a"},
+		{"env": "prod"},
+		nil,
+		{"owner": "stage"},
+		{"env": "stage"},
+	}
+
+	conns := []*Connection{}
+	for _, tag := range tags {
+		c := newTestConnection()
+		c.Tags = tag
+		conns = append(conns, c)
+	}
+
+	if changed := RetagConnections(conns, "env", "stage", "staging"); changed != 2 {
+		t.Fatalf("RetagConnections() failed, expected %d connections changed, have %d", 2, changed)
+	}
+
+	expected := []map[string]string{
+		{"env": "staging", "owner": "team-a"},
+		{"env": "prod"},
+		nil,
+		{"owner": "stage"},
+		{"env": "staging"},
+	}
+	for i, c := range conns {
+		if !reflect.DeepEqual(c.Tags, expected[i]) {
+			t.Fatalf("RetagConnections() failed, expected %v, have %v", expected[i], c.Tags)
+		}
+	}
+
+	if changed := RetagConnections(conns, "env", "stage", "staging"); changed != 0 {
+		t.Fatalf("RetagConnections() failed, expected no connections changed, have %d", changed)
+	}
+}
+
+func TestInterfaceAdvertisedRoutes(t *testing.T) {
+
+	newConn := func(ifaceA string, routesA []string, ifaceB string) *Connection {
+		c := newTestConnection()
+		c.PeerSettings[0].InterfaceID = ifaceA
+		c.PeerSettings[0].RoutingRules.AllowedIPs = routesA
+		c.PeerSettings[1].InterfaceID = ifaceB
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		conns    []*Connection
+		expected []string
+	}{
+		{
+			name:     "single connection",
+			conns:    []*Connection{newConn("iface-a", []string{"10.0.0.1/32", "10.1.0.0/16"}, "iface-b")},
+			expected: []string{"10.0.0.1/32", "10.1.0.0/16"},
+		},
+		{
+			name: "overlapping routes",
+			conns: []*Connection{
+				newConn("iface-a", []string{"10.0.0.1/32", "10.1.0.0/16"}, "iface-b"),
+				newConn("iface-a", []string{"10.1.2.3/16", "10.0.0.1/32"}, "iface-c"),
+			},
+			expected: []string{"10.0.0.1/32", "10.1.0.0/16"},
+		},
+		{
+			name: "disjoint routes",
+			conns: []*Connection{
+				newConn("iface-a", []string{"10.1.0.0/16"}, "iface-b"),
+				newConn("iface-c", []string{"10.2.0.0/16"}, "iface-d"),
+				newConn("iface-a", []string{"fd00::/64", "10.0.0.1/32"}, "iface-c"),
+			},
+			expected: []string{"10.0.0.1/32", "10.1.0.0/16", "fd00::/64"},
+		},
+	}
+
+	for _, tt := range tests {
+		res, err := InterfaceAdvertisedRoutes("iface-a", tt.conns)
+		if err != nil {
+			t.Fatalf("%s: InterfaceAdvertisedRoutes() failed, unexpected error: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(res, tt.expected) {
+			t.Fatalf("%s: InterfaceAdvertisedRoutes() failed, expected %v, have %v", tt.name, tt.expected, res)
+		}
+	}
+
+	if _, err := InterfaceAdvertisedRoutes("iface-a", []*Connection{newConn("iface-a", []string{"invalid"}, "iface-b")}); err == nil {
+		t.Fatalf("InterfaceAdvertisedRoutes() failed, expected error for invalid route")
+	}
+}
+
+func TestFindRedundantConnections(t *testing.T) {
+
+	a, b := newTestConnection(), newTestConnection()
+	b.PeerSettings[0], b.PeerSettings[1] = b.PeerSettings[1], b.PeerSettings[0]
+
+	// Same nodes, but different routes
+	c := newTestConnection()
+	c.PeerSettings[0].RoutingRules.AllowedIPs = []string{"10.0.1.0/24"}
+
+	res := FindRedundantConnections([]*Connection{a, b, c})
+	ids := []string{a.ID, b.ID}
+	sort.Strings(ids)
+	if expected := [][]string{ids}; !reflect.DeepEqual(res, expected) {
+		t.Fatalf("FindRedundantConnections() failed, expected %v, have %v", expected, res)
+	}
+
+	// A deliberate failover pair
+	a.Priority, b.Priority = intPtr(1), intPtr(2)
+	if res := FindRedundantConnections([]*Connection{a, b, c}); len(res) != 0 {
+		t.Fatalf("FindRedundantConnections() failed, expected no redundant connections, have %v", res)
+	}
+}
+
+func TestEffectiveBandwidth(t *testing.T) {
+
+	newConn := func(priority, rateLimit *int) *Connection {
+		c := newTestConnection()
+		c.Priority = priority
+		c.RateLimitKbps = rateLimit
+		return c
+	}
+
+	// Single link
+	a := newConn(nil, intPtr(1000))
+	if res := EffectiveBandwidth([]*Connection{a}); !reflect.DeepEqual(res, map[string]int{a.ID: 1000}) {
+		t.Fatalf("EffectiveBandwidth() failed, expected %d kbps, have %v", 1000, res)
+	}
+
+	// Two links with equal priority are both active
+	a, b := newConn(intPtr(1), intPtr(1000)), newConn(intPtr(1), nil)
+	expected := map[string]int{a.ID: 1000, b.ID: UnlimitedBandwidth}
+	if res := EffectiveBandwidth([]*Connection{a, b}); !reflect.DeepEqual(res, expected) {
+		t.Fatalf("EffectiveBandwidth() failed, expected %v, have %v", expected, res)
+	}
+
+	// The backup link is on standby, regardless of its higher rate limit
+	a, b = newConn(intPtr(1), intPtr(100)), newConn(intPtr(2), intPtr(500))
+	expected = map[string]int{a.ID: 100, b.ID: 0}
+	if res := EffectiveBandwidth([]*Connection{a, b}); !reflect.DeepEqual(res, expected) {
+		t.Fatalf("EffectiveBandwidth() failed, expected %v, have %v", expected, res)
+	}
+
+	// The backup link takes over when the primary one is disabled
+	a.Enabled = boolPtr(false)
+	expected = map[string]int{a.ID: 0, b.ID: 500}
+	if res := EffectiveBandwidth([]*Connection{a, b}); !reflect.DeepEqual(res, expected) {
+		t.Fatalf("EffectiveBandwidth() failed, expected %v, have %v", expected, res)
+	}
+}
+
+func TestShortestPath(t *testing.T) {
+
+	link := func(nodeA, nodeB string) *Connection {
+		c := newTestConnection()
+		c.PeerSettings[0].InterfaceID, c.PeerSettings[0].NodeID = "iface-"+nodeA+nodeB, nodeA
+		c.PeerSettings[1].InterfaceID, c.PeerSettings[1].NodeID = "iface-"+nodeB+nodeA, nodeB
+		return c
+	}
+
+	// A-B (twice), B-C, C-D, A-D and a disconnected pair E-F
+	conns := []*Connection{link("a", "b"), link("b", "a"), link("b", "c"), link("c", "d"), link("a", "d"), link("e", "f")}
+
+	tests := []struct {
+		from, to string
+		expected []string
+	}{
+		{"a", "b", []string{"a", "b"}},
+		{"a", "c", []string{"a", "b", "c"}},
+		{"b", "d", []string{"b", "a", "d"}},
+		{"a", "a", []string{"a"}},
+	}
+
+	for _, test := range tests {
+		path, err := ShortestPath(conns, test.from, test.to)
+		if err != nil {
+			t.Fatalf("ShortestPath() failed, unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(path, test.expected) {
+			t.Fatalf("ShortestPath() failed, expected %v, have %v", test.expected, path)
+		}
+	}
+
+	if _, err := ShortestPath(conns, "a", "e"); err == nil {
+		t.Fatalf("ShortestPath() failed, expected error for unreachable node")
+	}
+	if _, err := ShortestPath(conns, "z", "a"); err == nil {
+		t.Fatalf("ShortestPath() failed, expected error for unknown node")
+	}
+}
@@ -13,6 +13,7 @@ const (
 	errACLAlreadyBootstrapped = "ACL already bootstrapped"
 	errInvalidInput           = "Invalid input"
 	errNotFound               = "Resource not found"
+	errDeleted                = "Resource deleted"
 	errInternal               = "Internal error"
 )
 
@@ -34,6 +35,9 @@ var (
 
 	// ErrNotFound ...
 	ErrNotFound = errors.New(errNotFound)
+
+	// ErrDeleted ...
+	ErrDeleted = errors.New(errDeleted)
 )
 
 // Error :
@@ -7,15 +7,31 @@ import (
 	"time"
 )
 
+const (
+	// AddressFamilyIPv4 ...
+	AddressFamilyIPv4 = "ipv4"
+
+	// AddressFamilyIPv6 ...
+	AddressFamilyIPv6 = "ipv6"
+
+	// AddressFamilyDual ...
+	AddressFamilyDual = "dual"
+)
+
 // Network :
 type Network struct {
 	ID           string
 	Name         string
 	AddressRange string
-	Interfaces   []string
-	Connections  []string
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
+
+	// AddressFamily restricts the IP family of the routes which can be
+	// configured within the network. If empty, both families are allowed.
+	AddressFamily string
+
+	Interfaces  []string
+	Connections []string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
 
 	// Underlying structs for efficiently adding/removing interfaces and connections.
 	// Always use the lazyInterfacesMap() and lazyConnectionsMap() methods for accessing them.
@@ -31,9 +47,23 @@ func (n *Network) Validate() error {
 	if n.AddressRange == "" {
 		return fmt.Errorf("Address range is empty")
 	}
+	switch n.AddressFamily {
+	case "", AddressFamilyIPv4, AddressFamilyIPv6, AddressFamilyDual:
+	default:
+		return fmt.Errorf("Invalid address family %s", n.AddressFamily)
+	}
 	return nil
 }
 
+// SupportsAddressFamily : checks whether routes of a given family are allowed within the network.
+func (n *Network) SupportsAddressFamily(family string) bool {
+	switch n.AddressFamily {
+	case "", AddressFamilyDual:
+		return true
+	}
+	return n.AddressFamily == family
+}
+
 // CheckAddressInRange : Check whether an IP address in CIDR notation
 // is within the allowed range of the network.
 func (n *Network) CheckAddressInRange(ip string) error {
@@ -137,6 +167,9 @@ func (n *Network) Merge(in *Network) *Network {
 	if in.AddressRange != "" {
 		result.AddressRange = in.AddressRange
 	}
+	if in.AddressFamily != "" {
+		result.AddressFamily = in.AddressFamily
+	}
 
 	return &result
 }
@@ -147,6 +180,7 @@ func (n *Network) Stub() *NetworkListStub {
 		ID:               n.ID,
 		Name:             n.Name,
 		AddressRange:     n.AddressRange,
+		AddressFamily:    n.AddressFamily,
 		InterfacesCount:  len(n.Interfaces),
 		ConnectionsCount: len(n.Connections),
 		CreatedAt:        n.CreatedAt,
@@ -159,6 +193,7 @@ type NetworkListStub struct {
 	ID               string
 	Name             string
 	AddressRange     string
+	AddressFamily    string
 	InterfacesCount  int
 	ConnectionsCount int
 	CreatedAt        time.Time
@@ -282,6 +282,30 @@ type NodeInterfaceUpdateRequest struct {
 	WriteRequest
 }
 
+// PeerReport : contains the state of a peer of one of its
+// interfaces, as observed by the agent running on a node.
+type PeerReport struct {
+	InterfaceID string
+	PublicKey   string
+
+	// DiscoveredMTU is the path MTU towards the peer endpoint,
+	// net of the WireGuard overhead, if it could be determined.
+	DiscoveredMTU *int
+
+	// RxBytes and TxBytes count the traffic received from
+	// and transmitted to the peer since it was configured.
+	RxBytes uint64
+	TxBytes uint64
+}
+
+// NodePeerReportRequest :
+type NodePeerReportRequest struct {
+	NodeID string
+	Peers  []*PeerReport
+
+	WriteRequest
+}
+
 // NodeJoinNetworkRequest :
 type NodeJoinNetworkRequest struct {
 	NodeID    string
@@ -0,0 +1,109 @@
+package structs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+func copyIntPtr(p *int) *int {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+func copyStringPtr(p *string) *string {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+func copyBoolPtr(p *bool) *bool {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+func copyTimePtr(p *time.Time) *time.Time {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	res := make(map[string]string, len(m))
+	for k, v := range m {
+		res[k] = v
+	}
+	return res
+}
+
+// sortedKeys returns the keys of a set, in lexicographic order.
+func sortedKeys(m map[string]struct{}) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// unionStrings returns the deduplicated union of a number of lists
+// of strings, preserving the order in which they first appear.
+func unionStrings(lists ...[]string) []string {
+	res := []string{}
+	seen := map[string]struct{}{}
+	for _, list := range lists {
+		for _, s := range list {
+			if _, ok := seen[s]; !ok {
+				seen[s] = struct{}{}
+				res = append(res, s)
+			}
+		}
+	}
+	return res
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validateIdentifier rejects IDs with leading or trailing whitespace or
+// non-printable characters, which usually result from client bugs and
+// make the ID silently mismatch everywhere it is referenced.
+func validateIdentifier(kind, id string) error {
+	if strings.TrimSpace(id) != id {
+		return fmt.Errorf("invalid %s %q: must not have leading or trailing whitespace", kind, id)
+	}
+	for _, r := range id {
+		if !unicode.IsPrint(r) {
+			return fmt.Errorf("invalid %s %q: must not contain non-printable characters", kind, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Operation is a single operation of a JSON Patch document, as
+// defined in RFC 6902.
+type Operation struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	From string `json:"from,omitempty"`
+
+	// Value is empty only if the member is missing, as a JSON null
+	// is kept as is, so that operations can set values to null.
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Apply applies a JSON Patch document to a JSON document, and returns
+// the resulting document. Operations are applied in order, and if any
+// of them fails, an error is returned.
+func Apply(doc, patch []byte) ([]byte, error) {
+
+	ops := []Operation{}
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, fmt.Errorf("invalid patch: %v", err)
+	}
+
+	var root interface{}
+	if err := json.Unmarshal(doc, &root); err != nil {
+		return nil, fmt.Errorf("invalid document: %v", err)
+	}
+
+	for i, op := range ops {
+		var err error
+		if root, err = applyOperation(root, op); err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s) failed: %v", i, op.Op, op.Path, err)
+		}
+	}
+
+	return json.Marshal(root)
+}
+
+func applyOperation(root interface{}, op Operation) (interface{}, error) {
+
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add", "replace", "test":
+		if len(op.Value) == 0 {
+			return nil, errors.New("missing value")
+		}
+		var value interface{}
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, err
+		}
+		switch op.Op {
+		case "add":
+			return add(root, path, value)
+		case "replace":
+			if root, err = remove(root, path); err != nil {
+				return nil, err
+			}
+			return add(root, path, value)
+		default:
+			v, err := get(root, path)
+			if err != nil {
+				return nil, err
+			}
+			if !reflect.DeepEqual(v, value) {
+				return nil, errors.New("value does not match")
+			}
+			return root, nil
+		}
+	case "remove":
+		return remove(root, path)
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" && len(from) < len(path) && reflect.DeepEqual(from, path[:len(from)]) {
+			return nil, fmt.Errorf("cannot move %s into one of its children", op.From)
+		}
+		v, err := get(root, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if root, err = remove(root, from); err != nil {
+				return nil, err
+			}
+		} else {
+			// Copy the value, so that later operations on
+			// either location don't affect the other one.
+			b, _ := json.Marshal(v)
+			json.Unmarshal(b, &v)
+		}
+		return add(root, path, v)
+	}
+
+	return nil, fmt.Errorf("unknown operation %q", op.Op)
+}
+
+// parsePointer splits a JSON Pointer, as defined in RFC 6901,
+// into its unescaped reference tokens.
+func parsePointer(s string) ([]string, error) {
+	if s == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(s, "/") {
+		return nil, fmt.Errorf("invalid path %q", s)
+	}
+	tokens := strings.Split(s[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func get(node interface{}, path []string) (interface{}, error) {
+	for _, t := range path {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			v, ok := n[t]
+			if !ok {
+				return nil, fmt.Errorf("key %q not found", t)
+			}
+			node = v
+		case []interface{}:
+			i, err := arrayIndex(t, len(n)-1)
+			if err != nil {
+				return nil, err
+			}
+			node = n[i]
+		default:
+			return nil, fmt.Errorf("can't reference %q in a scalar value", t)
+		}
+	}
+	return node, nil
+}
+
+// update walks the document down to the container referenced by all but the
+// last token of the path, and replaces it with the result of fn. It returns
+// the updated document, since modifying arrays may reallocate them.
+func update(node interface{}, path []string, fn func(interface{}, string) (interface{}, error)) (interface{}, error) {
+
+	if len(path) == 1 {
+		return fn(node, path[0])
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("key %q not found", path[0])
+		}
+		v, err := update(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		n[path[0]] = v
+		return n, nil
+	case []interface{}:
+		i, err := arrayIndex(path[0], len(n)-1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := update(n[i], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = v
+		return n, nil
+	}
+
+	return nil, fmt.Errorf("can't reference %q in a scalar value", path[0])
+}
+
+func add(root interface{}, path []string, value interface{}) (interface{}, error) {
+
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return update(root, path, func(node interface{}, key string) (interface{}, error) {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			n[key] = value
+			return n, nil
+		case []interface{}:
+			i := len(n)
+			if key != "-" {
+				var err error
+				if i, err = arrayIndex(key, len(n)); err != nil {
+					return nil, err
+				}
+			}
+			n = append(n, nil)
+			copy(n[i+1:], n[i:])
+			n[i] = value
+			return n, nil
+		}
+		return nil, fmt.Errorf("can't add %q to a scalar value", key)
+	})
+}
+
+func remove(root interface{}, path []string) (interface{}, error) {
+
+	if len(path) == 0 {
+		return nil, errors.New("can't remove the whole document")
+	}
+
+	return update(root, path, func(node interface{}, key string) (interface{}, error) {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			if _, ok := n[key]; !ok {
+				return nil, fmt.Errorf("key %q not found", key)
+			}
+			delete(n, key)
+			return n, nil
+		case []interface{}:
+			i, err := arrayIndex(key, len(n)-1)
+			if err != nil {
+				return nil, err
+			}
+			return append(n[:i], n[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("can't remove %q from a scalar value", key)
+	})
+}
+
+// arrayIndex parses an array index, checking that it is within [0, max].
+func arrayIndex(s string, max int) (int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 || i > max || (len(s) > 1 && s[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", s)
+	}
+	return i, nil
+}
@@ -0,0 +1,69 @@
+package jsonpatch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+
+	doc := `{"a":{"b":[1,2,3]},"c":"x"}`
+
+	tests := []struct {
+		patch    string
+		expected string
+	}{
+		{`[{"op":"add","path":"/a/b/-","value":4}]`, `{"a":{"b":[1,2,3,4]},"c":"x"}`},
+		{`[{"op":"add","path":"/a/b/0","value":0}]`, `{"a":{"b":[0,1,2,3]},"c":"x"}`},
+		{`[{"op":"remove","path":"/a/b/1"}]`, `{"a":{"b":[1,3]},"c":"x"}`},
+		{`[{"op":"replace","path":"/c","value":"y"}]`, `{"a":{"b":[1,2,3]},"c":"y"}`},
+		{`[{"op":"move","from":"/c","path":"/d"}]`, `{"a":{"b":[1,2,3]},"d":"x"}`},
+		{`[{"op":"copy","from":"/a/b","path":"/e"}]`, `{"a":{"b":[1,2,3]},"c":"x","e":[1,2,3]}`},
+		{`[{"op":"test","path":"/c","value":"x"},{"op":"remove","path":"/a"}]`, `{"c":"x"}`},
+		{`[{"op":"add","path":"/d","value":null}]`, `{"a":{"b":[1,2,3]},"c":"x","d":null}`},
+		{`[{"op":"replace","path":"/c","value":null}]`, `{"a":{"b":[1,2,3]},"c":null}`},
+		{`[{"op":"replace","path":"/c","value":null},{"op":"test","path":"/c","value":null}]`, `{"a":{"b":[1,2,3]},"c":null}`},
+		{`[{"op":"move","from":"/a/b","path":"/a/b"}]`, `{"a":{"b":[1,2,3]},"c":"x"}`},
+	}
+
+	for _, test := range tests {
+		res, err := Apply([]byte(doc), []byte(test.patch))
+		if err != nil {
+			t.Fatalf("Apply() failed, unexpected error for %s: %v", test.patch, err)
+		}
+		if string(res) != test.expected {
+			t.Fatalf("Apply() failed, expected %s, have %s", test.expected, res)
+		}
+	}
+}
+
+func TestApplyInvalid(t *testing.T) {
+
+	doc := `{"a":{"b":[1,2,3]},"c":"x"}`
+
+	patches := []string{
+		`{"op":"add"}`,
+		`[{"op":"unknown","path":"/c"}]`,
+		`[{"op":"add","path":"/c"}]`,
+		`[{"op":"remove","path":"/z"}]`,
+		`[{"op":"remove","path":"/a/b/3"}]`,
+		`[{"op":"add","path":"/a/b/5","value":5}]`,
+		`[{"op":"add","path":"/z/y","value":1}]`,
+		`[{"op":"test","path":"/c","value":"y"}]`,
+		`[{"op":"replace","path":"c","value":"y"}]`,
+		`[{"op":"test","path":"/c","value":null}]`,
+		`[{"op":"move","from":"/a","path":"/a/b"}]`,
+	}
+
+	for _, patch := range patches {
+		if res, err := Apply([]byte(doc), []byte(patch)); err == nil {
+			t.Fatalf("Apply() failed, expected error for %s, have %s", patch, res)
+		}
+	}
+
+	// Moves into a child are rejected before looking up the location
+	_, err := Apply([]byte(doc), []byte(`[{"op":"move","from":"/a","path":"/a/b/0"}]`))
+	if err == nil || !strings.Contains(err.Error(), "children") {
+		t.Fatalf("Apply() failed, expected error for move into a child, have %v", err)
+	}
+}
@@ -3,8 +3,11 @@ package uuid
 import (
 	"crypto/rand"
 	"fmt"
+	"regexp"
 )
 
+var uuidRegexp = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
 func Generate() string {
 	buf := make([]byte, 16)
 	if _, err := rand.Read(buf); err != nil {
@@ -17,3 +20,8 @@ func Generate() string {
 		buf[8:10],
 		buf[10:16])
 }
+
+// IsValid checks whether a string is shaped like the UUIDs returned by Generate.
+func IsValid(s string) bool {
+	return uuidRegexp.MatchString(s)
+}